@@ -40,6 +40,15 @@ var addEntryIp string
 // Service name
 var addEntryServiceName string
 
+// Target of an alias
+var addEntryTarget string
+
+// Port
+var addEntryPort int32
+
+// Protocol
+var addEntryProtocol string
+
 var addEntryCmd = &cobra.Command{
 	Use:   "add",
 	Short: "Add a new DNS entry",
@@ -57,14 +66,20 @@ func init() {
 	addEntryCmd.Flags().StringVar(&addEntryFqdn, "fqdn", "", "FQDN of the DNS entry")
 	addEntryCmd.Flags().StringVar(&addEntryIp, "ip", "", "IP of the DNS entry")
 	addEntryCmd.Flags().StringVar(&addEntryServiceName, "serviceName", "", "service name")
+	addEntryCmd.Flags().StringVar(&addEntryTarget, "target", "", "FQDN of the entry of the organization aliased by the DNS entry, instead of an IP")
+	addEntryCmd.Flags().Int32Var(&addEntryPort, "port", 0, "Port of the service, adds a SRV record")
+	addEntryCmd.Flags().StringVar(&addEntryProtocol, "protocol", "", "Protocol of the port (tcp or udp), tcp by default")
 	addEntryCmd.MarkFlagRequired("orgId")
 	addEntryCmd.MarkFlagRequired("fqdn")
-	addEntryCmd.MarkFlagRequired("ip")
 	addEntryCmd.MarkFlagRequired("serviceName")
 }
 
 func addEntry() {
 
+	if (addEntryIp == "") == (addEntryTarget == "") {
+		log.Fatal().Msg("either ip or target is required")
+	}
+
 	conn, err := grpc.Dial(addEntryServer, grpc.WithInsecure())
 
 	if err != nil {
@@ -78,6 +93,9 @@ func addEntry() {
 		ServiceName:    addEntryServiceName,
 		Fqdn:           addEntryFqdn,
 		Ip:             addEntryIp,
+		Target:         addEntryTarget,
+		Port:           addEntryPort,
+		Protocol:       addEntryProtocol,
 	}
 
 	_, err = client.AddDNSEntry(context.Background(), &request)
@@ -0,0 +1,107 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var addServiceEntryServer string
+
+// Organization ID
+var addServiceEntryOrganizationId string
+
+// FQDN
+var addServiceEntryFqdn string
+
+// IP
+var addServiceEntryIp string
+
+// Target of an alias
+var addServiceEntryTarget string
+
+// Port
+var addServiceEntryPort int32
+
+// Protocol
+var addServiceEntryProtocol string
+
+// Tags
+var addServiceEntryTags []string
+
+var addServiceEntryCmd = &cobra.Command{
+	Use:   "service-add",
+	Short: "Add a new service DNS entry",
+	Long:  `Add a new service DNS entry of an organization`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		addServiceEntry()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(addServiceEntryCmd)
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryServer, "server", "localhost:8000", "Networking manager server URL")
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryOrganizationId, "orgId", "", "Organization ID")
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryFqdn, "fqdn", "", "FQDN of the DNS entry")
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryIp, "ip", "", "IP of the DNS entry")
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryTarget, "target", "", "FQDN of the entry of the organization aliased by the DNS entry, instead of an IP")
+	addServiceEntryCmd.Flags().Int32Var(&addServiceEntryPort, "port", 0, "Port of the service, adds a SRV record")
+	addServiceEntryCmd.Flags().StringVar(&addServiceEntryProtocol, "protocol", "", "Protocol of the port (tcp or udp), tcp by default")
+	addServiceEntryCmd.Flags().StringSliceVar(&addServiceEntryTags, "tag", []string{}, "Tag of the DNS entry")
+	addServiceEntryCmd.MarkFlagRequired("orgId")
+	addServiceEntryCmd.MarkFlagRequired("fqdn")
+}
+
+func addServiceEntry() {
+
+	if (addServiceEntryIp == "") == (addServiceEntryTarget == "") {
+		log.Fatal().Msg("either ip or target is required")
+	}
+
+	conn, err := grpc.Dial(addServiceEntryServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", addServiceEntryServer)
+	}
+
+	client := grpc_network_go.NewServiceDNSClient(conn)
+
+	request := grpc_network_go.AddServiceDNSEntryRequest{
+		OrganizationId: addServiceEntryOrganizationId,
+		Fqdn:           addServiceEntryFqdn,
+		Ip:             addServiceEntryIp,
+		Target:         addServiceEntryTarget,
+		Port:           addServiceEntryPort,
+		Protocol:       addServiceEntryProtocol,
+		Tags:           addServiceEntryTags,
+	}
+
+	_, err = client.AddEntry(context.Background(), &request)
+	if err != nil {
+		log.Error().Err(err).Msgf("error adding service dns entry %s", addServiceEntryFqdn)
+		return
+	}
+
+	log.Info().Msg("OK")
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var deleteServiceEntryServer string
+
+// Organization ID
+var deleteServiceEntryOrganizationId string
+
+// FQDN
+var deleteServiceEntryFqdn string
+
+var deleteServiceEntryCmd = &cobra.Command{
+	Use:   "service-delete",
+	Short: "Delete a service DNS entry",
+	Long:  `Delete a service DNS entry of an organization`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		deleteServiceEntry()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(deleteServiceEntryCmd)
+	deleteServiceEntryCmd.Flags().StringVar(&deleteServiceEntryServer, "server", "localhost:8000", "Networking manager server URL")
+	deleteServiceEntryCmd.Flags().StringVar(&deleteServiceEntryOrganizationId, "orgId", "", "Organization ID")
+	deleteServiceEntryCmd.Flags().StringVar(&deleteServiceEntryFqdn, "fqdn", "", "FQDN of the DNS entry")
+	deleteServiceEntryCmd.MarkFlagRequired("orgId")
+	deleteServiceEntryCmd.MarkFlagRequired("fqdn")
+}
+
+func deleteServiceEntry() {
+
+	conn, err := grpc.Dial(deleteServiceEntryServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", deleteServiceEntryServer)
+	}
+
+	client := grpc_network_go.NewServiceDNSClient(conn)
+
+	request := grpc_network_go.DeleteServiceDNSEntryRequest{
+		OrganizationId: deleteServiceEntryOrganizationId,
+		Fqdn:           deleteServiceEntryFqdn,
+	}
+
+	_, err = client.DeleteEntry(context.Background(), &request)
+	if err != nil {
+		log.Error().Err(err).Msgf("error deleting service dns entry %s", deleteServiceEntryFqdn)
+		return
+	}
+
+	log.Info().Msg("OK")
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/network-manager/internal/pkg/zonefile"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"os"
+)
+
+// GRPC server address
+var exportEntriesServer string
+
+// Organization ID
+var exportEntriesOrganizationId string
+
+// Output file, - for the standard output
+var exportEntriesOutput string
+
+// TTL of the records
+var exportEntriesTTL uint32
+
+var exportEntriesCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the DNS entries of an organization",
+	Long:  `Export the DNS entries of an organization in zone file format (RFC 1035)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		exportEntries()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(exportEntriesCmd)
+	exportEntriesCmd.Flags().StringVar(&exportEntriesServer, "server", "localhost:8000", "Networking manager server URL")
+	exportEntriesCmd.Flags().StringVar(&exportEntriesOrganizationId, "orgId", "", "Organization ID")
+	exportEntriesCmd.Flags().StringVar(&exportEntriesOutput, "output", "-", "Zone file, - for the standard output")
+	exportEntriesCmd.Flags().Uint32Var(&exportEntriesTTL, "ttl", zonefile.DefaultTTL, "TTL of the records in seconds")
+	exportEntriesCmd.MarkFlagRequired("orgId")
+}
+
+func exportEntries() {
+
+	conn, err := grpc.Dial(exportEntriesServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", exportEntriesServer)
+	}
+
+	client := grpc_network_go.NewDNSClient(conn)
+
+	list, err := client.ListEntries(context.Background(), &grpc_organization_go.OrganizationId{
+		OrganizationId: exportEntriesOrganizationId,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msgf("error listing dns entries of %s", exportEntriesOrganizationId)
+	}
+
+	// the entries of the connections and the reverse records are created again by the network manager
+	entries := make([]*grpc_network_go.DNSEntry, 0, len(list.DnsEntries))
+	for _, entry := range list.DnsEntries {
+		if zonefile.IsManaged(entry) {
+			log.Debug().Str("fqdn", entry.Fqdn).Msg("skipping entry managed by the network manager")
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	output := os.Stdout
+	if exportEntriesOutput != "-" {
+		output, err = os.Create(exportEntriesOutput)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("impossible to create %s", exportEntriesOutput)
+		}
+		defer output.Close()
+	}
+
+	wErr := zonefile.Write(output, exportEntriesOrganizationId, entries, exportEntriesTTL)
+	if wErr != nil {
+		log.Fatal().Str("trace", wErr.DebugReport()).Msg("error writing zone file")
+	}
+
+	log.Info().Int("entries", len(entries)).Int("skipped", len(list.DnsEntries)-len(entries)).Msg("entries exported")
+}
@@ -0,0 +1,136 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/nalej/network-manager/internal/pkg/zonefile"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"os"
+	"strings"
+)
+
+// GRPC server address
+var importEntriesServer string
+
+// Organization ID
+var importEntriesOrganizationId string
+
+// Input file
+var importEntriesInput string
+
+// Policy with the entries that already exist
+var importEntriesConflictPolicy string
+
+// Dry run
+var importEntriesDryRun bool
+
+// Number of entries added by request
+var importEntriesBatchSize int
+
+var importEntriesCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import the DNS entries of an organization",
+	Long:  `Import the DNS entries of an organization from a zone file (RFC 1035)`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		importEntries()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importEntriesCmd)
+	importEntriesCmd.Flags().StringVar(&importEntriesServer, "server", "localhost:8000", "Networking manager server URL")
+	importEntriesCmd.Flags().StringVar(&importEntriesOrganizationId, "orgId", "", "Organization ID")
+	importEntriesCmd.Flags().StringVar(&importEntriesInput, "input", "", "Zone file")
+	importEntriesCmd.Flags().StringVar(&importEntriesConflictPolicy, "conflictPolicy", "fail", "Policy with the entries that already exist (skip, overwrite or fail)")
+	importEntriesCmd.Flags().BoolVar(&importEntriesDryRun, "dryRun", false, "Report the changes without adding the entries")
+	importEntriesCmd.Flags().IntVar(&importEntriesBatchSize, "batchSize", 100, "Number of entries added by request")
+	importEntriesCmd.MarkFlagRequired("orgId")
+	importEntriesCmd.MarkFlagRequired("input")
+}
+
+func importEntries() {
+
+	policy, found := grpc_network_go.ConflictPolicy_value[strings.ToUpper(importEntriesConflictPolicy)]
+	if !found {
+		log.Fatal().Str("conflictPolicy", importEntriesConflictPolicy).Msg("conflict policy must be skip, overwrite or fail")
+	}
+	if importEntriesBatchSize <= 0 {
+		log.Fatal().Int("batchSize", importEntriesBatchSize).Msg("batch size must be positive")
+	}
+
+	input, err := os.Open(importEntriesInput)
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to open %s", importEntriesInput)
+	}
+	defer input.Close()
+
+	entries, pErr := zonefile.Parse(input, importEntriesInput)
+	if pErr != nil {
+		log.Fatal().Str("trace", pErr.DebugReport()).Msg("error reading zone file")
+	}
+
+	conn, err := grpc.Dial(importEntriesServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", importEntriesServer)
+	}
+
+	client := grpc_network_go.NewDNSClient(conn)
+
+	// the entries of a dry run are not added, so the aliases can only be checked against their targets in one batch
+	if importEntriesDryRun {
+		importEntriesBatchSize = len(entries)
+	}
+
+	added, replaced, skipped := 0, 0, 0
+	for first := 0; first < len(entries); first += importEntriesBatchSize {
+		last := first + importEntriesBatchSize
+		if last > len(entries) {
+			last = len(entries)
+		}
+		response, err := client.AddDNSEntries(context.Background(), &grpc_network_go.AddDNSEntriesRequest{
+			OrganizationId: importEntriesOrganizationId,
+			Entries:        entries[first:last],
+			ConflictPolicy: grpc_network_go.ConflictPolicy(policy),
+			DryRun:         importEntriesDryRun,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Int("imported", added+replaced).Msgf("error importing entries %d to %d", first+1, last)
+		}
+		for _, fqdn := range response.Added {
+			log.Info().Str("fqdn", fqdn).Bool("dryRun", importEntriesDryRun).Msg("added")
+		}
+		for _, fqdn := range response.Replaced {
+			log.Info().Str("fqdn", fqdn).Bool("dryRun", importEntriesDryRun).Msg("replaced")
+		}
+		for _, fqdn := range response.Skipped {
+			log.Info().Str("fqdn", fqdn).Bool("dryRun", importEntriesDryRun).Msg("skipped")
+		}
+		added += len(response.Added)
+		replaced += len(response.Replaced)
+		skipped += len(response.Skipped)
+	}
+
+	log.Info().Int("added", added).Int("replaced", replaced).Int("skipped", skipped).Bool("dryRun", importEntriesDryRun).
+		Msg("entries imported")
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var listServiceEntriesServer string
+
+// Organization ID
+var listServiceEntriesOrganizationId string
+
+// Maximum number of entries of a page
+var listServiceEntriesPageSize int32
+
+// Token of the page to be listed
+var listServiceEntriesPageToken string
+
+// List every page
+var listServiceEntriesAll bool
+
+var listServiceEntriesCmd = &cobra.Command{
+	Use:   "service-list",
+	Short: "List the service DNS entries of an organization",
+	Long:  `List a page of the service DNS entries of an organization, or all of them with --all`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		listServiceEntries()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listServiceEntriesCmd)
+	listServiceEntriesCmd.Flags().StringVar(&listServiceEntriesServer, "server", "localhost:8000", "Networking manager server URL")
+	listServiceEntriesCmd.Flags().StringVar(&listServiceEntriesOrganizationId, "orgId", "", "Organization ID")
+	listServiceEntriesCmd.Flags().Int32Var(&listServiceEntriesPageSize, "pageSize", 0, "Maximum number of entries of a page (0 for the default size)")
+	listServiceEntriesCmd.Flags().StringVar(&listServiceEntriesPageToken, "pageToken", "", "Token of the page to be listed, returned by the previous page")
+	listServiceEntriesCmd.Flags().BoolVar(&listServiceEntriesAll, "all", false, "List every page")
+	listServiceEntriesCmd.MarkFlagRequired("orgId")
+}
+
+func listServiceEntries() {
+
+	conn, err := grpc.Dial(listServiceEntriesServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", listServiceEntriesServer)
+	}
+
+	client := grpc_network_go.NewServiceDNSClient(conn)
+
+	request := grpc_network_go.ListServiceDNSEntriesRequest{
+		OrganizationId: listServiceEntriesOrganizationId,
+		PageSize:       listServiceEntriesPageSize,
+		PageToken:      listServiceEntriesPageToken,
+	}
+
+	for {
+		list, err := client.ListEntries(context.Background(), &request)
+		if err != nil {
+			log.Error().Err(err).Msgf("error listing service dns entries of %s", listServiceEntriesOrganizationId)
+			return
+		}
+		for _, entry := range list.Entries {
+			log.Info().Str("fqdn", entry.Fqdn).Str("ip", entry.Ip).Str("target", entry.Target).Int32("port", entry.Port).Str("protocol", entry.Protocol).Strs("tags", entry.Tags).Msg("service dns entry")
+		}
+		if list.NextPageToken == "" {
+			return
+		}
+		if !listServiceEntriesAll {
+			log.Info().Str("nextPageToken", list.NextPageToken).Msg("more entries available")
+			return
+		}
+		request.PageToken = list.NextPageToken
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/server"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+var migrateDNSConfig = server.Config{}
+
+// Organizations the entries registered without organization may belong to
+var migrateDNSOrganizations []string
+
+// Only report the entries to be migrated
+var migrateDNSDryRun bool
+
+var migrateDNSCmd = &cobra.Command{
+	Use:   "migrate-dns",
+	Short: "Migrate the DNS entries registered by previous versions",
+	Long: `Move the DNS entries registered in Consul by previous versions to the external node of their organization,
+with the organization in the metadata of the entry`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		migrateDNS()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateDNSCmd)
+	addConsulFlags(migrateDNSCmd, &migrateDNSConfig)
+	migrateDNSCmd.Flags().StringSliceVar(&migrateDNSOrganizations, "organizationId", []string{}, "Organization the entries registered without organization may belong to, besides the ones with entries")
+	migrateDNSCmd.Flags().BoolVar(&migrateDNSDryRun, "dryRun", false, "Only report the entries to be migrated")
+}
+
+func migrateDNS() {
+	client, err := consul.NewConsulClient(migrateDNSConfig.ConsulConfig())
+	if err != nil {
+		log.Fatal().Str("trace", err.DebugReport()).Msg("failed creating dns consul client")
+	}
+
+	report, err := client.Migrate(migrateDNSOrganizations, migrateDNSDryRun)
+	if err != nil {
+		log.Fatal().Str("trace", err.DebugReport()).Msg("error migrating DNS entries")
+	}
+	if migrateDNSDryRun {
+		for _, entry := range report.Migrated {
+			log.Info().Str("organizationId", entry.OrganizationId).Str("fqdn", entry.Fqdn).Str("ip", entry.IP).
+				Msg("DNS entry to be migrated")
+		}
+	}
+	log.Info().Int("migrated", len(report.Migrated)).Strs("skipped", report.Skipped).Int("errors", report.Errors).
+		Bool("dryRun", migrateDNSDryRun).Msg("DNS migration finished")
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/server"
+	"github.com/nalej/network-manager/internal/pkg/server/application"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"os"
+	"time"
+)
+
+var reconcileConfig = server.Config{}
+
+// Organizations to be checked besides the ones with networks in the controller
+var reconcileOrganizations []string
+
+// ZT networks whose issues are fixed
+var reconcileConfirmedNetworks []string
+
+var reconcileIPAMCmd = &cobra.Command{
+	Use:   "reconcile-ipam",
+	Short: "Reconcile the IP ranges of the connections",
+	Long: `Compare the IP ranges of the connections in the system model with the ZT networks of the controller, reporting
+duplicated ranges, orphaned ranges and networks without connection. Orphaned ranges and networks without connection
+are fixed with --fix if they are still found after the grace period. This command does not know the ranges being
+allocated by the running network managers, so only the issues of the networks confirmed with --confirmNetwork are fixed`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		reconcileIPAM()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reconcileIPAMCmd)
+	reconcileIPAMCmd.Flags().StringVar(&reconcileConfig.SystemModelURL, "sm", "localhost:8800", "System Model URL")
+	reconcileIPAMCmd.Flags().StringVar(&reconcileConfig.ZTUrl, "zturl", "http://localhost:9993", "ZT Controller URL")
+	reconcileIPAMCmd.Flags().StringVar(&reconcileConfig.ZTAccessToken, "ztaccesstoken", "", "ZT Access Token")
+	reconcileIPAMCmd.Flags().StringVar(&reconcileConfig.IPAMSupernet, "ipamSupernet", ipam.DefaultSupernet, "Network where the IP ranges of the ZT networks are allocated")
+	reconcileIPAMCmd.Flags().IntVar(&reconcileConfig.IPAMPrefixLength, "ipamPrefixLength", ipam.DefaultPrefixLength, "Prefix length of the IP ranges of the ZT networks")
+	reconcileIPAMCmd.Flags().StringSliceVar(&reconcileConfig.IPAMOrganizations, "ipamOrganization", []string{}, "IP ranges of an organization as <organizationId>=<supernet>:<prefixLength>")
+	reconcileIPAMCmd.Flags().StringSliceVar(&reconcileOrganizations, "organizationId", []string{}, "Organization to reconcile even if it has no networks in the controller")
+	reconcileIPAMCmd.Flags().BoolVar(&reconcileConfig.IPAMReconcileFix, "fix", false, "Fix orphaned IP ranges and ZT networks without connection")
+	reconcileIPAMCmd.Flags().StringSliceVar(&reconcileConfirmedNetworks, "confirmNetwork", []string{}, "ZT network whose IP range issues are fixed with --fix")
+	reconcileIPAMCmd.Flags().DurationVar(&reconcileConfig.IPAMReconcileGracePeriod, "gracePeriod", time.Minute*5, "Time an IP range issue must persist before being fixed")
+}
+
+func reconcileIPAM() {
+	if reconcileConfig.ZTAccessToken == "" {
+		reconcileConfig.ZTAccessToken = os.Getenv("ZT_ACCESS_TOKEN")
+	}
+	if reconcileConfig.ZTAccessToken == "" {
+		log.Fatal().Msg("ZT Access Token must be defined")
+	}
+	// the ranges allocated by the running network managers are not pending in this allocator, so the issues are only
+	// fixed if they persist after a grace period
+	if reconcileConfig.IPAMReconcileFix && reconcileConfig.IPAMReconcileGracePeriod <= 0 {
+		log.Fatal().Msg("grace period must be positive to fix the IP range issues")
+	}
+	if reconcileConfig.IPAMReconcileFix && len(reconcileConfirmedNetworks) == 0 {
+		log.Fatal().Msg("the networks to be fixed must be confirmed with --confirmNetwork")
+	}
+
+	allocator, err := reconcileConfig.NewAllocator()
+	if err != nil {
+		log.Fatal().Str("trace", err.DebugReport()).Msg("invalid IPAM configuration")
+	}
+
+	smConn, dErr := grpc.Dial(reconcileConfig.SystemModelURL, grpc.WithInsecure())
+	if dErr != nil {
+		log.Fatal().Err(dErr).Str("SystemModelURL", reconcileConfig.SystemModelURL).Msg("impossible to establish connection with system-model")
+	}
+	defer smConn.Close()
+
+	ztClient, err := zt.NewZTClient(reconcileConfig.ZTUrl, reconcileConfig.ZTAccessToken)
+	if err != nil {
+		log.Fatal().Str("trace", err.DebugReport()).Msg("impossible to create ZT client")
+	}
+
+	// the reconciliation does not contact the clusters, so no connection helper is required
+	manager, mErr := application.NewManager(smConn, nil, ztClient, allocator, nil)
+	if mErr != nil {
+		log.Fatal().Err(mErr).Msg("failed creating netapp manager")
+	}
+
+	reconciler := application.NewRangeReconciler(manager, 0, reconcileConfig.IPAMReconcileGracePeriod, reconcileConfig.IPAMReconcileFix)
+	reconciler.ConfirmNetworks(reconcileConfirmedNetworks)
+	report, err := reconciler.Reconcile(reconcileOrganizations)
+	if err != nil {
+		log.Fatal().Str("trace", err.DebugReport()).Msg("error reconciling IP ranges")
+	}
+	if reconcileConfig.IPAMReconcileFix && report.Pending > 0 {
+		// a second reconciliation fixes the issues that are still found
+		log.Info().Int("pending", report.Pending).Str("gracePeriod", reconcileConfig.IPAMReconcileGracePeriod.String()).
+			Msg("waiting for the grace period before fixing the issues")
+		time.Sleep(reconcileConfig.IPAMReconcileGracePeriod)
+		report, err = reconciler.Reconcile(reconcileOrganizations)
+		if err != nil {
+			log.Fatal().Str("trace", err.DebugReport()).Msg("error reconciling IP ranges")
+		}
+	}
+	application.LogReconcileReport(report)
+}
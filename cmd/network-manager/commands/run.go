@@ -18,10 +18,16 @@
 package commands
 
 import (
+	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/dnsserver"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/provider/dns"
 	"github.com/nalej/network-manager/internal/pkg/server"
+	"github.com/nalej/network-manager/internal/pkg/zt"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
 )
 
 var config = server.Config{}
@@ -37,6 +43,9 @@ var runCmd = &cobra.Command{
 		if config.ZTAccessToken == "" {
 			config.ZTAccessToken = os.Getenv("ZT_ACCESS_TOKEN")
 		}
+		if config.ZTAccessToken == "" && config.ZTMockup {
+			config.ZTAccessToken = "mockup"
+		}
 
 		config.Print()
 		err := config.Validate()
@@ -55,10 +64,39 @@ func init() {
 	runCmd.Flags().StringVar(&config.SystemModelURL, "sm", "localhost:8800", "System Model URL")
 	runCmd.Flags().StringVar(&config.ZTUrl, "zturl", "http://localhost:9993", "ZT Controller URL")
 	runCmd.Flags().StringVar(&config.ZTAccessToken, "ztaccesstoken", "", "ZT Access Token")
-	runCmd.Flags().StringVar(&config.DNSUrl, "dnsurl", "192.168.99.100:30500", "Consul DNS URL")
+	runCmd.Flags().BoolVar(&config.ZTMockup, "ztMockup", false, "Use an in-memory ZT controller (local development only, requires the ztmockup build tag)")
+	runCmd.Flags().StringVar(&config.ZTIPv6Mode, "ztIPv6Mode", "", "Create dual-stack ZT networks with the given IPv6 assign mode (zt, rfc4193 or 6plane)")
+	runCmd.Flags().IntVar(&config.ZTListWorkers, "ztListWorkers", zt.DefaultListWorkers, "Number of ZT network details requested concurrently when listing networks")
+	runCmd.Flags().DurationVar(&config.ZTMemberGCInterval, "ztMemberGCInterval", 0, "Interval between collections of ZT members not claimed in the system model (0 disables the collector)")
+	runCmd.Flags().DurationVar(&config.ZTMemberGCGracePeriod, "ztMemberGCGracePeriod", time.Hour, "Time a ZT member must be unclaimed before being collected")
+	runCmd.Flags().StringVar(&config.IPAMSupernet, "ipamSupernet", ipam.DefaultSupernet, "Network where the IP ranges of the ZT networks are allocated")
+	runCmd.Flags().IntVar(&config.IPAMPrefixLength, "ipamPrefixLength", ipam.DefaultPrefixLength, "Prefix length of the IP ranges of the ZT networks")
+	runCmd.Flags().StringSliceVar(&config.IPAMOrganizations, "ipamOrganization", []string{}, "IP ranges of an organization as <organizationId>=<supernet>:<prefixLength>")
+	runCmd.Flags().StringSliceVar(&config.IPAMClusterExclusions, "ipamClusterExclusion", []string{}, "CIDR used by a cluster that the IP ranges must not overlap as <clusterId>=<cidr> (* for every cluster)")
+	runCmd.Flags().DurationVar(&config.IPAMReconcileInterval, "ipamReconcileInterval", 0, "Interval between reconciliations of the IP ranges of the connections (0 disables the reconciler)")
+	runCmd.Flags().DurationVar(&config.IPAMReconcileGracePeriod, "ipamReconcileGracePeriod", time.Hour, "Time an IP range issue must persist before being fixed")
+	runCmd.Flags().BoolVar(&config.IPAMReconcileFix, "ipamReconcileFix", false, "Fix orphaned IP ranges and ZT networks without connection instead of only reporting them")
+	runCmd.Flags().StringVar(&config.DNSProvider, "dnsProvider", dns.ConsulBackend, "Backend of the DNS entries (consul or memory)")
+	runCmd.Flags().StringVar(&config.DNSServerAddress, "dnsServerAddress", "", "Address where the built-in DNS server listens, e.g. :5353 (empty disables the server)")
+	runCmd.Flags().StringVar(&config.DNSServerDomain, "dnsServerDomain", dnsserver.DefaultDomain, "Domain of the zones of the organizations served by the built-in DNS server")
+	runCmd.Flags().DurationVar(&config.DNSServerTTL, "dnsServerTTL", dnsserver.DefaultTTL*time.Second, "TTL of the records served by the built-in DNS server")
+	addConsulFlags(runCmd, &config)
 	runCmd.Flags().StringVar(&config.QueueAddress, "queueAddress", "localhost:6650", "Message queue (localhost:6650)")
 	runCmd.Flags().BoolVar(&config.UseTLS, "useTLS", true, "Use TLS to connect to the application cluster API")
 	runCmd.Flags().StringVar(&config.CACertPath, "caCertPath", "", "Path for the CA certificate")
 	runCmd.Flags().StringVar(&config.ClientCertPath, "clientCertPath", "", "Path for the client certificate")
 	runCmd.Flags().BoolVar(&config.SkipServerCertValidation, "skipServerCertValidation", true, "Skip server cert validation")
 }
+
+// addConsulFlags adds the flags of the connections to Consul to a command.
+func addConsulFlags(cmd *cobra.Command, conf *server.Config) {
+	cmd.Flags().StringVar(&conf.DNSUrl, "dnsurl", "192.168.99.100:30500", "Consul DNS URL")
+	cmd.Flags().StringVar(&conf.ConsulScheme, "consulScheme", consul.SchemeHTTP, "Scheme used to connect to Consul (http or https)")
+	cmd.Flags().StringVar(&conf.ConsulDatacenter, "consulDatacenter", consul.DefaultDatacenter, "Consul datacenter where the DNS entries are registered")
+	cmd.Flags().StringVar(&conf.ConsulToken, "consulToken", "", "Token of the Consul ACL")
+	cmd.Flags().StringVar(&conf.ConsulTokenFile, "consulTokenFile", "", "File with the token of the Consul ACL")
+	cmd.Flags().StringVar(&conf.ConsulCACertPath, "consulCACertPath", "", "Path for the CA certificate of the Consul agents")
+	cmd.Flags().StringVar(&conf.ConsulClientCertPath, "consulClientCertPath", "", "Path for the client certificate of Consul")
+	cmd.Flags().StringVar(&conf.ConsulClientKeyPath, "consulClientKeyPath", "", "Path for the key of the client certificate of Consul")
+	cmd.Flags().BoolVar(&conf.ConsulSkipServerCertValidation, "consulSkipServerCertValidation", false, "Skip the validation of the certificates of the Consul agents")
+}
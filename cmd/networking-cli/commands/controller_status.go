@@ -0,0 +1,64 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var controllerStatusServer string
+
+var controllerStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Get the status of the ZT controller",
+	Long:  `Get the address, version and connectivity of the ZT controller`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		controllerStatus()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(controllerStatusCmd)
+	controllerStatusCmd.Flags().StringVar(&controllerStatusServer, "server", "localhost:8000", "Networking manager server URL")
+}
+
+func controllerStatus() {
+
+	conn, err := grpc.Dial(controllerStatusServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", controllerStatusServer)
+	}
+
+	client := grpc_network_go.NewNetworksClient(conn)
+
+	status, err := client.GetControllerStatus(context.Background(), &grpc_common_go.Empty{})
+	if err != nil {
+		log.Error().Err(err).Msg("error retrieving controller status")
+		return
+	}
+
+	log.Info().Msgf("%s", status.String())
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var listMembersServer string
+
+// Organization ID
+var listMembersOrgId string
+
+// Network ID
+var listMembersNetworkId string
+
+// Member ID
+var listMembersMemberId string
+
+var listMembersCmd = &cobra.Command{
+	Use:   "members",
+	Short: "List the members of a network",
+	Long:  `List the members of a network, or get a single member if the member ID is set`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		listMembers()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listMembersCmd)
+	listMembersCmd.Flags().StringVar(&listMembersServer, "server", "localhost:8000", "Networking manager server URL")
+	listMembersCmd.Flags().StringVar(&listMembersOrgId, "orgid", "", "Organization ID")
+	listMembersCmd.Flags().StringVar(&listMembersNetworkId, "netid", "", "Network ID")
+	listMembersCmd.Flags().StringVar(&listMembersMemberId, "memberid", "", "Member ID")
+	listMembersCmd.MarkFlagRequired("orgid")
+	listMembersCmd.MarkFlagRequired("netid")
+}
+
+func listMembers() {
+
+	conn, err := grpc.Dial(listMembersServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", listMembersServer)
+	}
+
+	client := grpc_network_go.NewNetworksClient(conn)
+
+	if listMembersMemberId != "" {
+		request := grpc_network_go.MemberId{
+			OrganizationId: listMembersOrgId,
+			NetworkId:      listMembersNetworkId,
+			MemberId:       listMembersMemberId,
+		}
+		retrievedMember, err := client.GetMember(context.Background(), &request)
+		if err != nil {
+			log.Error().Err(err).Msgf("error retrieving member %s", listMembersMemberId)
+			return
+		}
+		log.Info().Msgf("%s", retrievedMember.String())
+		return
+	}
+
+	request := grpc_network_go.NetworkId{
+		OrganizationId: listMembersOrgId,
+		NetworkId:      listMembersNetworkId,
+	}
+
+	retrievedMemberList, err := client.ListMembers(context.Background(), &request)
+	if err != nil {
+		log.Error().Err(err).Msgf("error retrieving members of network %s", listMembersNetworkId)
+		return
+	}
+
+	log.Info().Msgf("%s", retrievedMemberList.String())
+}
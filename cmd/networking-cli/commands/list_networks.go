@@ -21,9 +21,11 @@ import (
 	"context"
 	"github.com/nalej/grpc-network-go"
 	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/network-manager/internal/pkg/server/networks"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 )
 
 // GRPC server address
@@ -63,15 +65,23 @@ func listNetworks() {
 		OrganizationId: listNetworksOrgId,
 	}
 
-	retrievedNetworkList, err := client.ListNetworks(context.Background(), &request)
+	var trailer metadata.MD
+	retrievedNetworkList, err := client.ListNetworks(context.Background(), &request, grpc.Trailer(&trailer))
 	if err != nil {
 		log.Error().Err(err).Msgf("error retrieving Organization %s", listNetworksOrgId)
 		return
 	}
 
-	if retrievedNetworkList == nil {
+	if len(retrievedNetworkList.Networks) > 0 {
 		log.Info().Msgf("%s", retrievedNetworkList.String())
 	} else {
 		log.Info().Msg("No networks to list")
 	}
+	for _, networkError := range retrievedNetworkList.Errors {
+		log.Warn().Str("networkId", networkError.NetworkId).Str("error", networkError.Error).Msg("network could not be retrieved")
+	}
+	// networks that could not be retrieved and cannot be identified as networks of the organization
+	if unknown := trailer.Get(networks.NetworkErrorsTrailer); len(unknown) > 0 {
+		log.Warn().Str("networks", unknown[0]).Msg("networks of unknown organization could not be retrieved")
+	}
 }
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var listRemovalsServer string
+
+// Organization ID
+var listRemovalsOrgId string
+
+// Network ID
+var listRemovalsNetworkId string
+
+var listRemovalsCmd = &cobra.Command{
+	Use:   "removals",
+	Short: "List the members removed from a network",
+	Long:  `List the members removed from a network, newest first`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		listRemovals()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(listRemovalsCmd)
+	listRemovalsCmd.Flags().StringVar(&listRemovalsServer, "server", "localhost:8000", "Networking manager server URL")
+	listRemovalsCmd.Flags().StringVar(&listRemovalsOrgId, "orgid", "", "Organization ID")
+	listRemovalsCmd.Flags().StringVar(&listRemovalsNetworkId, "netid", "", "Network ID")
+	listRemovalsCmd.MarkFlagRequired("orgid")
+	listRemovalsCmd.MarkFlagRequired("netid")
+}
+
+func listRemovals() {
+
+	conn, err := grpc.Dial(listRemovalsServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", listRemovalsServer)
+	}
+
+	client := grpc_network_go.NewNetworksClient(conn)
+
+	request := grpc_network_go.NetworkId{
+		OrganizationId: listRemovalsOrgId,
+		NetworkId:      listRemovalsNetworkId,
+	}
+
+	retrievedRemovalList, err := client.ListMemberRemovals(context.Background(), &request)
+	if err != nil {
+		log.Error().Err(err).Msgf("error retrieving member removals of network %s", listRemovalsNetworkId)
+		return
+	}
+
+	log.Info().Msgf("%s", retrievedRemovalList.String())
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package commands
+
+import (
+	"context"
+	"github.com/nalej/grpc-network-go"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+// GRPC server address
+var updateNetworkServer string
+
+// Organization ID
+var updateNetworkOrgId string
+
+// Application instance ID, only for application networks
+var updateNetworkAppInstanceId string
+
+// Network ID
+var updateNetworkId string
+
+// New name of the network
+var updateNetworkName string
+
+// New routes of the network
+var updateNetworkRoutes []string
+
+// New IP ranges of the network
+var updateNetworkIpRanges []string
+
+// New multicast limit of the network
+var updateNetworkMulticastLimit int32
+
+// Allow broadcast in the network
+var updateNetworkEnableBroadcast bool
+
+// Recompile the rules of the application network
+var updateNetworkRules bool
+
+var updateNetworkCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Update an existing network",
+	Long:  `Update the name, routes, IP ranges, multicast limit, broadcast flag or rules of an existing network`,
+	Run: func(cmd *cobra.Command, args []string) {
+		SetupLogging()
+		updateNetwork(cmd)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(updateNetworkCmd)
+	updateNetworkCmd.Flags().StringVar(&updateNetworkServer, "server", "localhost:8000", "Networking manager server URL")
+	updateNetworkCmd.Flags().StringVar(&updateNetworkOrgId, "orgid", "", "Organization ID")
+	updateNetworkCmd.Flags().StringVar(&updateNetworkAppInstanceId, "appInstanceId", "", "Application instance ID (application networks)")
+	updateNetworkCmd.Flags().StringVar(&updateNetworkId, "netid", "", "Network ID")
+	updateNetworkCmd.Flags().StringVar(&updateNetworkName, "name", "", "New name of the network")
+	updateNetworkCmd.Flags().StringSliceVar(&updateNetworkRoutes, "routes", []string{}, "New routes of the network (CIDR)")
+	updateNetworkCmd.Flags().StringSliceVar(&updateNetworkIpRanges, "ipRanges", []string{}, "New IP ranges of the network (start-end)")
+	updateNetworkCmd.Flags().Int32Var(&updateNetworkMulticastLimit, "multicastLimit", 32, "Maximum recipients for a multicast packet")
+	updateNetworkCmd.Flags().BoolVar(&updateNetworkEnableBroadcast, "enableBroadcast", true, "Allow broadcast in the network")
+	updateNetworkCmd.Flags().BoolVar(&updateNetworkRules, "rules", false, "Recompile the rules from the application descriptor (application networks)")
+	updateNetworkCmd.MarkFlagRequired("orgid")
+	updateNetworkCmd.MarkFlagRequired("netid")
+}
+
+func updateNetwork(cmd *cobra.Command) {
+
+	conn, err := grpc.Dial(updateNetworkServer, grpc.WithInsecure())
+
+	if err != nil {
+		log.Fatal().Err(err).Msgf("impossible to connect to server %s", updateNetworkServer)
+	}
+
+	client := grpc_network_go.NewNetworksClient(conn)
+
+	// only the flags set by the user are updated
+	request := grpc_network_go.UpdateNetworkRequest{
+		OrganizationId:        updateNetworkOrgId,
+		AppInstanceId:         updateNetworkAppInstanceId,
+		NetworkId:             updateNetworkId,
+		UpdateName:            cmd.Flags().Changed("name"),
+		Name:                  updateNetworkName,
+		UpdateRoutes:          cmd.Flags().Changed("routes"),
+		Routes:                updateNetworkRoutes,
+		UpdateIpRanges:        cmd.Flags().Changed("ipRanges"),
+		IpRanges:              updateNetworkIpRanges,
+		UpdateMulticastLimit:  cmd.Flags().Changed("multicastLimit"),
+		MulticastLimit:        updateNetworkMulticastLimit,
+		UpdateEnableBroadcast: cmd.Flags().Changed("enableBroadcast"),
+		EnableBroadcast:       updateNetworkEnableBroadcast,
+		UpdateRules:           updateNetworkRules,
+	}
+
+	updatedNetwork, err := client.UpdateNetwork(context.Background(), &request)
+	if err != nil {
+		log.Error().Err(err).Msgf("error updating network %s", updateNetworkId)
+		return
+	}
+
+	log.Info().Msgf("%s", updatedNetwork.String())
+}
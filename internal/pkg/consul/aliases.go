@@ -0,0 +1,270 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"strings"
+)
+
+// aliasKeyPrefix is the prefix of the keys of the aliases in the KV store, <prefix><organizationId>/<fqdn>
+const aliasKeyPrefix = "nalej-dns/aliases/"
+
+// aliasRecord with an alias stored in the KV store and the prepared query resolving it.
+type aliasRecord struct {
+	Entry Entry
+	// QueryID of the prepared query of the alias, empty if the alias does not resolve to an entry
+	QueryID string
+	// QueryTarget is the FQDN of the entry the prepared query resolves to
+	QueryTarget string
+}
+
+// aliasName returns the name used to compare the FQDNs of the aliases and their targets.
+func aliasName(fqdn string) string {
+	return strings.TrimSuffix(strings.ToLower(fqdn), ".")
+}
+
+func aliasOrganizationPrefix(organizationID string) string {
+	return fmt.Sprintf("%s%s/", aliasKeyPrefix, organizationID)
+}
+
+func aliasKey(organizationID string, fqdn string) string {
+	return aliasOrganizationPrefix(organizationID) + aliasName(fqdn)
+}
+
+// listAliases returns the aliases of an organization by name.
+func (a *ConsulClient) listAliases(organizationID string) (map[string]aliasRecord, derrors.Error) {
+	pairs, _, err := a.client.KV().List(aliasOrganizationPrefix(organizationID), &api.QueryOptions{Datacenter: a.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Msg("impossible to retrieve the aliases of the organization")
+		return nil, derrors.NewGenericError("impossible to retrieve the aliases of the organization", err).WithParams(organizationID)
+	}
+	aliases := make(map[string]aliasRecord, len(pairs))
+	for _, pair := range pairs {
+		record := aliasRecord{}
+		if err := json.Unmarshal(pair.Value, &record); err != nil {
+			log.Warn().Err(err).Str("key", pair.Key).Msg("skipping invalid alias")
+			continue
+		}
+		aliases[aliasName(record.Entry.Fqdn)] = record
+	}
+	return aliases, nil
+}
+
+// getAlias returns the alias of an organization with the given FQDN, nil if there is none.
+func (a *ConsulClient) getAlias(organizationID string, fqdn string) (*aliasRecord, derrors.Error) {
+	pair, _, err := a.client.KV().Get(aliasKey(organizationID, fqdn), &api.QueryOptions{Datacenter: a.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Str("fqdn", fqdn).Msg("impossible to retrieve the alias")
+		return nil, derrors.NewGenericError("impossible to retrieve the alias", err).WithParams(organizationID, fqdn)
+	}
+	if pair == nil {
+		return nil, nil
+	}
+	record := &aliasRecord{}
+	if err := json.Unmarshal(pair.Value, record); err != nil {
+		return nil, derrors.NewInternalError("invalid alias", err).WithParams(organizationID, fqdn)
+	}
+	return record, nil
+}
+
+func (a *ConsulClient) putAlias(record aliasRecord) derrors.Error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return derrors.NewInternalError("impossible to encode the alias", err).WithParams(record.Entry.Fqdn)
+	}
+	pair := &api.KVPair{Key: aliasKey(record.Entry.OrganizationId, record.Entry.Fqdn), Value: value}
+	_, err = a.client.KV().Put(pair, &api.WriteOptions{Datacenter: a.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", record.Entry.OrganizationId).Str("fqdn", record.Entry.Fqdn).
+			Msg("impossible to store the alias")
+		return derrors.NewGenericError("impossible to store the alias", err).WithParams(record.Entry.OrganizationId, record.Entry.Fqdn)
+	}
+	return nil
+}
+
+// deleteAlias removes an alias and its prepared query.
+func (a *ConsulClient) deleteAlias(record aliasRecord) derrors.Error {
+	organizationID, fqdn := record.Entry.OrganizationId, record.Entry.Fqdn
+	options := &api.WriteOptions{Datacenter: a.config.Datacenter}
+	if record.QueryID != "" {
+		if _, err := a.client.PreparedQuery().Delete(record.QueryID, options); err != nil {
+			log.Error().Err(err).Str("organizationId", organizationID).Str("fqdn", fqdn).Msg("impossible to delete the alias query")
+			return derrors.NewInternalError("impossible to delete the alias query", err).WithParams(organizationID, fqdn)
+		}
+	}
+	if _, err := a.client.KV().Delete(aliasKey(organizationID, fqdn), options); err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Str("fqdn", fqdn).Msg("impossible to delete the alias")
+		return derrors.NewInternalError("impossible to delete the alias", err).WithParams(organizationID, fqdn)
+	}
+	return nil
+}
+
+// deleteAliasesOf removes the aliases of an organization whose chain leads to one of the deleted entries.
+func (a *ConsulClient) deleteAliasesOf(organizationID string, deleted []string) derrors.Error {
+	aliases, err := a.listAliases(organizationID)
+	if err != nil {
+		return err
+	}
+	gone := make(map[string]bool, len(deleted))
+	for _, fqdn := range deleted {
+		gone[aliasName(fqdn)] = true
+	}
+	for removed := true; removed; {
+		removed = false
+		for name, record := range aliases {
+			if !gone[aliasName(record.Entry.Target)] {
+				continue
+			}
+			if err := a.deleteAlias(record); err != nil {
+				return err
+			}
+			log.Debug().Str("organizationId", organizationID).Str("fqdn", record.Entry.Fqdn).Msg("alias of deleted entry deleted")
+			delete(aliases, name)
+			gone[name] = true
+			removed = true
+		}
+	}
+	return nil
+}
+
+// entryExists checks if an organization has an entry that is not an alias with the given FQDN.
+func (a *ConsulClient) entryExists(organizationID string, fqdn string) (bool, derrors.Error) {
+	ids, err := a.entryServiceIDs(organizationID, fqdn)
+	if err != nil {
+		return false, err
+	}
+	return len(ids) > 0, nil
+}
+
+// entryServiceIDs returns the identifiers of the services of the entries of an organization with the given FQDN, one
+// per cluster for the entries registered by several clusters.
+func (a *ConsulClient) entryServiceIDs(organizationID string, fqdn string) ([]string, derrors.Error) {
+	services, _, err := a.client.Catalog().Service(fqdn, "", &api.QueryOptions{
+		Datacenter: a.config.Datacenter,
+		NodeMeta:   map[string]string{MetaOrganizationId: organizationID},
+	})
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Str("fqdn", fqdn).Msg("impossible to retrieve the entry")
+		return nil, derrors.NewGenericError("impossible to retrieve the entry", err).WithParams(organizationID, fqdn)
+	}
+	ids := make([]string, 0)
+	for _, service := range services {
+		if service.Node == organizationNode(organizationID) &&
+			service.ServiceID == serviceID(organizationID, fqdn, service.ServiceMeta[MetaClusterId]) {
+			ids = append(ids, service.ServiceID)
+		}
+	}
+	return ids, nil
+}
+
+// updateAliasQueries points the prepared queries of the aliases whose chain goes through one of the changed names to
+// the entry at the end of the chain. The query of an alias whose chain does not end in an entry is removed.
+func (a *ConsulClient) updateAliasQueries(organizationID string, changed ...string) derrors.Error {
+	aliases, err := a.listAliases(organizationID)
+	if err != nil {
+		return err
+	}
+	changedNames := make(map[string]bool, len(changed))
+	for _, fqdn := range changed {
+		changedNames[aliasName(fqdn)] = true
+	}
+	// existence of the entries at the end of the chains, checked once
+	exists := make(map[string]bool, 0)
+
+	for name, record := range aliases {
+		chain := []string{name}
+		target, next := "", record.Entry.Target
+		for i := 0; i < maxAliasChain; i++ {
+			chain = append(chain, aliasName(next))
+			targetAlias, isAlias := aliases[aliasName(next)]
+			if !isAlias {
+				target = strings.TrimSuffix(next, ".")
+				break
+			}
+			next = targetAlias.Entry.Target
+		}
+		affected := false
+		for _, link := range chain {
+			affected = affected || changedNames[link]
+		}
+		if !affected {
+			continue
+		}
+		if target != "" {
+			found, known := exists[target]
+			if !known {
+				found, err = a.entryExists(organizationID, target)
+				if err != nil {
+					return err
+				}
+				exists[target] = found
+			}
+			if !found {
+				target = ""
+			}
+		}
+		if err := a.updateAliasQuery(record, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateAliasQuery points the prepared query of an alias to a target entry, removing it if there is no target.
+func (a *ConsulClient) updateAliasQuery(record aliasRecord, target string) derrors.Error {
+	if record.QueryTarget == target && (target == "") == (record.QueryID == "") {
+		return nil
+	}
+	organizationID, fqdn := record.Entry.OrganizationId, record.Entry.Fqdn
+	options := &api.WriteOptions{Datacenter: a.config.Datacenter}
+	var err error
+	switch {
+	case target == "":
+		log.Warn().Str("organizationId", organizationID).Str("fqdn", fqdn).Str("target", record.Entry.Target).
+			Msg("alias does not resolve to an entry")
+		_, err = a.client.PreparedQuery().Delete(record.QueryID, options)
+		record.QueryID = ""
+	case record.QueryID == "":
+		record.QueryID, _, err = a.client.PreparedQuery().Create(aliasQuery(organizationID, fqdn, target), options)
+	default:
+		definition := aliasQuery(organizationID, fqdn, target)
+		definition.ID = record.QueryID
+		_, err = a.client.PreparedQuery().Update(definition, options)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Str("fqdn", fqdn).Msg("impossible to update the alias query")
+		return derrors.NewGenericError("impossible to update the alias query", err).WithParams(organizationID, fqdn)
+	}
+	record.QueryTarget = target
+	return a.putAlias(record)
+}
+
+// aliasQuery returns the prepared query of an alias resolving to the service of its target entry.
+func aliasQuery(organizationID string, fqdn string, target string) *api.PreparedQueryDefinition {
+	return &api.PreparedQueryDefinition{
+		Name: aliasQueryName(organizationID, fqdn),
+		Service: api.ServiceQuery{
+			Service:  target,
+			NodeMeta: map[string]string{MetaOrganizationId: organizationID},
+		},
+	}
+}
@@ -22,218 +22,363 @@ import (
 	"github.com/hashicorp/consul/api"
 	"github.com/nalej/derrors"
 	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
 	// Port exposing the ConsulDNS service
 	ConsulDNSPort = 8500
+	// ExternalNodeAddress is the address of the external nodes of the organizations. It is not used to answer DNS
+	// queries as every entry has its own address.
+	ExternalNodeAddress = "127.0.0.1"
+	// PageListTTL is the time the entries of an organization loaded for the first page of a listing are used to
+	// return the next pages
+	PageListTTL = time.Minute
 )
 
+// ConsulClient stores the DNS entries of each organization as services of an external node of the catalog, with the
+// organization, application instance, network and service name in the metadata of the service. The service of an
+// entry is its FQDN. The aliases are not services, so Consul DNS does not answer them with the address of the node.
+// They are stored in the KV store, each one with a prepared query resolving to the entry at the end of its chain of
+// aliases.
 type ConsulClient struct {
 	client api.Client
+	// config used to build the clients of the agent and of the nodes
+	config Config
+	// protects the listed entries
+	pagesLock sync.Mutex
+	// sorted entries of the organizations being listed by pages
+	pages map[string]*pagedList
 }
 
-func NewConsulClient(address string) (*ConsulClient, derrors.Error) {
-	config := api.DefaultConfig()
-	config.Address = address
+// pagedList with the sorted entries of an organization loaded for the first page of a listing.
+type pagedList struct {
+	entries []Entry
+	loaded  time.Time
+}
 
-	client, err := api.NewClient(config)
+func NewConsulClient(config Config) (*ConsulClient, derrors.Error) {
+	client, err := api.NewClient(config.apiConfig(config.Address))
 	if err != nil {
 		log.Error().Err(err).Msg("error creating new ConsulClient")
 		return nil, derrors.NewGenericError("error creating new ConsulClient", err)
 	}
-	return &ConsulClient{client: *client}, nil
+	return &ConsulClient{client: *client, config: config, pages: make(map[string]*pagedList, 0)}, nil
 }
 
-func (a *ConsulClient) Add(serviceName string, fqdn string, ip string, tags []string) derrors.Error {
+// nodeClient builds a client for the agent of a node of the catalog.
+func (a *ConsulClient) nodeClient(nodeAddress string) (*api.Client, derrors.Error) {
+	client, err := api.NewClient(a.config.apiConfig(fmt.Sprintf("%s:%d", nodeAddress, ConsulDNSPort)))
+	if err != nil {
+		log.Error().Err(err).Str("address", nodeAddress).Msg("error creating client of node")
+		return nil, derrors.NewGenericError("error creating client of node", err).WithParams(nodeAddress)
+	}
+	return client, nil
+}
 
-	// Register an external agent so we do not need a local agent running to control that service
-	entry := &api.CatalogRegistration{
-		Node:       fqdn,
-		Datacenter: "dc1",
-		Address:    ip,
-		Service: &api.AgentService{
-			Service: fqdn,
-			ID:      fqdn,
-			Address: ip,
-			Tags:    tags,
-		},
-		NodeMeta: map[string]string{
-			"external-node": "true",
-		},
+// Add an entry, replacing any alias of the organization with the same FQDN and the entry with the same FQDN in the
+// same cluster.
+func (a *ConsulClient) Add(entry Entry) derrors.Error {
+	if entry.Type == TypeAlias {
+		return a.addAlias(entry)
 	}
-	_, err := a.client.Catalog().Register(entry, &api.WriteOptions{Datacenter: "dc1"})
+	previous, err := a.getAlias(entry.OrganizationId, entry.Fqdn)
 	if err != nil {
-		log.Error().Msg("impossible to register service in catalog")
-		return derrors.NewGenericError(err.Error())
+		return err
+	}
+	if previous != nil {
+		if err := a.deleteAlias(*previous); err != nil {
+			return err
+		}
 	}
 
-	return nil
+	// Register an external node so we do not need a local agent running to control the entries
+	registration := &api.CatalogRegistration{
+		Node:       organizationNode(entry.OrganizationId),
+		Datacenter: a.config.Datacenter,
+		Address:    ExternalNodeAddress,
+		Service:    entry.ToAgentService(),
+		NodeMeta: map[string]string{
+			MetaExternalNode:   "true",
+			MetaOrganizationId: entry.OrganizationId,
+		},
+	}
+	_, rErr := a.client.Catalog().Register(registration, &api.WriteOptions{Datacenter: a.config.Datacenter})
+	if rErr != nil {
+		log.Error().Err(rErr).Str("organizationId", entry.OrganizationId).Str("fqdn", entry.Fqdn).
+			Msg("impossible to register entry in catalog")
+		return derrors.NewGenericError("impossible to register entry in catalog", rErr).WithParams(entry.OrganizationId, entry.Fqdn)
+	}
+	return a.updateAliasQueries(entry.OrganizationId, entry.Fqdn)
 }
 
-// Delete uses the fqdn as the consul service id and removes
-// the entry with that id. If tags are indicated, all the service entries
-// with those tags are removed.
-func (a *ConsulClient) Delete(fqdn string, tags []string) derrors.Error {
-
-	// delete the associated node
-
-	if tags == nil || len(tags) == 0 {
-		// remove using the FQDN
-		return a.deleteEntryById(fqdn)
+// addAlias adds an alias, replacing any entry of the organization with the same FQDN.
+func (a *ConsulClient) addAlias(entry Entry) derrors.Error {
+	ids, err := a.entryServiceIDs(entry.OrganizationId, entry.Fqdn)
+	if err != nil {
+		return err
 	}
-
-	// delete entries using tags
-	return a.deleteEntryByTags(tags)
+	for _, id := range ids {
+		if err := a.deregister(entry.OrganizationId, id); err != nil {
+			return err
+		}
+	}
+	record := aliasRecord{Entry: entry}
+	previous, err := a.getAlias(entry.OrganizationId, entry.Fqdn)
+	if err != nil {
+		return err
+	}
+	if previous != nil {
+		record.QueryID, record.QueryTarget = previous.QueryID, previous.QueryTarget
+	}
+	if err := a.putAlias(record); err != nil {
+		return err
+	}
+	return a.updateAliasQueries(entry.OrganizationId, entry.Fqdn)
 }
 
-func (a *ConsulClient) deleteEntryById(id string) derrors.Error {
-
-	// Remove the associated consul node to get rid of any everything.
-	dereg := api.CatalogDeregistration{
-		Datacenter: "dc1",
-		Node:       id,
+// Delete the entries of an organization with the given FQDN in every cluster, and the aliases that lead to them.
+func (a *ConsulClient) Delete(organizationID string, fqdn string) derrors.Error {
+	alias, err := a.getAlias(organizationID, fqdn)
+	if err != nil {
+		return err
+	}
+	if alias != nil {
+		if err := a.deleteAlias(*alias); err != nil {
+			return err
+		}
+		return a.deleteAliasesOf(organizationID, []string{fqdn})
 	}
-	_, err := a.client.Catalog().Deregister(&dereg, &api.WriteOptions{Datacenter: "dc1"})
+	ids, err := a.entryServiceIDs(organizationID, fqdn)
 	if err != nil {
-		log.Error().Err(err).Str("serviceId", id).Msg("service not found")
-		return derrors.NewInternalError("service not found", err)
+		return err
 	}
-	return nil
+	if len(ids) == 0 {
+		return derrors.NewNotFoundError("DNS entry not found").WithParams(organizationID, fqdn)
+	}
+	for _, id := range ids {
+		if err := a.deregister(organizationID, id); err != nil {
+			return err
+		}
+	}
+	return a.deleteAliasesOf(organizationID, []string{fqdn})
 }
 
-func (a *ConsulClient) deleteEntryByTags(tags []string) derrors.Error {
-
-	// The current consul API does not filter services by tag
-	// https://github.com/hashicorp/consul/issues/4811
-	// The workaround is to get all the available services from the catalog and
-	// remove those matching the tags
-
-	q := api.QueryOptions{}
-	services, _, err := a.client.Catalog().Services(&q)
-
+// DeleteFromCluster deletes the entry of an organization with the given FQDN in a cluster. The aliases that lead to
+// the FQDN are deleted once it has no entries in any cluster.
+func (a *ConsulClient) DeleteFromCluster(organizationID string, fqdn string, clusterID string) derrors.Error {
+	ids, err := a.entryServiceIDs(organizationID, fqdn)
 	if err != nil {
-		log.Error().Err(err).Msg("impossible to build DNS query")
-		return derrors.NewGenericError("impossible to build DNS query", err)
+		return err
 	}
-
-	toDelete := make([]string, 0)
-	for serviceId, serviceTags := range services {
-		if serviceTags == nil || len(serviceTags) == 0 {
-			continue
-		}
-		// build a map to determine if the tags are available
-		available := make(map[string]bool, len(serviceTags))
-		for _, availableTag := range serviceTags {
-			available[availableTag] = true
+	id := serviceID(organizationID, fqdn, clusterID)
+	remaining := 0
+	found := false
+	for _, existing := range ids {
+		if existing == id {
+			found = true
+		} else {
+			remaining++
 		}
+	}
+	if !found {
+		return derrors.NewNotFoundError("DNS entry not found").WithParams(organizationID, fqdn, clusterID)
+	}
+	if err := a.deregister(organizationID, id); err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	return a.deleteAliasesOf(organizationID, []string{fqdn})
+}
+
+// DeleteByServiceName deletes the entries of an organization with the given service name. Entries without service
+// name are deleted if their FQDN matches it.
+func (a *ConsulClient) DeleteByServiceName(organizationID string, serviceName string) derrors.Error {
+	return a.deleteMatching(organizationID, func(entry Entry) bool {
+		return entry.ServiceName == serviceName || (entry.ServiceName == "" && entry.Fqdn == serviceName)
+	})
+}
 
-		var allTagsFound bool = true
+// DeleteByTags deletes the entries of an organization that have all the given tags.
+func (a *ConsulClient) DeleteByTags(organizationID string, tags []string) derrors.Error {
+	return a.deleteMatching(organizationID, func(entry Entry) bool {
+		available := make(map[string]bool, len(entry.Tags))
+		for _, tag := range entry.Tags {
+			available[tag] = true
+		}
 		for _, toFind := range tags {
-			if _, found := available[toFind]; !found {
-				allTagsFound = false
+			if !available[toFind] {
+				return false
 			}
 		}
+		return true
+	})
+}
 
-		if allTagsFound {
-			toDelete = append(toDelete, serviceId)
-		}
-	}
+// DeleteByOwner deletes the entries of an organization owned by an application instance.
+func (a *ConsulClient) DeleteByOwner(organizationID string, appInstanceID string) derrors.Error {
+	return a.deleteMatching(organizationID, func(entry Entry) bool {
+		return entry.AppInstanceId == appInstanceID
+	})
+}
 
-	log.Debug().Msgf("%d service entries to be deleted", len(toDelete))
-	for _, serviceId := range toDelete {
-		// find in what node is the service registered
-		serv, _, err := a.client.Catalog().Service(serviceId, "", &q)
-		if err != nil {
-			log.Error().Err(err).Msgf("impossible to retrieve information for service %s", serviceId)
-			return derrors.NewGenericError("impossible to retrieve service information", err)
+func (a *ConsulClient) deleteMatching(organizationID string, matches func(entry Entry) bool) derrors.Error {
+	entries, err := a.List(organizationID)
+	if err != nil {
+		return err
+	}
+	deleted := make([]string, 0)
+	// FQDNs that keep entries in other clusters
+	remaining := make(map[string]bool, 0)
+	for _, entry := range entries {
+		if !matches(entry) {
+			remaining[entry.Fqdn] = true
+			continue
 		}
-		for _, servEntry := range serv {
-			// build the client for the specific node
-			config := api.DefaultConfig()
-			config.Address = fmt.Sprintf("%s:%d", servEntry.Address, ConsulDNSPort)
-			auxCli, err := api.NewClient(config)
-			log.Debug().Msgf("delete service %s", servEntry.ServiceID)
-			err = auxCli.Agent().ServiceDeregister(servEntry.ServiceID)
-
-			if err != nil {
-				log.Error().Err(err).Msgf("impossible to retrieve information for service %s", serviceId)
-			}
+		if entry.Type == TypeAlias {
+			err = a.Delete(organizationID, entry.Fqdn)
+		} else {
+			err = a.deregister(organizationID, serviceID(organizationID, entry.Fqdn, entry.ClusterId))
 		}
-
+		if err != nil && err.Type() != derrors.NotFound {
+			return err
+		}
+		deleted = append(deleted, entry.Fqdn)
 	}
+	gone := make([]string, 0, len(deleted))
+	for _, fqdn := range deleted {
+		if !remaining[fqdn] {
+			gone = append(gone, fqdn)
+		}
+	}
+	deleted = gone
+	log.Debug().Str("organizationId", organizationID).Int("deleted", len(deleted)).Msg("DNS entries deleted")
+	if len(deleted) == 0 {
+		return nil
+	}
+	return a.deleteAliasesOf(organizationID, deleted)
+}
 
+// deregister removes the service of an entry from the external node of its organization.
+func (a *ConsulClient) deregister(organizationID string, serviceID string) derrors.Error {
+	dereg := api.CatalogDeregistration{
+		Datacenter: a.config.Datacenter,
+		Node:       organizationNode(organizationID),
+		ServiceID:  serviceID,
+	}
+	_, err := a.client.Catalog().Deregister(&dereg, &api.WriteOptions{Datacenter: a.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("organizationId", organizationID).Str("serviceId", serviceID).Msg("impossible to deregister entry")
+		return derrors.NewInternalError("impossible to deregister entry", err).WithParams(organizationID, serviceID)
+	}
 	return nil
 }
 
-func (a *ConsulClient) List(serviceKind string) ([]Service, derrors.Error) {
-	services, err := a.client.Agent().Services()
-
+// List the entries of an organization sorted by FQDN.
+func (a *ConsulClient) List(organizationID string) ([]Entry, derrors.Error) {
+	node, _, err := a.client.Catalog().Node(organizationNode(organizationID), &api.QueryOptions{})
 	if err != nil {
-		log.Error().Msg("Could not retrieve service list")
-		return nil, derrors.NewGenericError(err.Error())
+		log.Error().Err(err).Str("organizationId", organizationID).Msg("impossible to retrieve the entries of the organization")
+		return nil, derrors.NewGenericError("impossible to retrieve the entries of the organization", err).WithParams(organizationID)
 	}
-
-	serviceList := make([]Service, 0)
-	for _, v := range services {
-		intermediateServ := ServiceFromConsulAPI(v)
-		if string(v.Kind) == serviceKind {
-			serviceList = append(serviceList, intermediateServ)
+	entries := make([]Entry, 0)
+	if node != nil {
+		for _, service := range node.Services {
+			entries = append(entries, EntryFromAgentService(service))
 		}
 	}
-
-	return serviceList, nil
-}
-
-//
-// Generic entries
-//
-
-func (a *ConsulClient) getGenericID(organizationID string, fqdn string) string {
-	return fmt.Sprintf("%s-%s", organizationID, fqdn)
+	aliases, aErr := a.listAliases(organizationID)
+	if aErr != nil {
+		return nil, aErr
+	}
+	for _, record := range aliases {
+		entries = append(entries, record.Entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Fqdn < entries[j].Fqdn })
+	return entries, nil
 }
 
-func (a *ConsulClient) AddGenericEntry(organizationID string, fqdn string, ip string, tags ...string) derrors.Error {
-	entryTags := []string{organizationID}
-	entryTags = append(entryTags, tags...)
-	entry := &api.AgentServiceRegistration{
-		ID:      a.getGenericID(organizationID, fqdn),
-		Name:    fqdn,
-		Address: ip,
-		Tags:    entryTags,
+// ListOrganizations lists the organizations with entries sorted by identifier.
+func (a *ConsulClient) ListOrganizations() ([]string, derrors.Error) {
+	nodes, _, err := a.client.Catalog().Nodes(&api.QueryOptions{NodeMeta: map[string]string{MetaExternalNode: "true"}})
+	if err != nil {
+		log.Error().Err(err).Msg("impossible to retrieve the nodes of the catalog")
+		return nil, derrors.NewGenericError("impossible to retrieve the nodes of the catalog", err)
 	}
-
-	err := a.client.Agent().ServiceRegister(entry)
-
+	found := make(map[string]bool, 0)
+	for _, node := range nodes {
+		organizationID := node.Meta[MetaOrganizationId]
+		if organizationID != "" && node.Node == organizationNode(organizationID) {
+			found[organizationID] = true
+		}
+	}
+	// organizations with aliases only
+	prefixes, _, err := a.client.KV().Keys(aliasKeyPrefix, "/", &api.QueryOptions{Datacenter: a.config.Datacenter})
 	if err != nil {
-		log.Error().Str("err", err.Error()).Msg("Cannot add generic entry")
-		return derrors.NewGenericError(err.Error())
+		log.Error().Err(err).Msg("impossible to retrieve the organizations with aliases")
+		return nil, derrors.NewGenericError("impossible to retrieve the organizations with aliases", err)
 	}
-
-	return nil
+	for _, prefix := range prefixes {
+		if organizationID := strings.TrimSuffix(strings.TrimPrefix(prefix, aliasKeyPrefix), "/"); organizationID != "" {
+			found[organizationID] = true
+		}
+	}
+	organizations := make([]string, 0, len(found))
+	for organizationID := range found {
+		organizations = append(organizations, organizationID)
+	}
+	sort.Strings(organizations)
+	return organizations, nil
 }
 
-func (a *ConsulClient) DeleteGenericEntry(organizationID string, fqdn string) derrors.Error {
-	serviceID := a.getGenericID(organizationID, fqdn)
-	q := api.QueryOptions{}
+// ListPage lists the entries of an organization sorted by FQDN. The page starts after the given FQDN and has at
+// most limit entries (0 for all). If there are more entries, the FQDN of the last one is returned. The entries are
+// loaded for the first page and the next pages are taken from them for PageListTTL, so the organization is not
+// reloaded for every page.
+func (a *ConsulClient) ListPage(organizationID string, after string, limit int) ([]Entry, string, derrors.Error) {
+	entries, err := a.pageEntries(organizationID, after == "")
+	if err != nil {
+		return nil, "", err
+	}
+	first := sort.Search(len(entries), func(i int) bool { return after == "" || entries[i].Fqdn > after })
+	entries = entries[first:]
+	next := ""
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+		next = entries[limit-1].Fqdn
+	}
+	return entries, next, nil
+}
 
-	// find in what node is the service registered
-	serv, _, err := a.client.Catalog().Service(serviceID, "", &q)
+// pageEntries returns the sorted entries of an organization to be listed by pages, loading them for the first page
+// or if they have expired.
+func (a *ConsulClient) pageEntries(organizationID string, first bool) ([]Entry, derrors.Error) {
+	if !first {
+		a.pagesLock.Lock()
+		list, found := a.pages[organizationID]
+		a.pagesLock.Unlock()
+		if found && time.Since(list.loaded) < PageListTTL {
+			return list.entries, nil
+		}
+	}
+	entries, err := a.List(organizationID)
 	if err != nil {
-		log.Error().Err(err).Msgf("impossible to retrieve information for service %s", serviceID)
-		return derrors.NewGenericError("impossible to retrieve service information", err)
+		return nil, err
 	}
-	for _, servEntry := range serv {
-		// build the client for the specific node
-		config := api.DefaultConfig()
-		config.Address = fmt.Sprintf("%s:%d", servEntry.Address, ConsulDNSPort)
-		auxCli, err := api.NewClient(config)
-		log.Debug().Str("address", servEntry.Address).Str("serviceID", servEntry.ServiceID).Msgf("delete service")
-		err = auxCli.Agent().ServiceDeregister(servEntry.ServiceID)
 
-		if err != nil {
-			log.Error().Err(err).Msgf("impossible to retrieve information for service %s", serviceID)
+	a.pagesLock.Lock()
+	defer a.pagesLock.Unlock()
+	now := time.Now()
+	for listed, list := range a.pages {
+		if now.Sub(list.loaded) >= PageListTTL {
+			delete(a.pages, listed)
 		}
 	}
-	return nil
+	a.pages[organizationID] = &pagedList{entries: entries, loaded: now}
+	return entries, nil
 }
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// DefaultDatacenter of the entries
+	DefaultDatacenter = "dc1"
+	// Schemes supported by the Consul API
+	SchemeHTTP  = "http"
+	SchemeHTTPS = "https"
+)
+
+// Config of the connections to Consul. Empty values keep the defaults of the Consul API, which can be set with
+// the CONSUL_* environment variables.
+type Config struct {
+	// Address of the Consul agent
+	Address string
+	// Scheme used to connect to the agents (http or https)
+	Scheme string
+	// Datacenter where the entries are registered
+	Datacenter string
+	// Token of the Consul ACL
+	Token string
+	// TokenFile with the token of the Consul ACL, used if Token is empty
+	TokenFile string
+	// CAFile with the CA certificate of the agents
+	CAFile string
+	// CertFile with the client certificate
+	CertFile string
+	// KeyFile with the key of the client certificate
+	KeyFile string
+	// InsecureSkipVerify skips the validation of the certificates of the agents
+	InsecureSkipVerify bool
+}
+
+// NewConfig creates the configuration to connect to an agent with the default settings.
+func NewConfig(address string) Config {
+	return Config{Address: address, Datacenter: DefaultDatacenter}
+}
+
+// apiConfig returns the configuration of a Consul API client connected to the given address.
+func (c *Config) apiConfig(address string) *api.Config {
+	config := api.DefaultConfig()
+	config.Address = address
+	if c.Scheme != "" {
+		config.Scheme = c.Scheme
+	}
+	if c.Datacenter != "" {
+		config.Datacenter = c.Datacenter
+	}
+	// the API reads the token file even if there is a token
+	if c.Token != "" {
+		config.Token = c.Token
+		config.TokenFile = ""
+	} else if c.TokenFile != "" {
+		config.TokenFile = c.TokenFile
+	}
+	if c.CAFile != "" {
+		config.TLSConfig.CAFile = c.CAFile
+	}
+	if c.CertFile != "" {
+		config.TLSConfig.CertFile = c.CertFile
+		config.TLSConfig.KeyFile = c.KeyFile
+	}
+	if c.InsecureSkipVerify {
+		config.TLSConfig.InsecureSkipVerify = true
+	}
+	return config
+}
@@ -18,27 +18,148 @@
 package consul
 
 import (
+	"fmt"
 	"github.com/hashicorp/consul/api"
 )
 
-type Service struct {
-	Kind api.ServiceKind
-	//ID string
-	Service string
-	Address string
+// Metadata of the DNS entries
+const (
+	MetaOrganizationId = "nalej-organization-id"
+	MetaAppInstanceId  = "nalej-app-instance-id"
+	MetaServiceGroupId = "nalej-service-group-id"
+	MetaNetworkId      = "nalej-network-id"
+	MetaClusterId      = "nalej-cluster-id"
+	MetaServiceName    = "nalej-service-name"
+	MetaProtocol       = "nalej-protocol"
+	MetaRecordType     = "nalej-record-type"
+	MetaTarget         = "nalej-target"
+	// MetaProtocolTag marks the entries whose last tag is their protocol, added for the RFC 2782 lookups
+	MetaProtocolTag = "nalej-protocol-tag"
+	// MetaExternalNode marks the nodes that are not managed by an agent
+	MetaExternalNode = "external-node"
+)
+
+// Entry with a DNS entry stored as a service of the external node of its organization. The organization, application
+// instance and service group that own the entry are stored in the metadata of the service.
+type Entry struct {
+	OrganizationId string
+	AppInstanceId  string
+	ServiceGroupId string
+	NetworkId      string
+	// ClusterId of the entries of a FQDN registered once per cluster
+	ClusterId   string
+	ServiceName string
+	Fqdn        string
+	IP          string
+	Port        int
+	Protocol    string
+	// Type of the record, empty for address records
+	Type   string
+	Target string
+	Tags   []string
+}
+
+// TypeAlias is the type of the entries that are aliases of another entry of their organization
+const TypeAlias = "CNAME"
+
+// maxAliasChain is the maximum number of aliases followed to resolve an alias
+const maxAliasChain = 8
+
+// aliasQueryPrefix is the prefix of the names of the prepared queries of the aliases
+const aliasQueryPrefix = "nalej-alias-"
+
+// aliasQueryName returns the name of the prepared query of an alias, resolved by Consul DNS as
+// <name>.query.<domain>.
+func aliasQueryName(organizationID string, fqdn string) string {
+	return fmt.Sprintf("%s%s", aliasQueryPrefix, entryID(organizationID, fqdn))
+}
+
+// entryID returns the identifier of the service of an entry.
+func entryID(organizationID string, fqdn string) string {
+	return fmt.Sprintf("%s-%s", organizationID, fqdn)
+}
+
+// serviceID returns the identifier of the service of an entry of a FQDN in a cluster, the identifier of the entry if
+// it has no cluster.
+func serviceID(organizationID string, fqdn string, clusterID string) string {
+	if clusterID == "" {
+		return entryID(organizationID, fqdn)
+	}
+	return fmt.Sprintf("%s#%s", entryID(organizationID, fqdn), clusterID)
+}
+
+// organizationNode returns the name of the external node with the entries of an organization.
+func organizationNode(organizationID string) string {
+	return fmt.Sprintf("nalej-dns-%s", organizationID)
 }
 
-func ServiceFromConsulAPI(s *api.AgentService) Service {
-	return Service{
-		Kind: s.Kind,
-		//ID: s.ID,
-		Service: s.Service,
-		Address: s.Address,
+func (e *Entry) ToAgentService() *api.AgentService {
+	meta := map[string]string{MetaOrganizationId: e.OrganizationId}
+	if e.AppInstanceId != "" {
+		meta[MetaAppInstanceId] = e.AppInstanceId
+	}
+	if e.ServiceGroupId != "" {
+		meta[MetaServiceGroupId] = e.ServiceGroupId
+	}
+	if e.NetworkId != "" {
+		meta[MetaNetworkId] = e.NetworkId
+	}
+	if e.ClusterId != "" {
+		meta[MetaClusterId] = e.ClusterId
+	}
+	if e.ServiceName != "" {
+		meta[MetaServiceName] = e.ServiceName
+	}
+	if e.Type != "" {
+		meta[MetaRecordType] = e.Type
+		meta[MetaTarget] = e.Target
+	}
+	tags := e.Tags
+	if e.Protocol != "" {
+		meta[MetaProtocol] = e.Protocol
+		// Consul answers _<service>._<tag> SRV queries, so the protocol is added as a tag
+		if !hasTag(tags, e.Protocol) {
+			tags = append(append(make([]string, 0, len(tags)+1), tags...), e.Protocol)
+			meta[MetaProtocolTag] = "true"
+		}
 	}
+	return &api.AgentService{
+		ID:      serviceID(e.OrganizationId, e.Fqdn, e.ClusterId),
+		Service: e.Fqdn,
+		Address: e.IP,
+		Port:    e.Port,
+		Tags:    tags,
+		Meta:    meta,
+	}
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
-type GenericEntry struct {
-	Fqdn string
-	IP   string
-	Tags []string
+func EntryFromAgentService(s *api.AgentService) Entry {
+	tags := s.Tags
+	if s.Meta[MetaProtocolTag] == "true" && len(tags) > 0 {
+		tags = tags[:len(tags)-1]
+	}
+	return Entry{
+		OrganizationId: s.Meta[MetaOrganizationId],
+		AppInstanceId:  s.Meta[MetaAppInstanceId],
+		ServiceGroupId: s.Meta[MetaServiceGroupId],
+		NetworkId:      s.Meta[MetaNetworkId],
+		ClusterId:      s.Meta[MetaClusterId],
+		ServiceName:    s.Meta[MetaServiceName],
+		Fqdn:           s.Service,
+		IP:             s.Address,
+		Port:           s.Port,
+		Protocol:       s.Meta[MetaProtocol],
+		Type:           s.Meta[MetaRecordType],
+		Target:         s.Meta[MetaTarget],
+		Tags:           tags,
+	}
 }
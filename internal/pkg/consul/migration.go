@@ -0,0 +1,179 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package consul
+
+import (
+	"github.com/hashicorp/consul/api"
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"strings"
+)
+
+// fqdnOrganizationPrefix is the length of the prefix of the organization identifier in the FQDNs of previous versions
+const fqdnOrganizationPrefix = 10
+
+// MigrationReport with the result of a migration of entries.
+type MigrationReport struct {
+	// Migrated entries, or entries to be migrated in a dry run.
+	Migrated []Entry
+	// Skipped are the identifiers of the entries whose organization is unknown.
+	Skipped []string
+	// Errors found during the migration.
+	Errors int
+}
+
+// Migrate moves the entries registered by previous versions to the external nodes of their organizations. Previous
+// versions registered external nodes named after the FQDN of the entry, without organization. Their organization is
+// the known organization found in their tags, or the only known organization whose identifier prefix is a label of
+// the FQDN, and they are skipped if it cannot be determined. The known organizations are the given ones and the ones
+// that already have entries. Previous versions also registered services of an agent with identifier
+// <organizationId>-<fqdn> and the organization as first tag. With dryRun, the entries are only reported.
+func (a *ConsulClient) Migrate(organizationIDs []string, dryRun bool) (*MigrationReport, derrors.Error) {
+	report := &MigrationReport{Migrated: make([]Entry, 0), Skipped: make([]string, 0)}
+
+	known, err := a.ListOrganizations()
+	if err != nil {
+		return nil, err
+	}
+	known = append(known, organizationIDs...)
+
+	q := api.QueryOptions{}
+	services, _, cErr := a.client.Catalog().Services(&q)
+	if cErr != nil {
+		log.Error().Err(cErr).Msg("impossible to retrieve the services of the catalog")
+		return nil, derrors.NewGenericError("impossible to retrieve the services of the catalog", cErr)
+	}
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		instances, _, err := a.client.Catalog().Service(name, "", &q)
+		if err != nil {
+			log.Error().Err(err).Msgf("impossible to retrieve information for service %s", name)
+			report.Errors++
+			continue
+		}
+		for _, instance := range instances {
+			if instance.ServiceMeta[MetaOrganizationId] != "" {
+				// already migrated
+				continue
+			}
+			var entry Entry
+			var remove func() derrors.Error
+			switch {
+			case instance.NodeMeta[MetaExternalNode] == "true" && instance.Node == name && instance.ServiceID == name:
+				organizationID := entryOrganization(name, instance.ServiceTags, known)
+				if organizationID == "" {
+					log.Warn().Str("fqdn", name).Strs("tags", instance.ServiceTags).Msg("skipping entry whose organization is unknown")
+					report.Skipped = append(report.Skipped, instance.ServiceID)
+					continue
+				}
+				entry = Entry{OrganizationId: organizationID, Fqdn: name, IP: instance.ServiceAddress, Tags: instance.ServiceTags}
+				node := instance.Node
+				remove = func() derrors.Error { return a.deregisterNode(node) }
+			case len(instance.ServiceTags) > 0 && instance.ServiceID == entryID(instance.ServiceTags[0], name):
+				entry = Entry{OrganizationId: instance.ServiceTags[0], Fqdn: name, IP: instance.ServiceAddress, Tags: instance.ServiceTags[1:]}
+				address, serviceID := instance.Address, instance.ServiceID
+				remove = func() derrors.Error { return a.deregisterAgentService(address, serviceID) }
+			default:
+				// not a DNS entry
+				continue
+			}
+			if !dryRun {
+				if err := a.Add(entry); err != nil {
+					report.Errors++
+					continue
+				}
+				if err := remove(); err != nil {
+					report.Errors++
+					continue
+				}
+				log.Info().Str("organizationId", entry.OrganizationId).Str("fqdn", entry.Fqdn).Msg("DNS entry migrated")
+			}
+			report.Migrated = append(report.Migrated, entry)
+		}
+	}
+	return report, nil
+}
+
+// entryOrganization returns the organization of an entry registered without organization: the known organization
+// found in its tags, or the only known organization whose identifier prefix is a label of the FQDN. The FQDNs of
+// previous versions were built with the first characters of the organization identifier. If the organization
+// cannot be determined, an empty string is returned.
+func entryOrganization(fqdn string, tags []string, known []string) string {
+	for _, tag := range tags {
+		for _, organizationID := range known {
+			if tag == organizationID {
+				return organizationID
+			}
+		}
+	}
+
+	labels := strings.FieldsFunc(fqdn, func(r rune) bool { return r == '-' || r == '.' })
+	found := ""
+	for _, organizationID := range known {
+		if len(organizationID) < fqdnOrganizationPrefix || organizationID == found {
+			continue
+		}
+		prefix := organizationID[0:fqdnOrganizationPrefix]
+		for _, label := range labels {
+			if label != prefix {
+				continue
+			}
+			if found != "" {
+				// several organizations match
+				return ""
+			}
+			found = organizationID
+			break
+		}
+	}
+	return found
+}
+
+// deregisterNode removes an external node with all its services.
+func (a *ConsulClient) deregisterNode(node string) derrors.Error {
+	dereg := api.CatalogDeregistration{
+		Datacenter: a.config.Datacenter,
+		Node:       node,
+	}
+	_, err := a.client.Catalog().Deregister(&dereg, &api.WriteOptions{Datacenter: a.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("node", node).Msg("impossible to deregister node")
+		return derrors.NewInternalError("impossible to deregister node", err).WithParams(node)
+	}
+	return nil
+}
+
+// deregisterAgentService removes a service from the agent of the node where it is registered.
+func (a *ConsulClient) deregisterAgentService(nodeAddress string, serviceID string) derrors.Error {
+	client, cErr := a.nodeClient(nodeAddress)
+	if cErr != nil {
+		return cErr
+	}
+	err := client.Agent().ServiceDeregister(serviceID)
+	if err != nil {
+		log.Error().Err(err).Str("address", nodeAddress).Str("serviceId", serviceID).Msg("impossible to deregister service")
+		return derrors.NewInternalError("impossible to deregister service", err).WithParams(nodeAddress, serviceID)
+	}
+	return nil
+}
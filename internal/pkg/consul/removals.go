@@ -0,0 +1,103 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/consul/api"
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// removalKeyPrefix is the prefix of the keys of the member removals in the KV store,
+// <prefix><organizationId>/<networkId>/<nanoseconds>-<memberId>
+const removalKeyPrefix = "nalej-network/removals/"
+
+func removalNetworkPrefix(organizationID string, networkID string) string {
+	return fmt.Sprintf("%s%s/%s/", removalKeyPrefix, organizationID, networkID)
+}
+
+// MemberHistory stores the members removed from the ZeroTier networks in the KV store, so the history is kept
+// across restarts and shared by the replicas. Each network keeps its last size removals.
+type MemberHistory struct {
+	client *ConsulClient
+	size   int
+}
+
+// NewMemberHistory creates a history of member removals stored in the KV store.
+func NewMemberHistory(client *ConsulClient, size int) *MemberHistory {
+	return &MemberHistory{client: client, size: size}
+}
+
+// Add a removal to the history, discarding the oldest removals of the network when it is full.
+func (h *MemberHistory) Add(removal zt.MemberRemoval) derrors.Error {
+	if h.size <= 0 {
+		return nil
+	}
+	now := time.Now()
+	if removal.Timestamp == 0 {
+		removal.Timestamp = now.Unix()
+	}
+	value, err := json.Marshal(removal)
+	if err != nil {
+		return derrors.NewInternalError("impossible to encode the member removal", err).WithParams(removal.NetworkId, removal.MemberId)
+	}
+	prefix := removalNetworkPrefix(removal.OrganizationId, removal.NetworkId)
+	// the keys are sorted by the time of the removal
+	pair := &api.KVPair{Key: fmt.Sprintf("%s%020d-%s", prefix, now.UnixNano(), removal.MemberId), Value: value}
+	options := &api.WriteOptions{Datacenter: h.client.config.Datacenter}
+	if _, err := h.client.client.KV().Put(pair, options); err != nil {
+		log.Error().Err(err).Str("networkId", removal.NetworkId).Str("memberId", removal.MemberId).
+			Msg("impossible to store the member removal")
+		return derrors.NewGenericError("impossible to store the member removal", err).WithParams(removal.NetworkId, removal.MemberId)
+	}
+
+	keys, _, err := h.client.client.KV().Keys(prefix, "", &api.QueryOptions{Datacenter: h.client.config.Datacenter})
+	if err != nil {
+		return derrors.NewGenericError("impossible to retrieve the member removals", err).WithParams(removal.NetworkId)
+	}
+	for i := 0; i < len(keys)-h.size; i++ {
+		if _, err := h.client.client.KV().Delete(keys[i], options); err != nil {
+			return derrors.NewGenericError("impossible to discard the member removal", err).WithParams(keys[i])
+		}
+	}
+	return nil
+}
+
+// List the removals of a network of an organization, newest first.
+func (h *MemberHistory) List(organizationId string, networkId string) ([]zt.MemberRemoval, derrors.Error) {
+	pairs, _, err := h.client.client.KV().List(removalNetworkPrefix(organizationId, networkId),
+		&api.QueryOptions{Datacenter: h.client.config.Datacenter})
+	if err != nil {
+		log.Error().Err(err).Str("networkId", networkId).Msg("impossible to retrieve the member removals")
+		return nil, derrors.NewGenericError("impossible to retrieve the member removals", err).WithParams(organizationId, networkId)
+	}
+	removals := make([]zt.MemberRemoval, 0, len(pairs))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		removal := zt.MemberRemoval{}
+		if err := json.Unmarshal(pairs[i].Value, &removal); err != nil {
+			log.Warn().Err(err).Str("key", pairs[i].Key).Msg("skipping invalid member removal")
+			continue
+		}
+		removals = append(removals, removal)
+	}
+	return removals, nil
+}
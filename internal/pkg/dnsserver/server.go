@@ -0,0 +1,415 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dnsserver
+
+import (
+	"github.com/miekg/dns"
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/entities"
+	dnsprovider "github.com/nalej/network-manager/internal/pkg/provider/dns"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultDomain of the zones of the organizations
+	DefaultDomain = "nalej"
+	// DefaultTTL of the records in seconds
+	DefaultTTL = 30
+	// Zones of the reverse records
+	reverseZoneIPv4 = "in-addr.arpa."
+	reverseZoneIPv6 = "ip6.arpa."
+)
+
+// Server is an authoritative DNS server answering the queries of the zones of the organizations with the entries of
+// a DNS provider. The zone of an organization is <organizationId>.<domain> and an entry is named
+// <fqdn>.<organizationId>.<domain>. The entries with a port have a SRV record with their name too, and can be looked up
+// by service as _<service>._<protocol>.<organizationId>.<domain>. The aliases have a CNAME record pointing to the
+// name of their target. The server is also authoritative for the in-addr.arpa and ip6.arpa zones. As the overlay IPs
+// repeat across the networks and the organizations, the reverse records are answered in the networks of the member
+// sending the query, found by the PTR entries of its own IP.
+type Server struct {
+	provider dnsprovider.Provider
+	// zone containing the zones of the organizations, in canonical form
+	zone string
+	// ttl of the records
+	ttl uint32
+	// servers listening on UDP and TCP
+	servers []*dns.Server
+}
+
+// NewServer creates a DNS server for the zones of a domain.
+func NewServer(provider dnsprovider.Provider, domain string, ttl uint32) *Server {
+	return &Server{
+		provider: provider,
+		zone:     strings.ToLower(dns.Fqdn(domain)),
+		ttl:      ttl,
+	}
+}
+
+// Run launches the server on UDP and TCP. This method blocks until one of them fails or the server is shut down.
+func (s *Server) Run(address string) derrors.Error {
+	s.servers = []*dns.Server{
+		{Addr: address, Net: "udp", Handler: s},
+		{Addr: address, Net: "tcp", Handler: s},
+	}
+	log.Info().Str("address", address).Str("zone", s.zone).Msg("launching DNS server")
+	errs := make(chan error, len(s.servers))
+	for _, server := range s.servers {
+		go func(server *dns.Server) {
+			errs <- server.ListenAndServe()
+		}(server)
+	}
+	err := <-errs
+	s.Shutdown()
+	if err != nil {
+		return derrors.NewInternalError("DNS server failed", err).WithParams(address)
+	}
+	return nil
+}
+
+// Shutdown stops the server.
+func (s *Server) Shutdown() {
+	for _, server := range s.servers {
+		// a server that is not running returns an error that can be ignored
+		_ = server.Shutdown()
+	}
+}
+
+// ServeDNS answers a query.
+func (s *Server) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = true
+	if len(r.Question) != 1 {
+		m.SetRcode(r, dns.RcodeFormatError)
+	} else {
+		question := r.Question[0]
+		answer, extra, rcode, zone := s.answer(question, remoteIP(w.RemoteAddr()))
+		m.Answer = answer
+		m.Extra = extra
+		m.Rcode = rcode
+		if zone != "" && len(answer) == 0 && (rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError) {
+			m.Ns = []dns.RR{s.soa(zone)}
+		}
+		log.Debug().Str("name", question.Name).Str("type", dns.TypeToString[question.Qtype]).
+			Str("rcode", dns.RcodeToString[rcode]).Int("answers", len(answer)).Msg("DNS query")
+	}
+	if err := w.WriteMsg(m); err != nil {
+		log.Warn().Err(err).Msg("unable to write DNS response")
+	}
+}
+
+// remoteIP returns the IP of the address of the sender of a query, nil if it is unknown.
+func remoteIP(address net.Addr) net.IP {
+	switch addr := address.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// answer returns the records of a question sent from an IP, the additional records, the response code and the zone
+// of the name, if any.
+func (s *Server) answer(question dns.Question, querier net.IP) ([]dns.RR, []dns.RR, int, string) {
+	name := strings.ToLower(dns.Fqdn(question.Name))
+	if question.Qclass != dns.ClassINET && question.Qclass != dns.ClassANY {
+		return nil, nil, dns.RcodeRefused, ""
+	}
+	for _, reverseZone := range []string{reverseZoneIPv4, reverseZoneIPv6} {
+		if name == reverseZone && question.Qtype == dns.TypeSOA {
+			return []dns.RR{s.soa(reverseZone)}, nil, dns.RcodeSuccess, reverseZone
+		}
+		if dns.IsSubDomain(reverseZone, name) {
+			answer, rcode := s.answerReverse(name, querier, question.Qtype)
+			return answer, nil, rcode, reverseZone
+		}
+	}
+	if !dns.IsSubDomain(s.zone, name) {
+		return nil, nil, dns.RcodeRefused, ""
+	}
+	if name == s.zone {
+		if question.Qtype == dns.TypeSOA {
+			return []dns.RR{s.soa(s.zone)}, nil, dns.RcodeSuccess, s.zone
+		}
+		return nil, nil, dns.RcodeSuccess, s.zone
+	}
+
+	// <fqdn>.<organizationId>.<domain>
+	relative := strings.TrimSuffix(name, "."+s.zone)
+	organizationId, fqdn := relative, ""
+	if separator := strings.LastIndex(relative, "."); separator != -1 {
+		organizationId, fqdn = relative[separator+1:], relative[:separator]
+	}
+	orgZone := organizationId + "." + s.zone
+	if fqdn == "" {
+		if question.Qtype == dns.TypeSOA {
+			return []dns.RR{s.soa(orgZone)}, nil, dns.RcodeSuccess, orgZone
+		}
+		return nil, nil, dns.RcodeSuccess, orgZone
+	}
+
+	entries, err := s.provider.List(organizationId)
+	if err != nil {
+		log.Warn().Str("organizationId", organizationId).Str("trace", err.DebugReport()).Msg("unable to list DNS entries")
+		return nil, nil, dns.RcodeServerFailure, ""
+	}
+	if strings.HasPrefix(fqdn, "_") {
+		return s.answerService(name, organizationId, fqdn, entries, question.Qtype)
+	}
+	answer, extra, found := s.answerName(name, organizationId, fqdn, entries, question.Qtype, 0)
+	if !found {
+		return nil, nil, dns.RcodeNameError, orgZone
+	}
+	return answer, extra, dns.RcodeSuccess, orgZone
+}
+
+// answerName returns the records of the entries with a FQDN, the additional records and whether there is any entry
+// with the FQDN. An alias is answered with its CNAME record followed by the records of its target, following up to
+// MaxAliasChain aliases.
+func (s *Server) answerName(name string, organizationId string, fqdn string, entries []entities.DNSEntry, qtype uint16, depth int) ([]dns.RR, []dns.RR, bool) {
+	found := false
+	answer := make([]dns.RR, 0)
+	extra := make([]dns.RR, 0)
+	for _, entry := range entries {
+		if !strings.EqualFold(strings.TrimSuffix(entry.Fqdn, "."), fqdn) {
+			continue
+		}
+		found = true
+		if entry.IsAlias() {
+			target := s.recordName(organizationId, entry.Target)
+			answer = append(answer, &dns.CNAME{Hdr: s.header(name, dns.TypeCNAME), Target: target})
+			if qtype != dns.TypeCNAME && qtype != dns.TypeANY && depth < entities.MaxAliasChain {
+				targetAnswer, targetExtra, _ := s.answerName(target, organizationId, strings.TrimSuffix(entry.Target, "."), entries, qtype, depth+1)
+				answer = append(answer, targetAnswer...)
+				extra = append(extra, targetExtra...)
+			}
+			continue
+		}
+		answer = append(answer, s.addressRecords(name, entry, qtype)...)
+		if entry.Port != 0 && entry.Type == "" && (qtype == dns.TypeSRV || qtype == dns.TypeANY) {
+			answer = append(answer, s.srv(name, name, entry))
+			extra = append(extra, s.addressRecords(name, entry, dns.TypeANY)...)
+		}
+	}
+	return answer, extra, found
+}
+
+// answerService returns the SRV records of the entries of a service name, _<service>._<protocol>, with the addresses
+// of their targets as additional records.
+func (s *Server) answerService(name string, organizationId string, serviceName string, entries []entities.DNSEntry, qtype uint16) ([]dns.RR, []dns.RR, int, string) {
+	orgZone := organizationId + "." + s.zone
+	labels := strings.Split(serviceName, ".")
+	if len(labels) != 2 || !strings.HasPrefix(labels[1], "_") {
+		return nil, nil, dns.RcodeNameError, orgZone
+	}
+	service, protocol := labels[0][1:], labels[1][1:]
+	found := false
+	answer := make([]dns.RR, 0)
+	extra := make([]dns.RR, 0)
+	for _, entry := range entries {
+		if entry.Port == 0 || entry.Type != "" || !strings.EqualFold(entry.Protocol, protocol) || !strings.EqualFold(entryService(entry), service) {
+			continue
+		}
+		found = true
+		if qtype == dns.TypeSRV || qtype == dns.TypeANY {
+			target := s.recordName(organizationId, entry.Fqdn)
+			answer = append(answer, s.srv(name, target, entry))
+			extra = append(extra, s.addressRecords(target, entry, dns.TypeANY)...)
+		}
+	}
+	if !found {
+		return nil, nil, dns.RcodeNameError, orgZone
+	}
+	return answer, extra, dns.RcodeSuccess, orgZone
+}
+
+// entryService returns the service of an entry for the SRV lookups, its service name or the first label of its FQDN
+// if it has none.
+func entryService(entry entities.DNSEntry) string {
+	if entry.ServiceName != "" {
+		return entry.ServiceName
+	}
+	return strings.SplitN(entry.Fqdn, ".", 2)[0]
+}
+
+// srv returns the SRV record of an entry with a port.
+func (s *Server) srv(name string, target string, entry entities.DNSEntry) dns.RR {
+	return &dns.SRV{
+		Hdr:      s.header(name, dns.TypeSRV),
+		Priority: 1,
+		Weight:   1,
+		Port:     uint16(entry.Port),
+		Target:   target,
+	}
+}
+
+// addressRecords returns the A or AAAA record of an address entry if its address matches the type of the question.
+func (s *Server) addressRecords(name string, entry entities.DNSEntry, qtype uint16) []dns.RR {
+	ip := net.ParseIP(entry.Ip)
+	if ip == nil || entry.Type != "" {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil && (qtype == dns.TypeA || qtype == dns.TypeANY) {
+		return []dns.RR{&dns.A{Hdr: s.header(name, dns.TypeA), A: ip4}}
+	}
+	if ip.To4() == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY) {
+		return []dns.RR{&dns.AAAA{Hdr: s.header(name, dns.TypeAAAA), AAAA: ip}}
+	}
+	return nil
+}
+
+// answerReverse returns the PTR records of a reverse name in the networks of the member sending the query. The PTR
+// entries of the networks point to their target and the address entries of the networks to their own name. The
+// queries of senders that are not members of a network, or whose IP is found in several organizations, are refused.
+func (s *Server) answerReverse(name string, querier net.IP, qtype uint16) ([]dns.RR, int) {
+	ip := reverseIP(name)
+	if ip == nil {
+		if querier == nil {
+			return nil, dns.RcodeRefused
+		}
+		return nil, dns.RcodeNameError
+	}
+	organizationId, networkIds, entries, rcode := s.querierNetworks(querier)
+	if rcode != dns.RcodeSuccess {
+		return nil, rcode
+	}
+	found := false
+	answer := make([]dns.RR, 0)
+	for _, networkId := range networkIds {
+		entryName, err := entities.ReverseEntryName(networkId, ip.String())
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			var target string
+			if entry.Type == entities.RecordTypePTR && strings.EqualFold(strings.TrimSuffix(entry.Fqdn, "."), entryName) {
+				target = s.recordName(organizationId, entry.Target)
+			} else if entry.Type == "" && entry.NetworkId == networkId && ip.Equal(net.ParseIP(entry.Ip)) {
+				target = s.recordName(organizationId, entry.Fqdn)
+			} else {
+				continue
+			}
+			found = true
+			if qtype == dns.TypePTR || qtype == dns.TypeANY {
+				answer = append(answer, &dns.PTR{Hdr: s.header(name, dns.TypePTR), Ptr: target})
+			}
+		}
+	}
+	if !found {
+		return nil, dns.RcodeNameError
+	}
+	return answer, dns.RcodeSuccess
+}
+
+// querierNetworks returns the organization, the networks and the entries of the organization of the member with the
+// IP of the sender of a query. The member is identified by the PTR entries of its IP.
+func (s *Server) querierNetworks(querier net.IP) (string, []string, []entities.DNSEntry, int) {
+	if querier == nil {
+		return "", nil, nil, dns.RcodeRefused
+	}
+	organizationIds, err := s.provider.ListOrganizations()
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Msg("unable to list the organizations with DNS entries")
+		return "", nil, nil, dns.RcodeServerFailure
+	}
+	owner := ""
+	var networkIds []string
+	var ownerEntries []entities.DNSEntry
+	for _, organizationId := range organizationIds {
+		entries, err := s.provider.List(organizationId)
+		if err != nil {
+			log.Warn().Str("organizationId", organizationId).Str("trace", err.DebugReport()).Msg("unable to list DNS entries")
+			return "", nil, nil, dns.RcodeServerFailure
+		}
+		networks := make([]string, 0)
+		for _, entry := range entries {
+			if entry.Type == entities.RecordTypePTR && entry.NetworkId != "" && querier.Equal(net.ParseIP(entry.Ip)) {
+				networks = append(networks, entry.NetworkId)
+			}
+		}
+		if len(networks) == 0 {
+			continue
+		}
+		if owner != "" {
+			log.Warn().Str("querier", querier.String()).Msg("reverse query from an IP of several organizations")
+			return "", nil, nil, dns.RcodeRefused
+		}
+		owner, networkIds, ownerEntries = organizationId, networks, entries
+	}
+	if owner == "" {
+		return "", nil, nil, dns.RcodeRefused
+	}
+	return owner, networkIds, ownerEntries, dns.RcodeSuccess
+}
+
+// recordName returns the name of the record of an entry.
+func (s *Server) recordName(organizationId string, fqdn string) string {
+	return strings.ToLower(strings.TrimSuffix(fqdn, ".")) + "." + organizationId + "." + s.zone
+}
+
+func (s *Server) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: s.ttl}
+}
+
+// soa returns the SOA record of a zone. The serial changes every second as the entries are not versioned.
+func (s *Server) soa(zone string) dns.RR {
+	return &dns.SOA{
+		Hdr:     s.header(zone, dns.TypeSOA),
+		Ns:      "ns." + s.zone,
+		Mbox:    "hostmaster." + s.zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.ttl,
+	}
+}
+
+// reverseIP returns the address of a complete reverse name, nil if the name is not complete or invalid.
+func reverseIP(name string) net.IP {
+	if dns.IsSubDomain(reverseZoneIPv4, name) {
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+reverseZoneIPv4))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+		for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+			labels[i], labels[j] = labels[j], labels[i]
+		}
+		return net.ParseIP(strings.Join(labels, ".")).To4()
+	}
+	labels := dns.SplitDomainName(strings.TrimSuffix(name, "."+reverseZoneIPv6))
+	if len(labels) != 2*net.IPv6len {
+		return nil
+	}
+	var address strings.Builder
+	for i := len(labels) - 1; i >= 0; i-- {
+		if len(labels[i]) != 1 {
+			return nil
+		}
+		address.WriteString(labels[i])
+		if i%4 == 0 && i != 0 {
+			address.WriteString(":")
+		}
+	}
+	return net.ParseIP(address.String())
+}
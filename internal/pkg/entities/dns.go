@@ -18,44 +18,194 @@
 package entities
 
 import (
+	"fmt"
 	"github.com/hashicorp/consul/api"
+	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-network-go"
+	"net"
+	"strings"
 )
 
+// Protocols of the ports of the DNS entries
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
+// Types of the records of the DNS entries. The entries without type are address records.
+const (
+	// RecordTypePTR is the type of the reverse records, named after the reverse name of their IP
+	RecordTypePTR = "PTR"
+	// RecordTypeCNAME is the type of the aliases, pointing to another entry of the organization
+	RecordTypeCNAME = "CNAME"
+)
+
+// MaxAliasChain is the maximum number of aliases followed to resolve an alias
+const MaxAliasChain = 8
+
+// Zones of the reverse names
+const (
+	reverseZoneIPv4 = "in-addr.arpa"
+	reverseZoneIPv6 = "ip6.arpa"
+)
+
+// DNSEntry with a DNS entry of an organization. The entry is owned by its organization, application instance and
+// service group.
 type DNSEntry struct {
 	OrganizationId string
+	AppInstanceId  string
+	ServiceGroupId string
 	NetworkId      string
-	Fqdn           string
-	Ip             string
-	ServiceName    string
-	Tags           []string
+	// ClusterId of the endpoint of a connection. The entries of a FQDN in several clusters are kept side by side, so
+	// the name has an address record per cluster.
+	ClusterId   string
+	Fqdn        string
+	Ip          string
+	ServiceName string
+	// Port of the service, 0 if the entry has no SRV record
+	Port int32
+	// Protocol of the port
+	Protocol string
+	// Type of the record, empty for address records
+	Type string
+	// Target name of the record, if it is not an address record
+	Target string
+	Tags   []string
+}
+
+// NewReverseEntry creates the PTR entry of an IP of a network pointing to a target name.
+func NewReverseEntry(organizationId string, appInstanceId string, serviceGroupId string, networkId string, ip string, target string) (*DNSEntry, derrors.Error) {
+	name, err := ReverseEntryName(networkId, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &DNSEntry{
+		OrganizationId: organizationId,
+		AppInstanceId:  appInstanceId,
+		ServiceGroupId: serviceGroupId,
+		NetworkId:      networkId,
+		Fqdn:           name,
+		Ip:             ip,
+		Type:           RecordTypePTR,
+		Target:         target,
+	}, nil
+}
+
+// ReverseEntryName returns the name of the PTR entry of an IP of a network, <networkId>.<reverse name>. The overlay
+// IPs repeat across the networks of an organization, so the entries of each network are kept apart.
+func ReverseEntryName(networkId string, ip string) (string, derrors.Error) {
+	name, err := ReverseName(ip)
+	if err != nil {
+		return "", err
+	}
+	if networkId == "" {
+		return name, nil
+	}
+	return fmt.Sprintf("%s.%s", networkId, name), nil
+}
+
+// ReverseName returns the name of the reverse record of an IP, in the in-addr.arpa zone for IPv4 and in the ip6.arpa
+// zone for IPv6.
+func ReverseName(ip string) (string, derrors.Error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", derrors.NewInvalidArgumentError("invalid IP").WithParams(ip)
+	}
+	if ip4 := parsed.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.%s", ip4[3], ip4[2], ip4[1], ip4[0], reverseZoneIPv4), nil
+	}
+	labels := make([]string, 0, 2*net.IPv6len+1)
+	for i := net.IPv6len - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", parsed[i]&0x0f), fmt.Sprintf("%x", parsed[i]>>4))
+	}
+	return strings.Join(append(labels, reverseZoneIPv6), "."), nil
+}
+
+// recordType returns the type of the record of an entry with a target, an alias if it has one.
+func recordType(target string) string {
+	if target != "" {
+		return RecordTypeCNAME
+	}
+	return ""
+}
+
+// portProtocol returns the protocol of a port, TCP if the port has no protocol.
+func portProtocol(port int32, protocol string) string {
+	if port == 0 {
+		return ""
+	}
+	if protocol == "" {
+		return ProtocolTCP
+	}
+	return strings.ToLower(protocol)
 }
 
 func DNSEntryFromGRPC(entry *grpc_network_go.AddDNSEntryRequest) DNSEntry {
 	return DNSEntry{
 		OrganizationId: entry.OrganizationId,
+		AppInstanceId:  entry.AppInstanceId,
+		ServiceGroupId: entry.ServiceGroupId,
 		Fqdn:           entry.Fqdn,
 		Ip:             entry.Ip,
 		ServiceName:    entry.ServiceName,
+		Port:           entry.Port,
+		Protocol:       portProtocol(entry.Port, entry.Protocol),
+		Type:           recordType(entry.Target),
+		Target:         entry.Target,
 		Tags:           entry.Tags,
 	}
 }
 
+func DNSEntryFromServiceGRPC(request *grpc_network_go.AddServiceDNSEntryRequest) DNSEntry {
+	return DNSEntry{
+		OrganizationId: request.OrganizationId,
+		Fqdn:           request.Fqdn,
+		Ip:             request.Ip,
+		Port:           request.Port,
+		Protocol:       portProtocol(request.Port, request.Protocol),
+		Type:           recordType(request.Target),
+		Target:         request.Target,
+		Tags:           request.Tags,
+	}
+}
+
 func (e *DNSEntry) ToGRPC() *grpc_network_go.DNSEntry {
 	return &grpc_network_go.DNSEntry{
 		OrganizationId: e.OrganizationId,
 		NetworkId:      e.NetworkId,
 		Fqdn:           e.Fqdn,
 		Ip:             e.Ip,
+		ServiceName:    e.ServiceName,
+		Port:           e.Port,
+		Protocol:       e.Protocol,
+		Target:         e.Target,
 		Tags:           e.Tags,
 	}
 }
 
+func (e *DNSEntry) ToServiceDNSEntry() *grpc_network_go.ServiceDNSEntry {
+	return &grpc_network_go.ServiceDNSEntry{
+		OrganizationId: e.OrganizationId,
+		Fqdn:           e.Fqdn,
+		Ip:             e.Ip,
+		Port:           e.Port,
+		Protocol:       e.Protocol,
+		Target:         e.Target,
+		Tags:           e.Tags,
+	}
+}
+
+// IsAlias checks if the entry is an alias of another entry.
+func (e *DNSEntry) IsAlias() bool {
+	return e.Type == RecordTypeCNAME
+}
+
 func (e *DNSEntry) ToConsulAPI() *api.AgentServiceRegistration {
 	return &api.AgentServiceRegistration{
 		Kind:    api.ServiceKind(e.OrganizationId),
 		Name:    e.Fqdn,
 		Address: e.Ip,
+		Port:    int(e.Port),
 		Tags:    e.Tags,
 	}
 }
@@ -66,6 +216,9 @@ func AddDNSRequestToEntry(e *grpc_network_go.AddDNSEntryRequest) *grpc_network_g
 		Tags:           e.Tags,
 		OrganizationId: e.OrganizationId,
 		Ip:             e.Ip,
+		Port:           e.Port,
+		Protocol:       e.Protocol,
+		Target:         e.Target,
 		//NetworkId:
 	}
 }
@@ -40,3 +40,104 @@ func (n *Network) ToGRPC() *grpc_network_go.Network {
 		CreationTimestamp: n.CreationTimestamp,
 	}
 }
+
+// NetworkError describes a network of the organization that could not be retrieved.
+type NetworkError struct {
+	// NetworkId with the ZeroTier network identifier.
+	NetworkId string
+	// Error with the reason the network could not be retrieved.
+	Error string
+}
+
+func (e *NetworkError) ToGRPC() *grpc_network_go.NetworkError {
+	return &grpc_network_go.NetworkError{
+		NetworkId: e.NetworkId,
+		Error:     e.Error,
+	}
+}
+
+type NetworkMember struct {
+	// OrganizationId with the organization identifier.
+	OrganizationId string
+	// NetworkId with the ZeroTier network identifier.
+	NetworkId string
+	// MemberId with the 10-digit ZeroTier address of the member.
+	MemberId string
+	// Authorized indicates if the member is authorized to join the network.
+	Authorized bool
+	// IpAssignments with the managed IP addresses of the member.
+	IpAssignments []string
+	// Time the member was last authorized on the network.
+	LastAuthorizedTime int64
+	// Public ZeroTier identity of the member.
+	Identity string
+}
+
+func (m *NetworkMember) ToGRPC() *grpc_network_go.NetworkMember {
+	return &grpc_network_go.NetworkMember{
+		OrganizationId:     m.OrganizationId,
+		NetworkId:          m.NetworkId,
+		MemberId:           m.MemberId,
+		Authorized:         m.Authorized,
+		IpAssignments:      m.IpAssignments,
+		LastAuthorizedTime: m.LastAuthorizedTime,
+		Identity:           m.Identity,
+	}
+}
+
+// ControllerStatus with the health information of the ZeroTier controller.
+type ControllerStatus struct {
+	// Address with the 10-digit ZeroTier address of the controller.
+	Address string
+	// Version of ZeroTier One running in the controller.
+	Version string
+	// Online is true if the controller can communicate with at least one root.
+	Online bool
+	// TcpFallbackActive is true if the controller is tunneling through a TCP relay.
+	TcpFallbackActive bool
+	// PublicIdentity with the address and public key of the controller.
+	PublicIdentity string
+	// Clock with the system clock of the controller, in milliseconds.
+	Clock int64
+}
+
+func (s *ControllerStatus) ToGRPC() *grpc_network_go.ControllerStatus {
+	return &grpc_network_go.ControllerStatus{
+		Address:           s.Address,
+		Version:           s.Version,
+		Online:            s.Online,
+		TcpFallbackActive: s.TcpFallbackActive,
+		PublicIdentity:    s.PublicIdentity,
+		Clock:             s.Clock,
+	}
+}
+
+// MemberRemoval with a member removed from a network.
+type MemberRemoval struct {
+	// OrganizationId with the organization identifier.
+	OrganizationId string
+	// NetworkId with the ZeroTier network identifier.
+	NetworkId string
+	// MemberId with the 10-digit ZeroTier address of the member.
+	MemberId string
+	// Identity with the address and public key of the member, if known.
+	Identity string
+	// IpAssignments with the IPs of the member when it was removed.
+	IpAssignments []string
+	// Reason of the removal.
+	Reason string
+	// Timestamp of the removal.
+	Timestamp int64
+}
+
+func (r *MemberRemoval) ToGRPC() *grpc_network_go.MemberRemoval {
+	return &grpc_network_go.MemberRemoval{
+		OrganizationId: r.OrganizationId,
+		NetworkId:      r.NetworkId,
+		MemberId:       r.MemberId,
+		Identity:       r.Identity,
+		IpAssignments:  r.IpAssignments,
+		Reason:         r.Reason,
+		Timestamp:      r.Timestamp,
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-network-go"
 	"github.com/nalej/grpc-organization-go"
+	"strings"
 )
 
 const (
@@ -32,6 +33,15 @@ const (
 	emptyAppId          = "Application instance ID cannot be empty"
 	emptyIp             = "Service IP cannot be empty"
 	emptyAppInstanceId  = "app_instance_id cannot be empty"
+	invalidPort         = "port must be between 0 and 65535"
+	invalidProtocol     = "protocol must be tcp or udp"
+	protocolWithoutPort = "protocol requires a port"
+	aliasWithIp         = "an alias cannot have an IP"
+	aliasWithPort       = "an alias cannot have a port"
+	aliasOfItself       = "an alias cannot point to itself"
+	aliasLoop           = "alias loop"
+	aliasTooLong        = "alias chain too long"
+	aliasTargetNotFound = "alias target not found"
 )
 
 func ValidAddNetworkRequest(addNetworkRequest *grpc_network_go.AddNetworkRequest) derrors.Error {
@@ -57,10 +67,121 @@ func ValidNetworkId(networkId *grpc_network_go.NetworkId) derrors.Error {
 	return nil
 }
 
+func ValidMemberId(memberId *grpc_network_go.MemberId) derrors.Error {
+	if memberId.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if memberId.NetworkId == "" {
+		return derrors.NewInvalidArgumentError(emptyNetworkId)
+	}
+	if memberId.MemberId == "" {
+		return derrors.NewInvalidArgumentError(emptyMemberId)
+	}
+	return nil
+}
+
 func ValidFQDN(fqdn *grpc_network_go.DNSEntry) derrors.Error {
 	if fqdn.Fqdn == "" {
 		return derrors.NewInvalidArgumentError(emptyFQDN)
 	}
+	if err := ValidTarget(fqdn.Fqdn, fqdn.Ip, fqdn.Port, fqdn.Target); err != nil {
+		return err
+	}
+	return ValidPort(fqdn.Port, fqdn.Protocol)
+}
+
+// ValidTarget checks the target of a DNS entry. An entry with a target is an alias, without IP or port.
+func ValidTarget(fqdn string, ip string, port int32, target string) derrors.Error {
+	if target == "" {
+		return nil
+	}
+	if ip != "" {
+		return derrors.NewInvalidArgumentError(aliasWithIp).WithParams(fqdn, ip)
+	}
+	if port != 0 {
+		return derrors.NewInvalidArgumentError(aliasWithPort).WithParams(fqdn, port)
+	}
+	if sameName(fqdn, target) {
+		return derrors.NewInvalidArgumentError(aliasOfItself).WithParams(fqdn)
+	}
+	return nil
+}
+
+// ValidAlias checks that the target of an alias is an entry of the given entries of its organization, following the
+// chain of aliases until an entry that is not an alias. The chain must not loop back to the alias nor have more than
+// MaxAliasChain aliases.
+func ValidAlias(alias DNSEntry, entries []DNSEntry) derrors.Error {
+	byName := make(map[string]DNSEntry, len(entries))
+	for _, entry := range entries {
+		byName[normalizeName(entry.Fqdn)] = entry
+	}
+	visited := map[string]bool{normalizeName(alias.Fqdn): true}
+	target := alias.Target
+	for i := 0; i < MaxAliasChain; i++ {
+		name := normalizeName(target)
+		if visited[name] {
+			return derrors.NewFailedPreconditionError(aliasLoop).WithParams(alias.Fqdn, target)
+		}
+		entry, exists := byName[name]
+		if !exists {
+			return derrors.NewNotFoundError(aliasTargetNotFound).WithParams(alias.Fqdn, target)
+		}
+		if !entry.IsAlias() {
+			return nil
+		}
+		visited[name] = true
+		target = entry.Target
+	}
+	return derrors.NewFailedPreconditionError(aliasTooLong).WithParams(alias.Fqdn, MaxAliasChain)
+}
+
+// sameName checks if two names are the same, ignoring the case and the trailing dot.
+func sameName(a string, b string) bool {
+	return normalizeName(a) == normalizeName(b)
+}
+
+func normalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// ValidPort checks the port of a DNS entry. The protocol is optional and only allowed with a port.
+func ValidPort(port int32, protocol string) derrors.Error {
+	if port < 0 || port > 65535 {
+		return derrors.NewInvalidArgumentError(invalidPort).WithParams(port)
+	}
+	if port == 0 && protocol != "" {
+		return derrors.NewInvalidArgumentError(protocolWithoutPort).WithParams(protocol)
+	}
+	switch strings.ToLower(protocol) {
+	case "", ProtocolTCP, ProtocolUDP:
+		return nil
+	}
+	return derrors.NewInvalidArgumentError(invalidProtocol).WithParams(protocol)
+}
+
+func ValidAddDNSEntriesRequest(request *grpc_network_go.AddDNSEntriesRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if _, exists := grpc_network_go.ConflictPolicy_name[int32(request.ConflictPolicy)]; !exists {
+		return derrors.NewInvalidArgumentError("invalid conflict policy").WithParams(request.ConflictPolicy)
+	}
+	fqdns := make(map[string]bool, len(request.Entries))
+	for _, entry := range request.Entries {
+		if entry.OrganizationId != "" && entry.OrganizationId != request.OrganizationId {
+			return derrors.NewInvalidArgumentError("entry of another organization").WithParams(entry.Fqdn, entry.OrganizationId)
+		}
+		if err := ValidFQDN(AddDNSRequestToEntry(entry)); err != nil {
+			return err
+		}
+		if entry.Ip == "" && entry.Target == "" {
+			return derrors.NewInvalidArgumentError(emptyIp).WithParams(entry.Fqdn)
+		}
+		if fqdns[entry.Fqdn] {
+			return derrors.NewInvalidArgumentError("duplicated FQDN").WithParams(entry.Fqdn)
+		}
+		fqdns[entry.Fqdn] = true
+	}
 	return nil
 }
 
@@ -74,6 +195,22 @@ func ValidDeleteNetworkRequest(deleteNetworkRequest *grpc_network_go.DeleteNetwo
 	return nil
 }
 
+func ValidUpdateNetworkRequest(updateNetworkRequest *grpc_network_go.UpdateNetworkRequest) derrors.Error {
+	if updateNetworkRequest.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if updateNetworkRequest.NetworkId == "" {
+		return derrors.NewInvalidArgumentError(emptyNetworkId)
+	}
+	if updateNetworkRequest.UpdateName && updateNetworkRequest.Name == "" {
+		return derrors.NewInvalidArgumentError(emptyNetworkName)
+	}
+	if updateNetworkRequest.UpdateRules && updateNetworkRequest.AppInstanceId == "" {
+		return derrors.NewInvalidArgumentError(emptyAppInstanceId)
+	}
+	return nil
+}
+
 func ValidAuthorizeMemberRequest(authMemberRequest *grpc_network_go.AuthorizeMemberRequest) derrors.Error {
 	if authMemberRequest.OrganizationId == "" {
 		return derrors.NewInvalidArgumentError(emptyOrganizationId)
@@ -97,10 +234,13 @@ func ValidAddServiceDNSEntryRequest(request *grpc_network_go.AddServiceDNSEntryR
 	if request.Fqdn == "" {
 		return derrors.NewInvalidArgumentError(emptyFQDN)
 	}
-	if request.Ip == "" {
+	if request.Ip == "" && request.Target == "" {
 		return derrors.NewInvalidArgumentError(emptyIp)
 	}
-	return nil
+	if err := ValidTarget(request.Fqdn, request.Ip, request.Port, request.Target); err != nil {
+		return err
+	}
+	return ValidPort(request.Port, request.Protocol)
 }
 
 func ValidDeleteServiceDNSEntryRequest(request *grpc_network_go.DeleteServiceDNSEntryRequest) derrors.Error {
@@ -113,6 +253,16 @@ func ValidDeleteServiceDNSEntryRequest(request *grpc_network_go.DeleteServiceDNS
 	return nil
 }
 
+func ValidListServiceDNSEntriesRequest(request *grpc_network_go.ListServiceDNSEntriesRequest) derrors.Error {
+	if request.OrganizationId == "" {
+		return derrors.NewInvalidArgumentError(emptyOrganizationId)
+	}
+	if request.PageSize < 0 {
+		return derrors.NewInvalidArgumentError("page_size cannot be negative")
+	}
+	return nil
+}
+
 func ValidAuthorizeZTConnectionRequest(request *grpc_network_go.AuthorizeZTConnectionRequest) derrors.Error {
 	if request.OrganizationId == "" {
 		return derrors.NewInvalidArgumentError(emptyOrganizationId)
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package entities
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func testAlias(fqdn string, target string) DNSEntry {
+	return DNSEntry{OrganizationId: "org1", Fqdn: fqdn, Type: RecordTypeCNAME, Target: target}
+}
+
+var _ = ginkgo.Describe("Alias validation", func() {
+
+	entries := []DNSEntry{
+		{OrganizationId: "org1", Fqdn: "web.example.com", Ip: "10.0.0.1"},
+		testAlias("www.example.com", "web.example.com"),
+		testAlias("loop1.example.com", "loop2.example.com"),
+		testAlias("loop2.example.com", "loop1.example.com"),
+	}
+
+	ginkgo.It("should accept an alias of an entry", func() {
+		gomega.Expect(ValidAlias(testAlias("app.example.com", "web.example.com"), entries)).To(gomega.Succeed())
+		gomega.Expect(ValidAlias(testAlias("app.example.com", "WEB.example.com."), entries)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should accept an alias of another alias", func() {
+		gomega.Expect(ValidAlias(testAlias("app.example.com", "www.example.com"), entries)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should reject an alias of a missing entry", func() {
+		err := ValidAlias(testAlias("app.example.com", "missing.example.com"), entries)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.NotFound))
+	})
+
+	ginkgo.It("should reject the loops", func() {
+		// the alias points to itself
+		err := ValidAlias(testAlias("app.example.com", "app.example.com"), entries)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+		// the alias replaces an alias pointing to it
+		err = ValidAlias(testAlias("web.example.com", "www.example.com"), entries)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+		// the target is in a loop
+		err = ValidAlias(testAlias("app.example.com", "loop1.example.com"), entries)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+	})
+
+	ginkgo.It("should reject the chains that are too long", func() {
+		chain := []DNSEntry{{OrganizationId: "org1", Fqdn: "web.example.com", Ip: "10.0.0.1"}}
+		target := "web.example.com"
+		for i := 0; i < MaxAliasChain; i++ {
+			fqdn := fmt.Sprintf("alias%d.example.com", i)
+			chain = append(chain, testAlias(fqdn, target))
+			target = fqdn
+		}
+		gomega.Expect(ValidAlias(testAlias("app.example.com", "alias0.example.com"), chain)).To(gomega.Succeed())
+		err := ValidAlias(testAlias("app.example.com", target), chain)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+	})
+})
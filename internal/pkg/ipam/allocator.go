@@ -0,0 +1,287 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ipam
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSupernet     = "192.168.0.0/16"
+	DefaultPrefixLength = 24
+	// Number of ranges at the beginning of the supernet that are not allocated to connections. The first one is
+	// used by the application networks.
+	ReservedRanges = 3
+	// Maximum prefix length of a range, so it has at least two assignable IPs
+	MaxPrefixLength = 30
+	// OrganizationSeparator separates the organization from its configuration (<organizationId>=<supernet>:<prefixLength>)
+	OrganizationSeparator = "="
+	// PrefixLengthSeparator separates the supernet from the prefix length of the ranges
+	PrefixLengthSeparator = ":"
+	// ClusterSeparator separates the cluster from an excluded CIDR (<clusterId>=<cidr>)
+	ClusterSeparator = "="
+	// AllClusters is the cluster identifier of the CIDRs excluded in every cluster
+	AllClusters = "*"
+)
+
+// Config with the supernet where the ranges of an organization are allocated.
+type Config struct {
+	Supernet Range
+	// PrefixLength of the allocated ranges
+	PrefixLength int
+}
+
+// NewConfig creates an allocation configuration.
+func NewConfig(supernet string, prefixLength int) (*Config, derrors.Error) {
+	network, err := ParseRange(supernet)
+	if err != nil {
+		return nil, err
+	}
+	if prefixLength > MaxPrefixLength {
+		return nil, derrors.NewInvalidArgumentError("prefix length is too long").WithParams(prefixLength)
+	}
+	// the supernet must hold the reserved ranges and at least one more
+	if prefixLength-network.PrefixLength() < 2 {
+		return nil, derrors.NewInvalidArgumentError("supernet is too small for the prefix length").WithParams(supernet, prefixLength)
+	}
+	return &Config{Supernet: *network, PrefixLength: prefixLength}, nil
+}
+
+// ParseOrganizationConfigs parses the configurations of the organizations (<organizationId>=<supernet>:<prefixLength>).
+func ParseOrganizationConfigs(values []string) (map[string]Config, derrors.Error) {
+	configs := make(map[string]Config, len(values))
+	for _, value := range values {
+		orgTokens := strings.SplitN(value, OrganizationSeparator, 2)
+		if len(orgTokens) != 2 || orgTokens[0] == "" {
+			return nil, derrors.NewInvalidArgumentError("incorrect organization IPAM format").WithParams(value)
+		}
+		netTokens := strings.SplitN(orgTokens[1], PrefixLengthSeparator, 2)
+		if len(netTokens) != 2 {
+			return nil, derrors.NewInvalidArgumentError("incorrect organization IPAM format").WithParams(value)
+		}
+		prefixLength, convErr := strconv.Atoi(netTokens[1])
+		if convErr != nil {
+			return nil, derrors.NewInvalidArgumentError("incorrect prefix length").WithParams(value)
+		}
+		config, err := NewConfig(netTokens[0], prefixLength)
+		if err != nil {
+			return nil, err
+		}
+		configs[orgTokens[0]] = *config
+	}
+	return configs, nil
+}
+
+// ParseClusterExclusions parses the CIDRs excluded in the clusters (<clusterId>=<cidr>). The CIDRs of the
+// AllClusters identifier are excluded in every cluster.
+func ParseClusterExclusions(values []string) (map[string][]Range, derrors.Error) {
+	exclusions := make(map[string][]Range, 0)
+	for _, value := range values {
+		tokens := strings.SplitN(value, ClusterSeparator, 2)
+		if len(tokens) != 2 || tokens[0] == "" {
+			return nil, derrors.NewInvalidArgumentError("incorrect cluster exclusion format").WithParams(value)
+		}
+		excluded, err := ParseRange(tokens[1])
+		if err != nil {
+			return nil, err
+		}
+		exclusions[tokens[0]] = append(exclusions[tokens[0]], *excluded)
+	}
+	return exclusions, nil
+}
+
+// Size returns the number of ranges in the supernet.
+func (c *Config) Size() uint32 {
+	return uint32(1) << uint(c.PrefixLength-c.Supernet.PrefixLength())
+}
+
+// Range returns the i-th range of the supernet.
+func (c *Config) Range(i uint32) Range {
+	first := c.Supernet.offset(i << uint(8*net.IPv4len-c.PrefixLength))
+	return NewRange(first, c.PrefixLength)
+}
+
+// Allocator assigns IP ranges to the ZeroTier networks. The ranges in use are stored in the system model, so the
+// allocator only keeps the ranges that have been allocated and not stored yet.
+type Allocator struct {
+	sync.Mutex
+	defaultConfig Config
+	// configuration of the organizations that do not use the default one
+	organizations map[string]Config
+	// allocated ranges pending to be stored, by organization
+	pending map[string][]Range
+	// CIDRs excluded in the clusters, by cluster
+	clusterExclusions map[string][]Range
+}
+
+// NewAllocator creates an allocator with a default configuration, the configuration of some organizations and the
+// CIDRs excluded in the clusters.
+func NewAllocator(defaultConfig Config, organizations map[string]Config, clusterExclusions map[string][]Range) *Allocator {
+	if organizations == nil {
+		organizations = make(map[string]Config, 0)
+	}
+	if clusterExclusions == nil {
+		clusterExclusions = make(map[string][]Range, 0)
+	}
+	return &Allocator{
+		defaultConfig:     defaultConfig,
+		organizations:     organizations,
+		pending:           make(map[string][]Range, 0),
+		clusterExclusions: clusterExclusions,
+	}
+}
+
+// ClusterExclusions returns the CIDRs excluded in the configuration of a set of clusters.
+func (a *Allocator) ClusterExclusions(clusterIds []string) []Range {
+	excluded := make([]Range, 0)
+	excluded = append(excluded, a.clusterExclusions[AllClusters]...)
+	for _, clusterId := range clusterIds {
+		excluded = append(excluded, a.clusterExclusions[clusterId]...)
+	}
+	return excluded
+}
+
+// Config returns the configuration of an organization.
+func (a *Allocator) Config(organizationId string) Config {
+	config, found := a.organizations[organizationId]
+	if !found {
+		return a.defaultConfig
+	}
+	return config
+}
+
+// ApplicationRange returns the range of the application networks of an organization.
+func (a *Allocator) ApplicationRange(organizationId string) Range {
+	config := a.Config(organizationId)
+	return config.Range(0)
+}
+
+// Allocate a range for a connection that does not overlap the given ranges, the excluded ones or any pending range.
+// The range must be released once it is stored in the system model or if it is not going to be used.
+//   params:
+//     organizationId The organization of the connection
+//     used The ranges in use that the new range cannot overlap
+//     excluded The ranges of the clusters of the connection that the new range cannot overlap
+//   returns:
+//     The allocated range.
+//     Error, if there is no free range.
+func (a *Allocator) Allocate(organizationId string, used []Range, excluded []Range) (*Range, derrors.Error) {
+	a.Lock()
+	defer a.Unlock()
+
+	config := a.Config(organizationId)
+	taken := make([]Range, 0, len(used)+len(a.pending[organizationId]))
+	taken = append(taken, used...)
+	taken = append(taken, a.pending[organizationId]...)
+	// number of ranges discarded only because of the excluded ranges
+	excludedHits := 0
+	for i := uint32(ReservedRanges); i < config.Size(); i++ {
+		candidate := config.Range(i)
+		if conflict := FindConflict(candidate, taken); conflict != nil {
+			continue
+		}
+		if conflict := FindConflict(candidate, excluded); conflict != nil {
+			excludedHits++
+			continue
+		}
+		a.pending[organizationId] = append(a.pending[organizationId], candidate)
+		log.Debug().Str("organizationId", organizationId).Str("range", candidate.String()).Msg("IP range allocated")
+		return &candidate, nil
+	}
+	if excludedHits > 0 {
+		excludedCIDRs := make([]string, len(excluded))
+		for i, r := range excluded {
+			excludedCIDRs[i] = r.String()
+		}
+		return nil, derrors.NewFailedPreconditionError("no free IP range that does not overlap the networks of the clusters").
+			WithParams(organizationId, config.Supernet.String(), config.PrefixLength, strings.Join(excludedCIDRs, ","))
+	}
+	return nil, derrors.NewFailedPreconditionError("free IP range not found").
+		WithParams(organizationId, config.Supernet.String(), config.PrefixLength)
+}
+
+// Reserve a given range for a connection if it does not overlap the given ranges, the excluded ones or any pending
+// range. As the allocated ranges, it must be released once it is stored in the system model or if it is not going to
+// be used.
+//   params:
+//     organizationId The organization of the connection
+//     r The range to be reserved
+//     used The ranges in use that the range cannot overlap
+//     excluded The ranges of the clusters of the connection that the range cannot overlap
+//   returns:
+//     Error, if the range overlaps any of them.
+func (a *Allocator) Reserve(organizationId string, r Range, used []Range, excluded []Range) derrors.Error {
+	a.Lock()
+	defer a.Unlock()
+
+	if conflict := FindConflict(r, used); conflict != nil {
+		return derrors.NewFailedPreconditionError("IP range overlaps a range in use").
+			WithParams(organizationId, r.String(), conflict.String())
+	}
+	if conflict := FindConflict(r, a.pending[organizationId]); conflict != nil {
+		return derrors.NewFailedPreconditionError("IP range overlaps a range being allocated").
+			WithParams(organizationId, r.String(), conflict.String())
+	}
+	if conflict := FindConflict(r, excluded); conflict != nil {
+		return derrors.NewFailedPreconditionError("IP range overlaps the networks of the clusters").
+			WithParams(organizationId, r.String(), conflict.String())
+	}
+	a.pending[organizationId] = append(a.pending[organizationId], r)
+	log.Debug().Str("organizationId", organizationId).Str("range", r.String()).Msg("IP range reserved")
+	return nil
+}
+
+// Release a range that is stored in the system model or that is not going to be used.
+func (a *Allocator) Release(organizationId string, released Range) {
+	a.Lock()
+	defer a.Unlock()
+
+	pending := a.pending[organizationId]
+	for i, r := range pending {
+		if r.String() == released.String() {
+			a.pending[organizationId] = append(pending[:i], pending[i+1:]...)
+			break
+		}
+	}
+	if len(a.pending[organizationId]) == 0 {
+		delete(a.pending, organizationId)
+	}
+}
+
+// IsPending checks if a range has been allocated and not released yet.
+func (a *Allocator) IsPending(organizationId string, r Range) bool {
+	a.Lock()
+	defer a.Unlock()
+	return FindConflict(r, a.pending[organizationId]) != nil
+}
+
+// FindConflict returns the first range that overlaps a given one, nil if there is none.
+func FindConflict(r Range, ranges []Range) *Range {
+	for _, other := range ranges {
+		if r.Overlaps(other) {
+			conflict := other
+			return &conflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ipam
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func mustParseRange(cidr string) Range {
+	r, err := ParseRange(cidr)
+	gomega.Expect(err).To(gomega.Succeed())
+	return *r
+}
+
+var _ = ginkgo.Describe("Allocator", func() {
+
+	var allocator *Allocator
+
+	ginkgo.BeforeEach(func() {
+		config, err := NewConfig(DefaultSupernet, DefaultPrefixLength)
+		gomega.Expect(err).To(gomega.Succeed())
+		allocator = NewAllocator(*config, nil, nil)
+	})
+
+	ginkgo.It("should reject invalid configurations", func() {
+		_, err := NewConfig("192.168.0.0/16", MaxPrefixLength+1)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = NewConfig("192.168.0.0/24", 25)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = NewConfig("fd00::/64", 24)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should reserve the first range for the application networks", func() {
+		applicationRange := allocator.ApplicationRange("org1")
+		gomega.Expect(applicationRange.String()).To(gomega.Equal("192.168.0.0/24"))
+		allocated, err := allocator.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocated.String()).To(gomega.Equal("192.168.3.0/24"))
+	})
+
+	ginkgo.It("should not allocate a range twice until it is released", func() {
+		first, err := allocator.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocator.IsPending("org1", *first)).To(gomega.BeTrue())
+		gomega.Expect(allocator.IsPending("org2", *first)).To(gomega.BeFalse())
+
+		second, err := allocator.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(second.String()).To(gomega.Equal("192.168.4.0/24"))
+
+		// once stored, the range is passed as used
+		allocator.Release("org1", *first)
+		gomega.Expect(allocator.IsPending("org1", *first)).To(gomega.BeFalse())
+		third, err := allocator.Allocate("org1", []Range{*first}, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(third.String()).To(gomega.Equal("192.168.5.0/24"))
+
+		// ranges of other organizations are independent
+		other, err := allocator.Allocate("org2", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(other.String()).To(gomega.Equal("192.168.3.0/24"))
+	})
+
+	ginkgo.It("should skip the used and excluded ranges", func() {
+		used := []Range{mustParseRange("192.168.3.0/24")}
+		excluded := []Range{mustParseRange("192.168.4.0/23")}
+		allocated, err := allocator.Allocate("org1", used, excluded)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocated.String()).To(gomega.Equal("192.168.6.0/24"))
+	})
+
+	ginkgo.It("should reserve a range that does not overlap the used, pending or excluded ranges", func() {
+		pending, err := allocator.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		used := []Range{mustParseRange("192.168.10.0/24")}
+		excluded := []Range{mustParseRange("192.168.20.0/23")}
+
+		gomega.Expect(allocator.Reserve("org1", mustParseRange("192.168.10.128/25"), used, excluded)).To(gomega.HaveOccurred())
+		gomega.Expect(allocator.Reserve("org1", *pending, used, excluded)).To(gomega.HaveOccurred())
+		gomega.Expect(allocator.Reserve("org1", mustParseRange("192.168.21.0/24"), used, excluded)).To(gomega.HaveOccurred())
+
+		reserved := mustParseRange("192.168.30.0/24")
+		gomega.Expect(allocator.Reserve("org1", reserved, used, excluded)).To(gomega.Succeed())
+		gomega.Expect(allocator.IsPending("org1", reserved)).To(gomega.BeTrue())
+		gomega.Expect(allocator.Reserve("org1", reserved, used, excluded)).To(gomega.HaveOccurred())
+		allocator.Release("org1", reserved)
+		gomega.Expect(allocator.Reserve("org1", reserved, used, excluded)).To(gomega.Succeed())
+	})
+
+	ginkgo.It("should fail when there is no free range", func() {
+		config, err := NewConfig("10.0.0.0/28", 30)
+		gomega.Expect(err).To(gomega.Succeed())
+		small := NewAllocator(*config, nil, nil)
+
+		_, err = small.Allocate("org1", nil, []Range{mustParseRange("10.0.0.0/28")})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+
+		allocated, err := small.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocated.String()).To(gomega.Equal("10.0.0.12/30"))
+		_, err = small.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should use the configuration of the organizations", func() {
+		configs, err := ParseOrganizationConfigs([]string{"org1=10.1.0.0/16:20"})
+		gomega.Expect(err).To(gomega.Succeed())
+		config, err := NewConfig(DefaultSupernet, DefaultPrefixLength)
+		gomega.Expect(err).To(gomega.Succeed())
+		allocator = NewAllocator(*config, configs, nil)
+
+		applicationRange := allocator.ApplicationRange("org1")
+		gomega.Expect(applicationRange.String()).To(gomega.Equal("10.1.0.0/20"))
+		allocated, err := allocator.Allocate("org1", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocated.String()).To(gomega.Equal("10.1.48.0/20"))
+		allocated, err = allocator.Allocate("org2", nil, nil)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(allocated.String()).To(gomega.Equal("192.168.3.0/24"))
+	})
+
+	ginkgo.It("should reject invalid organization configurations", func() {
+		for _, value := range []string{"10.1.0.0/16:24", "=10.1.0.0/16:24", "org1=10.1.0.0/16", "org1=10.1.0.0/16:x"} {
+			_, err := ParseOrganizationConfigs([]string{value})
+			gomega.Expect(err).To(gomega.HaveOccurred(), value)
+		}
+	})
+
+	ginkgo.It("should return the exclusions of the clusters", func() {
+		exclusions, err := ParseClusterExclusions([]string{"*=10.0.0.0/8", "cluster1=172.16.0.0/12"})
+		gomega.Expect(err).To(gomega.Succeed())
+		config, err := NewConfig(DefaultSupernet, DefaultPrefixLength)
+		gomega.Expect(err).To(gomega.Succeed())
+		allocator = NewAllocator(*config, nil, exclusions)
+
+		gomega.Expect(allocator.ClusterExclusions(nil)).To(gomega.Equal([]Range{mustParseRange("10.0.0.0/8")}))
+		gomega.Expect(allocator.ClusterExclusions([]string{"cluster1", "cluster2"})).To(gomega.Equal(
+			[]Range{mustParseRange("10.0.0.0/8"), mustParseRange("172.16.0.0/12")}))
+
+		_, err = ParseClusterExclusions([]string{"cluster1"})
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+})
@@ -0,0 +1,116 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ipam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/nalej/derrors"
+	"net"
+	"strings"
+)
+
+const (
+	// PoolSeparator separates the first and the last IP of a range in the system model (<first>-<last>)
+	PoolSeparator = "-"
+	// StackSeparator separates the IPv4 and IPv6 ranges of a dual-stack range in the system model
+	StackSeparator = ","
+)
+
+// Range with an IPv4 network assigned to a ZeroTier network.
+type Range struct {
+	net.IPNet
+}
+
+// NewRange creates the range of the network containing the given IP.
+func NewRange(ip net.IP, prefixLength int) Range {
+	mask := net.CIDRMask(prefixLength, 8*net.IPv4len)
+	return Range{net.IPNet{IP: ip.To4().Mask(mask), Mask: mask}}
+}
+
+// ParseRange parses a range in CIDR notation.
+func ParseRange(cidr string) (*Range, derrors.Error) {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return nil, derrors.NewInvalidArgumentError("incorrect IPv4 CIDR format").WithParams(cidr)
+	}
+	prefixLength, _ := network.Mask.Size()
+	result := NewRange(ip, prefixLength)
+	return &result, nil
+}
+
+// ParsePool parses a range stored in the system model (<first>-<last>). The IPv6 range of dual-stack ranges is
+// ignored. The result is the smallest network containing both IPs.
+func ParsePool(pool string) (*Range, derrors.Error) {
+	v4Pool := strings.Split(pool, StackSeparator)[0]
+	limits := strings.Split(v4Pool, PoolSeparator)
+	if len(limits) != 2 {
+		return nil, derrors.NewInvalidArgumentError("incorrect IP range format").WithParams(pool)
+	}
+	first := net.ParseIP(limits[0]).To4()
+	last := net.ParseIP(limits[1]).To4()
+	if first == nil || last == nil {
+		return nil, derrors.NewInvalidArgumentError("incorrect IP range format").WithParams(pool)
+	}
+	result := NewRange(first, 8*net.IPv4len)
+	for prefixLength := 8*net.IPv4len - 1; prefixLength >= 0 && !result.Contains(last); prefixLength-- {
+		result = NewRange(first, prefixLength)
+	}
+	return &result, nil
+}
+
+// PrefixLength returns the number of bits of the network prefix.
+func (r *Range) PrefixLength() int {
+	ones, _ := r.Mask.Size()
+	return ones
+}
+
+// Number returns the network number of the range, that is, the network address without the host bits.
+func (r *Range) Number() uint32 {
+	if r.PrefixLength() == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(r.IP.To4()) >> uint(8*net.IPv4len-r.PrefixLength())
+}
+
+// First returns the first assignable IP of the range.
+func (r *Range) First() net.IP {
+	return r.offset(1)
+}
+
+// Last returns the last assignable IP of the range.
+func (r *Range) Last() net.IP {
+	hosts := uint32(1)<<uint(8*net.IPv4len-r.PrefixLength()) - 1
+	return r.offset(hosts - 1)
+}
+
+// Pool returns the range in the format stored in the system model (<first>-<last>).
+func (r *Range) Pool() string {
+	return fmt.Sprintf("%s%s%s", r.First().String(), PoolSeparator, r.Last().String())
+}
+
+// Overlaps checks if two ranges share any IP.
+func (r *Range) Overlaps(other Range) bool {
+	return r.Contains(other.IP) || other.Contains(r.IP)
+}
+
+func (r *Range) offset(value uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(r.IP.To4())+value)
+	return ip
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package ipam
+
+import (
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+var _ = ginkgo.Describe("Range", func() {
+
+	ginkgo.It("should parse a CIDR", func() {
+		r, err := ParseRange("192.168.1.7/24")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(r.String()).To(gomega.Equal("192.168.1.0/24"))
+		gomega.Expect(r.PrefixLength()).To(gomega.Equal(24))
+		gomega.Expect(r.Number()).To(gomega.Equal(uint32(0xc0a801)))
+
+		_, err = ParseRange("192.168.1.0")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+		_, err = ParseRange("fd00::/64")
+		gomega.Expect(err).To(gomega.HaveOccurred())
+	})
+
+	ginkgo.It("should return the assignable IPs", func() {
+		r := mustParseRange("192.168.1.0/24")
+		gomega.Expect(r.First().String()).To(gomega.Equal("192.168.1.1"))
+		gomega.Expect(r.Last().String()).To(gomega.Equal("192.168.1.254"))
+		gomega.Expect(r.Pool()).To(gomega.Equal("192.168.1.1-192.168.1.254"))
+	})
+
+	ginkgo.It("should parse the pools of the system model", func() {
+		r, err := ParsePool("192.168.1.1-192.168.1.254")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(r.String()).To(gomega.Equal("192.168.1.0/24"))
+
+		r, err = ParsePool("10.0.0.1-10.0.3.254,fd6e:616c:656a:3::1-fd6e:616c:656a:3:ffff:ffff:ffff:fffe")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(r.String()).To(gomega.Equal("10.0.0.0/22"))
+
+		for _, pool := range []string{"192.168.1.1", "192.168.1.1-", "fd00::1-fd00::2"} {
+			_, err = ParsePool(pool)
+			gomega.Expect(err).To(gomega.HaveOccurred(), pool)
+		}
+	})
+
+	ginkgo.It("should detect overlapping ranges", func() {
+		r := mustParseRange("192.168.4.0/23")
+		gomega.Expect(r.Overlaps(mustParseRange("192.168.5.0/24"))).To(gomega.BeTrue())
+		gomega.Expect(r.Overlaps(mustParseRange("192.168.0.0/16"))).To(gomega.BeTrue())
+		gomega.Expect(r.Overlaps(mustParseRange("192.168.6.0/24"))).To(gomega.BeFalse())
+
+		conflict := FindConflict(r, []Range{mustParseRange("10.0.0.0/8"), mustParseRange("192.168.4.0/24")})
+		gomega.Expect(conflict).NotTo(gomega.BeNil())
+		gomega.Expect(conflict.String()).To(gomega.Equal("192.168.4.0/24"))
+		gomega.Expect(FindConflict(r, nil)).To(gomega.BeNil())
+	})
+})
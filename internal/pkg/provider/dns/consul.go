@@ -0,0 +1,131 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package dns
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/entities"
+)
+
+// ConsulProvider stores the DNS entries in Consul.
+type ConsulProvider struct {
+	client *consul.ConsulClient
+}
+
+// NewConsulProvider creates a provider that uses a Consul client.
+func NewConsulProvider(client *consul.ConsulClient) *ConsulProvider {
+	return &ConsulProvider{client: client}
+}
+
+func toConsulEntry(entry entities.DNSEntry) consul.Entry {
+	return consul.Entry{
+		OrganizationId: entry.OrganizationId,
+		AppInstanceId:  entry.AppInstanceId,
+		ServiceGroupId: entry.ServiceGroupId,
+		NetworkId:      entry.NetworkId,
+		ClusterId:      entry.ClusterId,
+		ServiceName:    entry.ServiceName,
+		Fqdn:           entry.Fqdn,
+		IP:             entry.Ip,
+		Port:           int(entry.Port),
+		Protocol:       entry.Protocol,
+		Type:           entry.Type,
+		Target:         entry.Target,
+		Tags:           entry.Tags,
+	}
+}
+
+func fromConsulEntries(entries []consul.Entry) []entities.DNSEntry {
+	result := make([]entities.DNSEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = entities.DNSEntry{
+			OrganizationId: entry.OrganizationId,
+			AppInstanceId:  entry.AppInstanceId,
+			ServiceGroupId: entry.ServiceGroupId,
+			NetworkId:      entry.NetworkId,
+			ClusterId:      entry.ClusterId,
+			ServiceName:    entry.ServiceName,
+			Fqdn:           entry.Fqdn,
+			Ip:             entry.IP,
+			Port:           int32(entry.Port),
+			Protocol:       entry.Protocol,
+			Type:           entry.Type,
+			Target:         entry.Target,
+			Tags:           entry.Tags,
+		}
+	}
+	return result
+}
+
+// Add a DNS entry of a service.
+func (p *ConsulProvider) Add(entry entities.DNSEntry) derrors.Error {
+	return p.client.Add(toConsulEntry(entry))
+}
+
+// Delete the DNS entries of a service of an organization using its service name or, if the entry has tags, every
+// entry of the organization with those tags.
+func (p *ConsulProvider) Delete(entry entities.DNSEntry) derrors.Error {
+	if len(entry.Tags) > 0 {
+		return p.client.DeleteByTags(entry.OrganizationId, entry.Tags)
+	}
+	return p.client.DeleteByServiceName(entry.OrganizationId, entry.ServiceName)
+}
+
+// DeleteEntriesByOwner deletes the DNS entries of an organization owned by an application instance.
+func (p *ConsulProvider) DeleteEntriesByOwner(organizationId string, appInstanceId string) derrors.Error {
+	return p.client.DeleteByOwner(organizationId, appInstanceId)
+}
+
+// List the DNS entries of an organization.
+func (p *ConsulProvider) List(organizationId string) ([]entities.DNSEntry, derrors.Error) {
+	entries, err := p.client.List(organizationId)
+	if err != nil {
+		return nil, err
+	}
+	return fromConsulEntries(entries), nil
+}
+
+// ListOrganizations lists the organizations with DNS entries.
+func (p *ConsulProvider) ListOrganizations() ([]string, derrors.Error) {
+	return p.client.ListOrganizations()
+}
+
+// AddGeneric adds a generic DNS entry.
+func (p *ConsulProvider) AddGeneric(entry entities.DNSEntry) derrors.Error {
+	return p.client.Add(toConsulEntry(entry))
+}
+
+// ListGeneric lists a page of the DNS entries of an organization sorted by FQDN.
+func (p *ConsulProvider) ListGeneric(organizationId string, after string, limit int) ([]entities.DNSEntry, string, derrors.Error) {
+	entries, next, err := p.client.ListPage(organizationId, after, limit)
+	if err != nil {
+		return nil, "", err
+	}
+	return fromConsulEntries(entries), next, nil
+}
+
+// DeleteGeneric deletes the DNS entry of an organization with the given FQDN.
+func (p *ConsulProvider) DeleteGeneric(organizationId string, fqdn string) derrors.Error {
+	return p.client.Delete(organizationId, fqdn)
+}
+
+// DeleteClusterEntry deletes the DNS entry of an organization with the given FQDN in a cluster.
+func (p *ConsulProvider) DeleteClusterEntry(organizationId string, fqdn string, clusterId string) derrors.Error {
+	return p.client.DeleteFromCluster(organizationId, fqdn, clusterId)
+}
@@ -18,14 +18,18 @@
 package dns
 
 import (
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/network-manager/internal/pkg/entities"
+	"sort"
+	"strings"
 	"sync"
 )
 
+// MockupDNSEntryProvider stores the DNS entries in memory.
 type MockupDNSEntryProvider struct {
 	sync.Mutex
-	// DNS entries indexed by cluster identifier.
+	// DNS entries indexed by organization, FQDN and cluster.
 	entries map[string]entities.DNSEntry
 }
 
@@ -35,9 +39,8 @@ func NewMockupDNSEntryProvider() *MockupDNSEntryProvider {
 	}
 }
 
-func (m *MockupDNSEntryProvider) unsafeExists(FQDN string) bool {
-	_, exists := m.entries[FQDN]
-	return exists
+func entryKey(organizationId string, fqdn string, clusterId string) string {
+	return fmt.Sprintf("%s-%s#%s", organizationId, fqdn, clusterId)
 }
 
 // Clear cleans the contents of the mockup.
@@ -47,34 +50,181 @@ func (m *MockupDNSEntryProvider) Clear() {
 	m.Unlock()
 }
 
-// List all DNS entries from a network
-func (m *MockupDNSEntryProvider) List(networkID string) derrors.Error {
+// Add a DNS entry of a service, replacing any entry of the organization with the same FQDN in the same cluster.
+func (m *MockupDNSEntryProvider) Add(entry entities.DNSEntry) derrors.Error {
 	m.Lock()
 	defer m.Unlock()
-	if !m.unsafeExists(networkID) {
-		return derrors.NewNotFoundError(networkID)
-	}
+	m.entries[entryKey(entry.OrganizationId, entry.Fqdn, entry.ClusterId)] = entry
 	return nil
 }
 
-// Add a new DNS Entry to the system.
-func (m *MockupDNSEntryProvider) Add(entry entities.DNSEntry) derrors.Error {
+// Delete the DNS entries of a service of an organization using its service name or, if the entry has tags, every
+// entry of the organization with those tags. Entries without service name are deleted if their FQDN matches it.
+func (m *MockupDNSEntryProvider) Delete(entry entities.DNSEntry) derrors.Error {
+	m.deleteMatching(entry.OrganizationId, func(stored entities.DNSEntry) bool {
+		if len(entry.Tags) > 0 {
+			return hasTags(stored, entry.Tags)
+		}
+		return stored.ServiceName == entry.ServiceName || (stored.ServiceName == "" && stored.Fqdn == entry.ServiceName)
+	})
+	return nil
+}
+
+// DeleteEntriesByOwner deletes the DNS entries of an organization owned by an application instance.
+func (m *MockupDNSEntryProvider) DeleteEntriesByOwner(organizationId string, appInstanceId string) derrors.Error {
+	m.deleteMatching(organizationId, func(stored entities.DNSEntry) bool {
+		return stored.AppInstanceId == appInstanceId
+	})
+	return nil
+}
+
+// deleteMatching deletes the DNS entries of an organization that match a condition, and the aliases that lead to
+// them.
+func (m *MockupDNSEntryProvider) deleteMatching(organizationId string, matches func(stored entities.DNSEntry) bool) {
 	m.Lock()
 	defer m.Unlock()
-	if !m.unsafeExists(entry.Fqdn) {
-		m.entries[entry.Fqdn] = entry
-		return nil
+	deleted := make([]string, 0)
+	for key, stored := range m.entries {
+		if stored.OrganizationId == organizationId && matches(stored) {
+			delete(m.entries, key)
+			deleted = append(deleted, stored.Fqdn)
+		}
+	}
+	m.deleteAliasesOf(organizationId, m.withoutEntries(organizationId, deleted))
+}
+
+// withoutEntries returns the FQDNs of an organization that have no entries left in any cluster. The caller holds
+// the lock.
+func (m *MockupDNSEntryProvider) withoutEntries(organizationId string, fqdns []string) []string {
+	remaining := make(map[string]bool, 0)
+	for _, stored := range m.entries {
+		if stored.OrganizationId == organizationId {
+			remaining[stored.Fqdn] = true
+		}
+	}
+	gone := make([]string, 0, len(fqdns))
+	for _, fqdn := range fqdns {
+		if !remaining[fqdn] {
+			gone = append(gone, fqdn)
+		}
+	}
+	return gone
+}
+
+// deleteAliasesOf deletes the aliases of an organization whose chain leads to one of the deleted entries. The caller
+// holds the lock.
+func (m *MockupDNSEntryProvider) deleteAliasesOf(organizationId string, deleted []string) {
+	gone := make(map[string]bool, len(deleted))
+	for _, fqdn := range deleted {
+		gone[aliasName(fqdn)] = true
+	}
+	for removed := true; removed; {
+		removed = false
+		for key, stored := range m.entries {
+			if stored.OrganizationId == organizationId && stored.IsAlias() && gone[aliasName(stored.Target)] {
+				delete(m.entries, key)
+				gone[aliasName(stored.Fqdn)] = true
+				removed = true
+			}
+		}
+	}
+}
+
+// aliasName returns the name used to compare the FQDNs of the aliases and their targets.
+func aliasName(fqdn string) string {
+	return strings.TrimSuffix(strings.ToLower(fqdn), ".")
+}
+
+func hasTags(entry entities.DNSEntry, tags []string) bool {
+	available := make(map[string]bool, len(entry.Tags))
+	for _, tag := range entry.Tags {
+		available[tag] = true
+	}
+	for _, toFind := range tags {
+		if !available[toFind] {
+			return false
+		}
 	}
-	return derrors.NewAlreadyExistsError(entry.Fqdn)
+	return true
+}
+
+// List the DNS entries of an organization sorted by FQDN.
+func (m *MockupDNSEntryProvider) List(organizationId string) ([]entities.DNSEntry, derrors.Error) {
+	entries, _, err := m.ListGeneric(organizationId, "", 0)
+	return entries, err
+}
+
+// ListOrganizations lists the organizations with DNS entries sorted by identifier.
+func (m *MockupDNSEntryProvider) ListOrganizations() ([]string, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	found := make(map[string]bool, 0)
+	result := make([]string, 0)
+	for _, entry := range m.entries {
+		if !found[entry.OrganizationId] {
+			found[entry.OrganizationId] = true
+			result = append(result, entry.OrganizationId)
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// AddGeneric adds a generic DNS entry, replacing any entry of the organization with the same FQDN in the same
+// cluster.
+func (m *MockupDNSEntryProvider) AddGeneric(entry entities.DNSEntry) derrors.Error {
+	return m.Add(entry)
+}
+
+// ListGeneric lists a page of the DNS entries of an organization sorted by FQDN.
+func (m *MockupDNSEntryProvider) ListGeneric(organizationId string, after string, limit int) ([]entities.DNSEntry, string, derrors.Error) {
+	m.Lock()
+	defer m.Unlock()
+	result := make([]entities.DNSEntry, 0)
+	for _, entry := range m.entries {
+		if entry.OrganizationId != organizationId || (after != "" && entry.Fqdn <= after) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Fqdn < result[j].Fqdn })
+	next := ""
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+		next = result[limit-1].Fqdn
+	}
+	return result, next, nil
+}
+
+// DeleteGeneric deletes the DNS entries of an organization with the given FQDN in every cluster, and the aliases that
+// lead to them.
+func (m *MockupDNSEntryProvider) DeleteGeneric(organizationId string, fqdn string) derrors.Error {
+	m.Lock()
+	defer m.Unlock()
+	found := false
+	for key, stored := range m.entries {
+		if stored.OrganizationId == organizationId && stored.Fqdn == fqdn {
+			delete(m.entries, key)
+			found = true
+		}
+	}
+	if !found {
+		return derrors.NewNotFoundError("DNS entry not found").WithParams(organizationId, fqdn)
+	}
+	m.deleteAliasesOf(organizationId, []string{fqdn})
+	return nil
 }
 
-// Delete a DNS Entry
-func (m *MockupDNSEntryProvider) Delete(FQDN string) derrors.Error {
+// DeleteClusterEntry deletes the DNS entry of an organization with the given FQDN in a cluster. The aliases that lead
+// to the FQDN are deleted once it has no entries in any cluster.
+func (m *MockupDNSEntryProvider) DeleteClusterEntry(organizationId string, fqdn string, clusterId string) derrors.Error {
 	m.Lock()
 	defer m.Unlock()
-	if !m.unsafeExists(FQDN) {
-		return derrors.NewNotFoundError(FQDN)
+	key := entryKey(organizationId, fqdn, clusterId)
+	if _, exists := m.entries[key]; !exists {
+		return derrors.NewNotFoundError("DNS entry not found").WithParams(organizationId, fqdn, clusterId)
 	}
-	delete(m.entries, FQDN)
+	delete(m.entries, key)
+	m.deleteAliasesOf(organizationId, m.withoutEntries(organizationId, []string{fqdn}))
 	return nil
 }
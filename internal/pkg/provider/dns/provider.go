@@ -22,11 +22,39 @@ import (
 	"github.com/nalej/network-manager/internal/pkg/entities"
 )
 
+// Backends of the DNS provider
+const (
+	// ConsulBackend stores the entries in a Consul catalog
+	ConsulBackend = "consul"
+	// MemoryBackend stores the entries in memory, for local development and testing
+	MemoryBackend = "memory"
+)
+
+// Provider stores the DNS entries of the organizations. An entry is identified by its organization, FQDN and cluster,
+// if any, so a FQDN has an entry per cluster where it is registered. The
+// entries of the services are added and deleted by the DNS service, and the generic entries by the ServiceDNS
+// service, but both share the same storage. Deleting an entry deletes the aliases whose chain leads to it.
 type Provider interface {
-	//List DNS entries on the system
-	List(dns entities.DNSEntry) derrors.Error
-	//Add DNS entry to the system
-	Add(dns entities.DNSEntry) derrors.Error
-	//Delete DNS entry from the system
-	Delete(dns entities.DNSEntry) derrors.Error
+	// Add a DNS entry of a service to the system
+	Add(entry entities.DNSEntry) derrors.Error
+	// Delete the DNS entries of a service of an organization using its service name or, if the entry has tags,
+	// every entry of the organization with those tags
+	Delete(entry entities.DNSEntry) derrors.Error
+	// DeleteEntriesByOwner deletes the DNS entries of an organization owned by an application instance
+	DeleteEntriesByOwner(organizationId string, appInstanceId string) derrors.Error
+	// List the DNS entries of an organization
+	List(organizationId string) ([]entities.DNSEntry, derrors.Error)
+	// ListOrganizations lists the organizations with DNS entries
+	ListOrganizations() ([]string, derrors.Error)
+	// AddGeneric adds a generic DNS entry to the system
+	AddGeneric(entry entities.DNSEntry) derrors.Error
+	// ListGeneric lists a page of the DNS entries of an organization sorted by FQDN. The page starts after the
+	// given FQDN and has at most limit entries (0 for all). The FQDN of the last entry is returned if there are more
+	// entries.
+	ListGeneric(organizationId string, after string, limit int) ([]entities.DNSEntry, string, derrors.Error)
+	// DeleteGeneric deletes the DNS entries of an organization with the given FQDN in every cluster
+	DeleteGeneric(organizationId string, fqdn string) derrors.Error
+	// DeleteClusterEntry deletes the DNS entry of an organization with the given FQDN in a cluster, keeping the
+	// entries of the FQDN in the other clusters
+	DeleteClusterEntry(organizationId string, fqdn string, clusterId string) derrors.Error
 }
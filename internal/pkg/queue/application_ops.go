@@ -0,0 +1,83 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package queue
+
+import (
+	"context"
+	"github.com/nalej/nalej-bus/pkg/queue/application/ops"
+	"github.com/nalej/network-manager/internal/pkg/server/dns"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+const ApplicationOpsTimeout = time.Minute * 60
+
+type AppOpsHandler struct {
+	// DNS manager
+	dnsManager *dns.Manager
+	// operations consumer
+	consumer *ops.ApplicationOpsConsumer
+}
+
+func NewAppOpsHandler(dnsManager *dns.Manager, consumer *ops.ApplicationOpsConsumer) AppOpsHandler {
+	return AppOpsHandler{dnsManager: dnsManager, consumer: consumer}
+}
+
+func (a AppOpsHandler) Run() {
+	go a.consumeUndeployRequest()
+	go a.waitRequests()
+}
+
+// waitRequests Endless loop waiting for requests
+func (a AppOpsHandler) waitRequests() {
+	log.Debug().Msg("wait for requests to be received by the application ops queue")
+	for {
+		somethingReceived := false
+		ctx, cancel := context.WithTimeout(context.Background(), ApplicationOpsTimeout)
+		currentTime := time.Now()
+		err := a.consumer.Consume(ctx)
+		somethingReceived = true
+		cancel()
+		select {
+		case <-ctx.Done():
+			// the timeout was reached
+			if !somethingReceived {
+				log.Debug().Str("since", currentTime.Format(time.RFC3339)).Msgf("no message received")
+			}
+		default:
+			if err != nil {
+				log.Error().Err(err).Msg("error consuming data from application ops")
+			}
+		}
+	}
+}
+
+// consumeUndeployRequest deletes the DNS entries of the undeployed application instances, so their names do not
+// outlive them.
+func (a AppOpsHandler) consumeUndeployRequest() {
+	log.Debug().Msg("waiting for undeploy requests...")
+	for {
+		received := <-a.consumer.Config.ChUndeployRequest
+		log.Debug().Interface("undeployRequest", received).Msg("<- incoming undeploy request")
+		err := a.dnsManager.DeleteEntriesByOwner(received.OrganizationId, received.AppInstanceId)
+		if err != nil {
+			log.Error().Str("trace", err.DebugReport()).Str("appInstanceId", received.AppInstanceId).
+				Msg("failed deleting the DNS entries of the undeployed application instance")
+		}
+	}
+}
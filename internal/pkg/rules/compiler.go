@@ -0,0 +1,182 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rules
+
+import (
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/network-manager/internal/pkg/utils"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/rs/zerolog/log"
+	"sort"
+)
+
+const (
+	// ServiceTagId identifies the tag with the service a member belongs to. Service proxies
+	// carry the tag of the service they expose.
+	ServiceTagId uint32 = 1000
+	// ServiceTagDefault is the value of the service tag for members without service, or whose service
+	// is not referenced by any rule
+	ServiceTagDefault uint32 = 0
+	// SideTagId identifies the tag with the side of a connection a member belongs to.
+	SideTagId uint32 = 1001
+	// SideTagOutbound is the value of the side tag for the members of the outbound side
+	SideTagOutbound uint32 = 0
+	// SideTagInbound is the value of the side tag for the members of the inbound side
+	SideTagInbound uint32 = 1
+)
+
+// ServiceTags allocates a value of the service tag to each service referenced by the security rules of an
+// application instance. The values are assigned in the order of the service names, so they are the same every
+// time they are computed for the instance and no two services share a value.
+func ServiceTags(appInstance *grpc_application_go.AppInstance) map[string]zt.MemberTag {
+	names := make(map[string]bool, 0)
+	for _, rule := range appInstance.Rules {
+		if rule.Access != grpc_application_go.PortAccess_ALL_APP_SERVICES &&
+			rule.Access != grpc_application_go.PortAccess_APP_SERVICES {
+			continue
+		}
+		names[utils.FormatName(rule.TargetServiceName)] = true
+		for _, authService := range rule.AuthServices {
+			names[utils.FormatName(authService)] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	tags := make(map[string]zt.MemberTag, len(sorted))
+	for i, name := range sorted {
+		tags[name] = zt.MemberTag{Id: ServiceTagId, Value: ServiceTagDefault + uint32(i) + 1}
+	}
+	return tags
+}
+
+// ServiceTag returns the tag to be assigned to the members of a service of an application instance. The
+// services that are not referenced by any rule get the default value.
+func ServiceTag(appInstance *grpc_application_go.AppInstance, serviceName string) zt.MemberTag {
+	tag, found := ServiceTags(appInstance)[utils.FormatName(serviceName)]
+	if !found {
+		return zt.MemberTag{Id: ServiceTagId, Value: ServiceTagDefault}
+	}
+	return tag
+}
+
+// SideTag returns the tag to be assigned to the members of a side of a connection.
+func SideTag(inbound bool) zt.MemberTag {
+	if inbound {
+		return zt.MemberTag{Id: SideTagId, Value: SideTagInbound}
+	}
+	return zt.MemberTag{Id: SideTagId, Value: SideTagOutbound}
+}
+
+// CompileApplicationRules compiles the security rules of an application instance into the rules
+// of its ZeroTier network. Only the ports declared by ALL_APP_SERVICES and APP_SERVICES rules are
+// reachable, and the latter only by the members tagged with one of the authorized services.
+func CompileApplicationRules(appInstance *grpc_application_go.AppInstance) *zt.RuleSet {
+	tags := ServiceTags(appInstance)
+	rules := baseRules()
+	for _, rule := range appInstance.Rules {
+		if rule.Access != grpc_application_go.PortAccess_ALL_APP_SERVICES &&
+			rule.Access != grpc_application_go.PortAccess_APP_SERVICES {
+			continue
+		}
+		if rule.TargetPort <= 0 {
+			log.Warn().Str("ruleId", rule.RuleId).Str("targetService", rule.TargetServiceName).
+				Msg("security rule without target port ignored")
+			continue
+		}
+		senders := make([]zt.MemberTag, 0)
+		if rule.Access == grpc_application_go.PortAccess_APP_SERVICES {
+			for _, authService := range rule.AuthServices {
+				senders = append(senders, tags[utils.FormatName(authService)])
+			}
+			if len(senders) == 0 {
+				// nobody is allowed to access this port
+				continue
+			}
+		}
+		target := tags[utils.FormatName(rule.TargetServiceName)]
+		rules = append(rules, portRules(int(rule.TargetPort), senders, target)...)
+	}
+	rules = append(rules, zt.DropRule())
+
+	log.Debug().Str("appInstanceId", appInstance.AppInstanceId).Int("rules", len(rules)).Msg("application rules compiled")
+	return &zt.RuleSet{
+		Rules: rules,
+		Tags:  []zt.Tag{{Id: ServiceTagId, Default: ServiceTagDefault}},
+	}
+}
+
+// CompileConnectionRules compiles the rules of the ZeroTier network of a connection. Only the port of the
+// target service of the inbound is reachable, and only on the members of the inbound side. If the inbound
+// has no port, no rules are returned and all the traffic is accepted.
+func CompileConnectionRules(targetInstance *grpc_application_go.AppInstance, inboundName string) *zt.RuleSet {
+	for _, rule := range targetInstance.Rules {
+		if rule.Access == grpc_application_go.PortAccess_INBOUND_APPNET && rule.InboundNetInterface == inboundName {
+			if rule.TargetPort <= 0 {
+				break
+			}
+			rules := baseRules()
+			rules = append(rules, portRules(int(rule.TargetPort), nil, SideTag(true))...)
+			rules = append(rules, zt.DropRule())
+			return &zt.RuleSet{
+				Rules: rules,
+				Tags:  []zt.Tag{{Id: SideTagId, Default: SideTagOutbound}},
+			}
+		}
+	}
+	log.Warn().Str("appInstanceId", targetInstance.AppInstanceId).Str("inbound", inboundName).
+		Msg("no port found for the inbound, the connection network accepts all the traffic")
+	return nil
+}
+
+// baseRules drops any non IP traffic and accepts ARP and ICMP.
+func baseRules() []zt.Rule {
+	return []zt.Rule{
+		zt.MatchEtherType(zt.EtherTypeIPv4, true, false),
+		zt.MatchEtherType(zt.EtherTypeARP, true, false),
+		zt.MatchEtherType(zt.EtherTypeIPv6, true, false),
+		zt.DropRule(),
+		zt.MatchEtherType(zt.EtherTypeARP, false, false),
+		zt.AcceptRule(),
+		zt.MatchIpProtocol(zt.IpProtocolICMP, false, false),
+		zt.MatchIpProtocol(zt.IpProtocolICMPv6, false, true),
+		zt.AcceptRule(),
+	}
+}
+
+// portRules accepts TCP and UDP traffic to a port of the members with the receiver tag, and the answers
+// from that port of those members. If senders are set, only members with one of those tags can reach the port.
+func portRules(port int, senders []zt.MemberTag, receiver zt.MemberTag) []zt.Rule {
+	rules := make([]zt.Rule, 0)
+	for _, protocol := range []int{zt.IpProtocolTCP, zt.IpProtocolUDP} {
+		// requests: the tag matches go first so the ORed senders are evaluated before the AND chain
+		for i, sender := range senders {
+			rules = append(rules, zt.MatchTagSender(sender, i > 0))
+		}
+		rules = append(rules, zt.MatchTagReceiver(receiver, false))
+		rules = append(rules, zt.MatchIpProtocol(protocol, false, false), zt.MatchIpDestPortRange(port, port), zt.AcceptRule())
+
+		// answers, only from the members exposing the port so no other member can bypass the rules by
+		// sending from that port
+		rules = append(rules, zt.MatchTagSender(receiver, false))
+		rules = append(rules, zt.MatchIpProtocol(protocol, false, false), zt.MatchIpSourcePortRange(port, port), zt.AcceptRule())
+	}
+	return rules
+}
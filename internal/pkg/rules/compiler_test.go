@@ -0,0 +1,123 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package rules
+
+import (
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+// destPorts returns the destination ports accepted by the rules.
+func destPorts(rules []zt.Rule) []int {
+	ports := make([]int, 0)
+	for _, rule := range rules {
+		if rule.Type == zt.RuleMatchIpDestPortRange {
+			ports = append(ports, *rule.Start)
+		}
+	}
+	return ports
+}
+
+// senderValues returns the values of the sender tags matched by the rules.
+func senderValues(rules []zt.Rule) []uint32 {
+	values := make([]uint32, 0)
+	for _, rule := range rules {
+		if rule.Type == zt.RuleMatchTagSender {
+			values = append(values, *rule.Value)
+		}
+	}
+	return values
+}
+
+// receiverValues returns the values of the receiver tags matched by the rules.
+func receiverValues(rules []zt.Rule) []uint32 {
+	values := make([]uint32, 0)
+	for _, rule := range rules {
+		if rule.Type == zt.RuleMatchTagReceiver {
+			values = append(values, *rule.Value)
+		}
+	}
+	return values
+}
+
+var _ = ginkgo.Describe("Rules compiler", func() {
+
+	appInstance := &grpc_application_go.AppInstance{
+		AppInstanceId: "app1",
+		Rules: []*grpc_application_go.SecurityRule{
+			{RuleId: "r1", TargetServiceName: "Web", TargetPort: 80, Access: grpc_application_go.PortAccess_ALL_APP_SERVICES},
+			{RuleId: "r2", TargetServiceName: "db", TargetPort: 5432, Access: grpc_application_go.PortAccess_APP_SERVICES,
+				AuthServices: []string{"web", "backup"}},
+			// ignored rules
+			{RuleId: "r3", TargetServiceName: "db", TargetPort: 22, Access: grpc_application_go.PortAccess_APP_SERVICES},
+			{RuleId: "r4", TargetServiceName: "web", Access: grpc_application_go.PortAccess_ALL_APP_SERVICES},
+			{RuleId: "r5", TargetServiceName: "public", TargetPort: 443, Access: grpc_application_go.PortAccess_PUBLIC},
+		},
+	}
+
+	ginkgo.It("should assign a different tag to each service of the rules", func() {
+		tags := ServiceTags(appInstance)
+		gomega.Expect(tags).To(gomega.HaveLen(3))
+		gomega.Expect(tags["backup"]).To(gomega.Equal(zt.MemberTag{Id: ServiceTagId, Value: 1}))
+		gomega.Expect(tags["db"]).To(gomega.Equal(zt.MemberTag{Id: ServiceTagId, Value: 2}))
+		gomega.Expect(tags["web"]).To(gomega.Equal(zt.MemberTag{Id: ServiceTagId, Value: 3}))
+		gomega.Expect(ServiceTag(appInstance, "WEB")).To(gomega.Equal(tags["web"]))
+		// services without rules are not distinguished
+		gomega.Expect(ServiceTag(appInstance, "public").Value).To(gomega.Equal(ServiceTagDefault))
+		gomega.Expect(ServiceTag(appInstance, "other").Value).To(gomega.Equal(ServiceTagDefault))
+	})
+
+	ginkgo.It("should only accept the ports of the application rules", func() {
+		ruleSet := CompileApplicationRules(appInstance)
+		gomega.Expect(ruleSet.Tags).To(gomega.Equal([]zt.Tag{{Id: ServiceTagId, Default: ServiceTagDefault}}))
+		// a rule for TCP and another one for UDP
+		gomega.Expect(destPorts(ruleSet.Rules)).To(gomega.Equal([]int{80, 80, 5432, 5432}))
+		gomega.Expect(ruleSet.Rules[len(ruleSet.Rules)-1]).To(gomega.Equal(zt.DropRule()))
+		// only the authorized services reach the database, and only the members of the target services answer
+		backup, db, web := uint32(1), uint32(2), uint32(3)
+		gomega.Expect(receiverValues(ruleSet.Rules)).To(gomega.Equal([]uint32{web, web, db, db}))
+		gomega.Expect(senderValues(ruleSet.Rules)).To(gomega.Equal([]uint32{web, web, web, backup, db, web, backup, db}))
+	})
+
+	ginkgo.It("should drop all the IP traffic of an application without rules", func() {
+		ruleSet := CompileApplicationRules(&grpc_application_go.AppInstance{AppInstanceId: "app1"})
+		gomega.Expect(destPorts(ruleSet.Rules)).To(gomega.BeEmpty())
+		gomega.Expect(ruleSet.Rules[len(ruleSet.Rules)-1]).To(gomega.Equal(zt.DropRule()))
+	})
+
+	ginkgo.It("should only accept the port of the inbound of a connection on its inbound side", func() {
+		targetInstance := &grpc_application_go.AppInstance{
+			AppInstanceId: "app1",
+			Rules: []*grpc_application_go.SecurityRule{
+				{RuleId: "r1", TargetPort: 8080, Access: grpc_application_go.PortAccess_INBOUND_APPNET, InboundNetInterface: "in1"},
+				{RuleId: "r2", TargetPort: 9090, Access: grpc_application_go.PortAccess_INBOUND_APPNET, InboundNetInterface: "in2"},
+			},
+		}
+		ruleSet := CompileConnectionRules(targetInstance, "in2")
+		gomega.Expect(ruleSet).NotTo(gomega.BeNil())
+		gomega.Expect(ruleSet.Tags).To(gomega.Equal([]zt.Tag{{Id: SideTagId, Default: SideTagOutbound}}))
+		gomega.Expect(destPorts(ruleSet.Rules)).To(gomega.Equal([]int{9090, 9090}))
+		// the answers from the port are only accepted from the inbound side
+		gomega.Expect(receiverValues(ruleSet.Rules)).To(gomega.Equal([]uint32{SideTagInbound, SideTagInbound}))
+		gomega.Expect(senderValues(ruleSet.Rules)).To(gomega.Equal([]uint32{SideTagInbound, SideTagInbound}))
+
+		gomega.Expect(CompileConnectionRules(targetInstance, "in3")).To(gomega.BeNil())
+	})
+})
@@ -30,12 +30,13 @@ import (
 	"github.com/nalej/grpc-network-go"
 	"github.com/nalej/grpc-organization-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/rules"
+	"github.com/nalej/network-manager/internal/pkg/server/dns"
 	"github.com/nalej/network-manager/internal/pkg/utils"
 	"github.com/nalej/network-manager/internal/pkg/zt"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
-	"strconv"
-	"strings"
 	"time"
 )
 
@@ -44,8 +45,6 @@ const (
 	// Number of retries to be done when updating routes
 	ApplicationManagerUpdateRetries = 5
 	ApplicationManagerJoinTimeout   = time.Second * 20
-	ztInitialRange                  = 3
-	ztFinalRange                    = 255
 )
 
 type Manager struct {
@@ -56,9 +55,14 @@ type Manager struct {
 	connHelper   *utils.ConnectionsHelper
 	appNetClient grpc_application_network_go.ApplicationNetworkClient
 	ZTClient     *zt.ZTClient
+	// allocator of the IP ranges of the connections
+	allocator *ipam.Allocator
+	// DNS manager of the records of the overlay IPs, nil if they are not managed
+	dnsManager *dns.Manager
 }
 
-func NewManager(conn *grpc.ClientConn, connHelper *utils.ConnectionsHelper, ztClient *zt.ZTClient) (*Manager, error) {
+func NewManager(conn *grpc.ClientConn, connHelper *utils.ConnectionsHelper, ztClient *zt.ZTClient, allocator *ipam.Allocator,
+	dnsManager *dns.Manager) (*Manager, error) {
 	clusterInfrastructure := grpc_infrastructure_go.NewClustersClient(conn)
 	applicationClient := grpc_application_go.NewApplicationsClient(conn)
 	appNetClient := grpc_application_network_go.NewApplicationNetworkClient(conn)
@@ -69,6 +73,8 @@ func NewManager(conn *grpc.ClientConn, connHelper *utils.ConnectionsHelper, ztCl
 		connHelper:            connHelper,
 		appNetClient:          appNetClient,
 		ZTClient:              ztClient,
+		allocator:             allocator,
+		dnsManager:            dnsManager,
 	}, nil
 }
 
@@ -92,6 +98,8 @@ func (m *Manager) RegisterInboundServiceProxy(request *grpc_network_go.InboundSe
 		return derrors.NewInternalError("impossible to add network proxy", err)
 	}
 
+	m.addProxyReverseEntry(request)
+
 	// Inform pods about new available entities
 	var updateErr error = nil
 	for i := 0; i < ApplicationManagerUpdateRetries; i++ {
@@ -428,8 +436,10 @@ func (m *Manager) getServicesIAccess(appInstance *grpc_application_go.AppInstanc
 	return allowedServices
 }
 
-// getRangeIp returns the IP range that is going to be used in the new ZT network (rangeMin, rangeMax)
-func (m *Manager) getRangeIp(organizationID string, sourceId string, targetId string) (string, string, derrors.Error) {
+// getRangeIp allocates the IP range that is going to be used in the new ZT network. The range does not overlap
+// the ranges of the other connections of the instances nor the networks of the clusters where the services of the
+// connection are deployed. It must be released once it is stored.
+func (m *Manager) getRangeIp(organizationID string, sourceId string, targetId string, clusterIds []string) (*ipam.Range, derrors.Error) {
 	log.Debug().Str("organizationID", organizationID).Str("sourceId", sourceId).Str("targetId", targetId).Msg("getRangeIp")
 	// get the ipRange for the new ztNetwork
 	ctxList, cancelList := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
@@ -439,41 +449,32 @@ func (m *Manager) getRangeIp(organizationID string, sourceId string, targetId st
 	})
 	if err != nil {
 		log.Error().Err(err).Str("trace", conversions.ToDerror(err).DebugReport()).Msg("error getting connections")
-		return "", "", conversions.ToDerror(err)
+		return nil, conversions.ToDerror(err)
 	}
 
-	ips := make([]bool, 256)
-	// range retrieved x.x.x.x x.x.x.x (192.168.x.1 192.168.x.254)
+	// the application networks are shared by all the instances
+	used := []ipam.Range{m.allocator.ApplicationRange(organizationID)}
 	for _, conn := range lis.Connections {
 		if conn.SourceInstanceId == sourceId || conn.SourceInstanceId == targetId ||
 			conn.TargetInstanceId == sourceId || conn.TargetInstanceId == targetId {
 			if conn.IpRange != "" {
-				tokens := strings.Split(conn.IpRange, ".") // [x, x, X, x x, x, x, x]
-				if len(tokens) != 7 {
+				connRange, rErr := ipam.ParsePool(conn.IpRange)
+				if rErr != nil {
 					log.Error().Str("range", conn.IpRange).Msg("incorrect IP range format")
-					return "", "", derrors.NewInternalError("incorrect IP range format").WithParams(conn.IpRange)
-				}
-				value, convErr := strconv.Atoi(tokens[2])
-				if convErr != nil {
-					log.Error().Str("range", conn.IpRange).Msg("error converting ip range to int")
-					return "", "", derrors.NewInternalError("incorrect IP range format").WithParams(conn.IpRange)
-				} else {
-					ips[value] = true
+					return nil, derrors.NewInternalError("incorrect IP range format", rErr).WithParams(conn.IpRange)
 				}
+				used = append(used, *connRange)
 			}
-
 		}
 	}
 
-	for i := ztInitialRange; i < ztFinalRange; i++ {
-		if !ips[i] {
-			rangeMin := fmt.Sprintf("192.168.%d.1", i)
-			rangeMax := fmt.Sprintf("192.168.%d.254", i)
-			return rangeMin, rangeMax, nil
-		}
+	excluded := m.connHelper.ExcludedRanges(organizationID, clusterIds, m.allocator, m.clusterInfrastructure)
+	ipRange, aErr := m.allocator.Allocate(organizationID, used, excluded)
+	if aErr != nil {
+		log.Error().Str("trace", aErr.DebugReport()).Strs("clusterIds", clusterIds).Msg("unable to allocate IP range")
+		return nil, aErr.WithParams(sourceId, targetId, clusterIds)
 	}
-
-	return "", "", derrors.NewInternalError("Free IP Range not found").WithParams(sourceId, targetId)
+	return ipRange, nil
 }
 
 // deployedOnInfo is a struct to keep the service identifier and the cluster where it is deployed on
@@ -623,13 +624,6 @@ func (m *Manager) sendLeave(organizationID string, clusterID string, instanceID
 // AddConnection adds a new connection between one outbound and one inbound
 func (m *Manager) AddConnection(addRequest *grpc_application_network_go.AddConnectionRequest) error {
 
-	rangeMin, rangeMax, ipErr := m.getRangeIp(addRequest.OrganizationId, addRequest.SourceInstanceId, addRequest.TargetInstanceId)
-	if ipErr != nil {
-		return conversions.ToGRPCError(ipErr)
-	}
-	// addRequest needs IpRange
-	addRequest.IpRange = fmt.Sprintf("%s-%s", rangeMin, rangeMax)
-
 	// get the serviceId for inbound in targetInstanceId
 	ctxTarget, cancelTarget := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
 	defer cancelTarget()
@@ -660,6 +654,20 @@ func (m *Manager) AddConnection(addRequest *grpc_application_network_go.AddConne
 		return conversions.ToGRPCError(gErr)
 	}
 
+	// the range cannot overlap the networks of the clusters where the services are deployed
+	clusterIds := make([]string, 0, len(sources)+len(targets))
+	for _, deployed := range append(sources, targets...) {
+		clusterIds = append(clusterIds, deployed.ClusterId)
+	}
+	ipRange, ipErr := m.getRangeIp(addRequest.OrganizationId, addRequest.SourceInstanceId, addRequest.TargetInstanceId, clusterIds)
+	if ipErr != nil {
+		return conversions.ToGRPCError(ipErr)
+	}
+	// the range is stored in the connection when it is created or updated
+	defer m.allocator.Release(addRequest.OrganizationId, *ipRange)
+	// addRequest needs IpRange
+	addRequest.IpRange = ipRange.Pool()
+
 	// Create the connection
 	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
 	defer cancel()
@@ -669,13 +677,18 @@ func (m *Manager) AddConnection(addRequest *grpc_application_network_go.AddConne
 		return err
 	}
 
-	// Create ZTNetwork
-	ztNetwork, err := m.ZTClient.Add(conn.ConnectionId, addRequest.OrganizationId, rangeMin, rangeMax)
+	// Create ZTNetwork, only the port of the inbound is reachable
+	ruleSet := rules.CompileConnectionRules(targetInstance, addRequest.InboundName)
+	ztNetwork, err := m.ZTClient.Add(conn.ConnectionId, addRequest.OrganizationId, *ipRange, ruleSet)
 	if err != nil {
 		log.Error().Str("trace", conversions.ToDerror(err).DebugReport()).Msg("error creating ZTNetwork")
 		return err
 	}
 	log.Info().Str("networkId", ztNetwork.ID).Str("ZtName", ztNetwork.Name).Msg("ZT network created!")
+	// dual-stack networks include the IPv6 range
+	if ipRange := ztNetwork.IpRange(); ipRange != "" {
+		addRequest.IpRange = ipRange
+	}
 
 	// Update the connection with the ztNerworkId
 	ctxUpdate, cancelUpdate := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
@@ -816,15 +829,6 @@ func (m *Manager) RemoveConnection(removeRequest *grpc_application_network_go.Re
 
 	// Remove Zero tier network
 	if conn.ZtNetworkId != "" {
-		log.Debug().Msg("Remove zero tier network")
-		// remove ZeroTier network
-		delErr := m.ZTClient.Delete(conn.ZtNetworkId, removeRequest.OrganizationId)
-		if delErr != nil {
-			log.Error().Err(delErr).Str("organizationId", removeRequest.OrganizationId).Msg("error deleting zero tier network")
-			return conversions.ToGRPCError(delErr)
-		}
-
-		// send a message to zt-nalej (through deployment-manager) to leave the network
 		ctxList, cancelList := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
 		defer cancelList()
 		ztConn, err := m.appNetClient.ListZTNetworkConnection(ctxList, &grpc_application_network_go.ZTNetworkId{
@@ -835,7 +839,40 @@ func (m *Manager) RemoveConnection(removeRequest *grpc_application_network_go.Re
 			log.Error().Err(err).Str("organizationId", removeRequest.OrganizationId).Str("ZtNetworkId", conn.ZtNetworkId).
 				Msg("error getting zero tier connections")
 		}
-		for _, ztConn := range ztConn.Connections {
+
+		// deauthorize and delete the members of the connection before removing the network
+		for _, ztConn := range ztConn.GetConnections() {
+			if ztConn.ZtMember == "" {
+				continue
+			}
+			rmErr := m.ZTClient.RemoveMember(removeRequest.OrganizationId, conn.ZtNetworkId, ztConn.ZtMember, zt.RemovalReasonConnectionRemoved)
+			if rmErr != nil {
+				log.Warn().Str("ZtNetworkId", conn.ZtNetworkId).Str("ZtMember", ztConn.ZtMember).
+					Str("trace", rmErr.DebugReport()).Msg("error removing zero tier member")
+			}
+		}
+
+		if m.dnsManager != nil {
+			dErr := m.dnsManager.DeleteNetworkEntries(removeRequest.OrganizationId, conn.ZtNetworkId)
+			if dErr != nil {
+				log.Warn().Str("trace", dErr.DebugReport()).Str("ZtNetworkId", conn.ZtNetworkId).
+					Msg("error deleting the DNS entries of the connection")
+			}
+		}
+
+		log.Debug().Msg("Remove zero tier network")
+		// remove ZeroTier network, claiming it first if it was created without organization
+		_, delErr := m.ZTClient.Claim(conn.ZtNetworkId, removeRequest.OrganizationId)
+		if delErr == nil {
+			delErr = m.ZTClient.Delete(conn.ZtNetworkId, removeRequest.OrganizationId)
+		}
+		if delErr != nil {
+			log.Error().Err(delErr).Str("organizationId", removeRequest.OrganizationId).Msg("error deleting zero tier network")
+			return conversions.ToGRPCError(delErr)
+		}
+
+		// send a message to zt-nalej (through deployment-manager) to leave the network
+		for _, ztConn := range ztConn.GetConnections() {
 			isInbound := true
 			if ztConn.Side == grpc_application_network_go.ConnectionSide_SIDE_OUTBOUND {
 				isInbound = false
@@ -873,6 +910,38 @@ func (m *Manager) RemoveConnection(removeRequest *grpc_application_network_go.Re
 	return nil
 }
 
+// deleteEndpointEntries deletes the DNS entries of the endpoint of a connection with an overlay IP, the errors are
+// only logged.
+func (m *Manager) deleteEndpointEntries(organizationId string, networkId string, ip string) {
+	if m.dnsManager == nil || ip == "" {
+		return
+	}
+	err := m.dnsManager.DeleteEndpointEntries(organizationId, networkId, ip)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("ip", ip).Msg("unable to delete the DNS entries of the connection endpoint")
+	}
+}
+
+// addProxyReverseEntry adds the PTR record of the IP of a proxy in the network of its application instance, the
+// errors are only logged.
+func (m *Manager) addProxyReverseEntry(request *grpc_network_go.InboundServiceProxy) {
+	if m.dnsManager == nil || request.Ip == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	net, err := m.applicationClient.GetAppZtNetwork(ctx, &grpc_application_go.GetAppZtNetworkRequest{
+		OrganizationId: request.OrganizationId, AppInstanceId: request.AppInstanceId})
+	if err != nil {
+		log.Warn().Err(err).Str("appInstanceId", request.AppInstanceId).Msg("unable to get the network of the proxy")
+		return
+	}
+	dErr := m.dnsManager.AddReverseEntry(request.OrganizationId, request.AppInstanceId, request.ServiceGroupId, net.NetworkId, request.Ip, request.Fqdn)
+	if dErr != nil {
+		log.Warn().Str("trace", dErr.DebugReport()).Str("ip", request.Ip).Msg("unable to add the reverse DNS entry of the proxy")
+	}
+}
+
 // getConnections returns the inbound and outbound connections of and instance
 func (m *Manager) getConnections(organizationId string, appInstanceId string) (*grpc_application_network_go.ConnectionInstanceList, *grpc_application_network_go.ConnectionInstanceList) {
 
@@ -944,10 +1013,11 @@ func (m *Manager) manageConnectionsServiceTerminating(instance *grpc_application
 			for _, conn := range ztConnection.Connections {
 				if conn.AppInstanceId == instance.AppInstanceId && conn.ServiceId == service.ServiceId && conn.ClusterId == service.ClusterId {
 					ztMember = conn.ZtMember
+					m.deleteEndpointEntries(instance.OrganizationId, connection.ZtNetworkId, conn.ZtIp)
 				}
 			}
 			if ztMember != "" {
-				unErr := m.ZTClient.Unauthorize(connection.ZtNetworkId, ztMember)
+				unErr := m.ZTClient.RemoveMember(instance.OrganizationId, connection.ZtNetworkId, ztMember, zt.RemovalReasonServiceTerminating)
 				if unErr != nil {
 					log.Error().Err(unErr).Msg("error sending unauthorized message")
 				}
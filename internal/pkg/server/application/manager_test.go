@@ -0,0 +1,332 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package application
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-application-network-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-infrastructure-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/utils"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+// applicationsClient is a fake of the system model client of the applications that returns the given instances.
+type applicationsClient struct {
+	grpc_application_go.ApplicationsClient
+	// application instances indexed by identifier
+	instances map[string]*grpc_application_go.AppInstance
+}
+
+func (c *applicationsClient) GetAppInstance(ctx context.Context, in *grpc_application_go.AppInstanceId, opts ...grpc.CallOption) (*grpc_application_go.AppInstance, error) {
+	instance, found := c.instances[in.AppInstanceId]
+	if !found || instance.OrganizationId != in.OrganizationId {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("application instance not found").WithParams(in.AppInstanceId))
+	}
+	return instance, nil
+}
+
+// clustersClient is a fake of the system model client of the clusters of an organization without clusters, so the
+// join and leave messages are never sent.
+type clustersClient struct {
+	grpc_infrastructure_go.ClustersClient
+}
+
+func (c *clustersClient) ListClusters(ctx context.Context, in *grpc_organization_go.OrganizationId, opts ...grpc.CallOption) (*grpc_infrastructure_go.ClusterList, error) {
+	return &grpc_infrastructure_go.ClusterList{}, nil
+}
+
+// appNetClient is a fake of the system model client of the application networks. It keeps the connections and the
+// ZeroTier connections of their services in memory.
+type appNetClient struct {
+	grpc_application_network_go.ApplicationNetworkClient
+	// connections indexed by connection key
+	connections map[string]*grpc_application_network_go.ConnectionInstance
+	// ZeroTier connections of the services indexed by network
+	ztConnections map[string][]*grpc_application_network_go.ZTNetworkConnection
+}
+
+func newAppNetClient() *appNetClient {
+	return &appNetClient{
+		connections:   make(map[string]*grpc_application_network_go.ConnectionInstance, 0),
+		ztConnections: make(map[string][]*grpc_application_network_go.ZTNetworkConnection, 0),
+	}
+}
+
+func connectionKey(sourceInstanceId string, targetInstanceId string, inboundName string, outboundName string) string {
+	return sourceInstanceId + "/" + outboundName + "/" + targetInstanceId + "/" + inboundName
+}
+
+func (c *appNetClient) ListConnections(ctx context.Context, in *grpc_organization_go.OrganizationId, opts ...grpc.CallOption) (*grpc_application_network_go.ConnectionInstanceList, error) {
+	list := &grpc_application_network_go.ConnectionInstanceList{}
+	for _, conn := range c.connections {
+		if conn.OrganizationId == in.OrganizationId {
+			list.Connections = append(list.Connections, conn)
+		}
+	}
+	return list, nil
+}
+
+func (c *appNetClient) AddConnection(ctx context.Context, in *grpc_application_network_go.AddConnectionRequest, opts ...grpc.CallOption) (*grpc_application_network_go.ConnectionInstance, error) {
+	key := connectionKey(in.SourceInstanceId, in.TargetInstanceId, in.InboundName, in.OutboundName)
+	conn := &grpc_application_network_go.ConnectionInstance{
+		OrganizationId:   in.OrganizationId,
+		ConnectionId:     key,
+		SourceInstanceId: in.SourceInstanceId,
+		TargetInstanceId: in.TargetInstanceId,
+		InboundName:      in.InboundName,
+		OutboundName:     in.OutboundName,
+		IpRange:          in.IpRange,
+	}
+	c.connections[key] = conn
+	return conn, nil
+}
+
+func (c *appNetClient) GetConnection(ctx context.Context, in *grpc_application_network_go.ConnectionInstanceId, opts ...grpc.CallOption) (*grpc_application_network_go.ConnectionInstance, error) {
+	conn, found := c.connections[connectionKey(in.SourceInstanceId, in.TargetInstanceId, in.InboundName, in.OutboundName)]
+	if !found {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("connection not found"))
+	}
+	return conn, nil
+}
+
+func (c *appNetClient) UpdateConnection(ctx context.Context, in *grpc_application_network_go.UpdateConnectionRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	conn, found := c.connections[connectionKey(in.SourceInstanceId, in.TargetInstanceId, in.InboundName, in.OutboundName)]
+	if !found {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("connection not found"))
+	}
+	if in.UpdateZtNetworkId {
+		conn.ZtNetworkId = in.ZtNetworkId
+	}
+	if in.UpdateIpRange {
+		conn.IpRange = in.IpRange
+	}
+	if in.UpdateStatus {
+		conn.Status = in.Status
+	}
+	return &grpc_common_go.Success{}, nil
+}
+
+func (c *appNetClient) RemoveConnection(ctx context.Context, in *grpc_application_network_go.RemoveConnectionRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	delete(c.connections, connectionKey(in.SourceInstanceId, in.TargetInstanceId, in.InboundName, in.OutboundName))
+	return &grpc_common_go.Success{}, nil
+}
+
+func (c *appNetClient) AddZTNetworkConnection(ctx context.Context, in *grpc_application_network_go.ZTNetworkConnection, opts ...grpc.CallOption) (*grpc_application_network_go.ZTNetworkConnection, error) {
+	c.ztConnections[in.ZtNetworkId] = append(c.ztConnections[in.ZtNetworkId], in)
+	return in, nil
+}
+
+func (c *appNetClient) ListZTNetworkConnection(ctx context.Context, in *grpc_application_network_go.ZTNetworkId, opts ...grpc.CallOption) (*grpc_application_network_go.ZTNetworkConnectionList, error) {
+	return &grpc_application_network_go.ZTNetworkConnectionList{Connections: c.ztConnections[in.ZtNetworkId]}, nil
+}
+
+func (c *appNetClient) RemoveZTNetworkConnectionByNetworkId(ctx context.Context, in *grpc_application_network_go.ZTNetworkId, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	delete(c.ztConnections, in.ZtNetworkId)
+	return &grpc_common_go.Success{}, nil
+}
+
+// testInstances returns a source instance whose web service, deployed in two clusters, has two outbounds, and a
+// target instance whose database is exposed in an inbound.
+func testInstances() map[string]*grpc_application_go.AppInstance {
+	source := &grpc_application_go.AppInstance{
+		OrganizationId: "org1",
+		AppInstanceId:  "source",
+		Groups: []*grpc_application_go.ServiceGroupInstance{
+			{
+				ServiceGroupId: "group1",
+				ServiceInstances: []*grpc_application_go.ServiceInstance{
+					{ServiceId: "web", ServiceInstanceId: "web1", Name: "web", DeployedOnClusterId: "cluster1"},
+					{ServiceId: "web", ServiceInstanceId: "web2", Name: "web", DeployedOnClusterId: "cluster2"},
+				},
+			},
+		},
+		Rules: []*grpc_application_go.SecurityRule{
+			{RuleId: "r1", TargetServiceName: "web", Access: grpc_application_go.PortAccess_OUTBOUND_APPNET,
+				OutboundNetInterface: "out"},
+			{RuleId: "r2", TargetServiceName: "web", Access: grpc_application_go.PortAccess_OUTBOUND_APPNET,
+				OutboundNetInterface: "backup"},
+		},
+	}
+	target := &grpc_application_go.AppInstance{
+		OrganizationId: "org1",
+		AppInstanceId:  "target",
+		Groups: []*grpc_application_go.ServiceGroupInstance{
+			{
+				ServiceGroupId: "group1",
+				ServiceInstances: []*grpc_application_go.ServiceInstance{
+					{ServiceId: "db", ServiceInstanceId: "db1", Name: "db", DeployedOnClusterId: "cluster1"},
+				},
+			},
+		},
+		Rules: []*grpc_application_go.SecurityRule{
+			{RuleId: "r1", TargetServiceName: "db", TargetPort: 5432, Access: grpc_application_go.PortAccess_INBOUND_APPNET,
+				InboundNetInterface: "in"},
+		},
+	}
+	return map[string]*grpc_application_go.AppInstance{source.AppInstanceId: source, target.AppInstanceId: target}
+}
+
+var _ = ginkgo.Describe("Application manager", func() {
+
+	var appNet *appNetClient
+	var client *zt.ZTClient
+	var manager *Manager
+
+	ginkgo.BeforeEach(func() {
+		controller.Clear()
+		var err derrors.Error
+		client, err = zt.NewZTClient(controller.URL(), testAccessToken)
+		gomega.Expect(err).To(gomega.Succeed())
+		config, err := ipam.NewConfig(ipam.DefaultSupernet, ipam.DefaultPrefixLength)
+		gomega.Expect(err).To(gomega.Succeed())
+		appNet = newAppNetClient()
+		manager = &Manager{
+			applicationClient:     &applicationsClient{instances: testInstances()},
+			clusterInfrastructure: &clustersClient{},
+			connHelper:            utils.NewConnectionsHelper(false, "", "", true),
+			appNetClient:          appNet,
+			ZTClient:              client,
+			allocator:             ipam.NewAllocator(*config, nil, nil),
+		}
+	})
+
+	// addConnection connects an outbound of the source instance to the inbound of the target instance.
+	addConnection := func(outboundName string) *grpc_application_network_go.ConnectionInstance {
+		err := manager.AddConnection(&grpc_application_network_go.AddConnectionRequest{
+			OrganizationId:   "org1",
+			SourceInstanceId: "source",
+			TargetInstanceId: "target",
+			InboundName:      "in",
+			OutboundName:     outboundName,
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		conn, found := appNet.connections[connectionKey("source", "target", "in", outboundName)]
+		gomega.Expect(found).To(gomega.BeTrue())
+		return conn
+	}
+
+	ginkgo.Context("adding connections", func() {
+
+		ginkgo.It("should create the network of the connection with its range", func() {
+			conn := addConnection("out")
+			gomega.Expect(conn.ZtNetworkId).NotTo(gomega.BeEmpty())
+
+			network, err := client.GetOrganizationNetwork(conn.ZtNetworkId, "org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(network.IpRange()).To(gomega.Equal(conn.IpRange))
+			gomega.Expect(network.Rules).NotTo(gomega.BeEmpty())
+			connRange, rErr := ipam.ParsePool(conn.IpRange)
+			gomega.Expect(rErr).To(gomega.Succeed())
+			gomega.Expect(connRange.Overlaps(manager.allocator.ApplicationRange("org1"))).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should register the services of both sides in every cluster", func() {
+			conn := addConnection("out")
+
+			ztConnections := appNet.ztConnections[conn.ZtNetworkId]
+			gomega.Expect(ztConnections).To(gomega.HaveLen(3))
+			clusters := make([]string, 0)
+			for _, ztConn := range ztConnections {
+				if ztConn.Side == grpc_application_network_go.ConnectionSide_SIDE_INBOUND {
+					gomega.Expect(ztConn.AppInstanceId).To(gomega.Equal("target"))
+					gomega.Expect(ztConn.ServiceId).To(gomega.Equal("db"))
+				} else {
+					gomega.Expect(ztConn.AppInstanceId).To(gomega.Equal("source"))
+					gomega.Expect(ztConn.ServiceId).To(gomega.Equal("web"))
+					clusters = append(clusters, ztConn.ClusterId)
+				}
+			}
+			gomega.Expect(clusters).To(gomega.ConsistOf("cluster1", "cluster2"))
+		})
+
+		ginkgo.It("should not overlap the ranges of the other connections of the instances", func() {
+			first := addConnection("out")
+			second := addConnection("backup")
+
+			firstRange, err := ipam.ParsePool(first.IpRange)
+			gomega.Expect(err).To(gomega.Succeed())
+			secondRange, err := ipam.ParsePool(second.IpRange)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(firstRange.Overlaps(*secondRange)).To(gomega.BeFalse())
+		})
+
+		ginkgo.It("should not create a network for a missing inbound", func() {
+			err := manager.AddConnection(&grpc_application_network_go.AddConnectionRequest{
+				OrganizationId:   "org1",
+				SourceInstanceId: "source",
+				TargetInstanceId: "target",
+				InboundName:      "missing",
+				OutboundName:     "out",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(appNet.connections).To(gomega.BeEmpty())
+			networks, lErr := client.List("org1")
+			gomega.Expect(lErr).To(gomega.Succeed())
+			gomega.Expect(networks).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("removing connections", func() {
+
+		ginkgo.It("should remove the network of the connection and its members", func() {
+			conn := addConnection("out")
+			networkId := conn.ZtNetworkId
+			gomega.Expect(client.Authorize(networkId, "a1b2c3d4e5")).To(gomega.Succeed())
+			appNet.ztConnections[networkId][0].ZtMember = "a1b2c3d4e5"
+
+			err := manager.RemoveConnection(&grpc_application_network_go.RemoveConnectionRequest{
+				OrganizationId:   "org1",
+				SourceInstanceId: "source",
+				TargetInstanceId: "target",
+				InboundName:      "in",
+				OutboundName:     "out",
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(appNet.connections).To(gomega.BeEmpty())
+			gomega.Expect(appNet.ztConnections).NotTo(gomega.HaveKey(networkId))
+
+			_, gErr := client.Get(networkId)
+			gomega.Expect(gErr).To(gomega.HaveOccurred())
+			removals, rErr := client.MemberRemovals("org1", networkId)
+			gomega.Expect(rErr).To(gomega.Succeed())
+			gomega.Expect(removals).To(gomega.HaveLen(1))
+			gomega.Expect(removals[0].MemberId).To(gomega.Equal("a1b2c3d4e5"))
+			gomega.Expect(removals[0].Reason).To(gomega.Equal(zt.RemovalReasonConnectionRemoved))
+		})
+
+		ginkgo.It("should fail if the connection does not exist", func() {
+			err := manager.RemoveConnection(&grpc_application_network_go.RemoveConnectionRequest{
+				OrganizationId:   "org1",
+				SourceInstanceId: "source",
+				TargetInstanceId: "target",
+				InboundName:      "in",
+				OutboundName:     "out",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+	})
+})
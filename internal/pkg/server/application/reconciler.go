@@ -0,0 +1,477 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package application
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-application-network-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/rs/zerolog/log"
+	"sort"
+	"time"
+)
+
+// Kinds of IP range issues found by the reconciler
+const (
+	// Two connections sharing an instance have overlapping ranges
+	RangeIssueDuplicated = "duplicated"
+	// A connection has a range but its ZT network does not exist in the controller
+	RangeIssueOrphaned = "orphaned"
+	// A ZT network with a connection range is not referenced by any connection
+	RangeIssueNoConnection = "no connection"
+)
+
+// RangeIssue with an IP range that is not consistent between the system model and the controller.
+type RangeIssue struct {
+	Kind           string
+	OrganizationId string
+	// ConnectionId of the connection with the range, empty for networks without connection
+	ConnectionId string
+	// ZtNetworkId of the network with the range, if any
+	ZtNetworkId string
+	IpRange     string
+	// ConflictsWith is the connection with the overlapping range of a duplicated range
+	ConflictsWith string
+	// Fixed is true if the issue has been fixed during the reconciliation
+	Fixed bool
+}
+
+func (i *RangeIssue) String() string {
+	return fmt.Sprintf("%s range %s (organizationId: %s, connectionId: %s, ztNetworkId: %s, conflictsWith: %s, fixed: %t)",
+		i.Kind, i.IpRange, i.OrganizationId, i.ConnectionId, i.ZtNetworkId, i.ConflictsWith, i.Fixed)
+}
+
+// ReconcileReport with the result of a reconciliation.
+type ReconcileReport struct {
+	// Timestamp of the reconciliation.
+	Timestamp time.Time
+	// Organizations checked.
+	Organizations int
+	// Connections checked.
+	Connections int
+	// Networks checked.
+	Networks int
+	// Issues found.
+	Issues []RangeIssue
+	// Pending are the issues that are still in their grace period, so they are not fixed yet.
+	Pending int
+	// Errors found during the reconciliation.
+	Errors int
+}
+
+// RangeReconciler compares the IP ranges of the connections in the system model with the assignment pools of the
+// ZT networks in the controller, reporting and optionally fixing the ranges that have leaked:
+//   - Duplicated ranges, that is, overlapping ranges of connections sharing an instance. They are only reported as
+//     fixing them requires readdressing a connection.
+//   - Orphaned ranges of connections whose ZT network does not exist. They are removed from the connection.
+//   - Networks with a connection range and no connection referencing them. They are deleted from the controller.
+//
+// The application networks are identified by the instances of the system model, so a network referenced by an
+// application instance or a connection is never deleted.
+type RangeReconciler struct {
+	manager *Manager
+	// interval between reconciliations
+	interval time.Duration
+	// gracePeriod an issue must persist before being fixed
+	gracePeriod time.Duration
+	// fix the issues or only report them
+	fix bool
+	// issues found and the first time they were found
+	found map[string]time.Time
+	// confirmed ZT networks whose issues can be fixed, nil to fix the issues of any network
+	confirmed map[string]bool
+}
+
+// NewRangeReconciler creates a new reconciler of IP ranges.
+func NewRangeReconciler(manager *Manager, interval time.Duration, gracePeriod time.Duration, fix bool) *RangeReconciler {
+	return &RangeReconciler{
+		manager:     manager,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		fix:         fix,
+		found:       make(map[string]time.Time, 0),
+	}
+}
+
+// ConfirmNetworks restricts the fixes to the issues of the given ZT networks. The reconcilers that do not share the
+// allocator of the running network managers do not know the ranges being allocated, so every fix must be confirmed.
+func (r *RangeReconciler) ConfirmNetworks(networkIds []string) {
+	r.confirmed = make(map[string]bool, len(networkIds))
+	for _, networkId := range networkIds {
+		r.confirmed[networkId] = true
+	}
+}
+
+// Run launches the periodic reconciliation of the organizations found in the controller. This method blocks.
+func (r *RangeReconciler) Run() {
+	log.Info().Str("interval", r.interval.String()).Str("gracePeriod", r.gracePeriod.String()).Bool("fix", r.fix).
+		Msg("launching IP range reconciler")
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := r.Reconcile(nil)
+		if err != nil {
+			log.Error().Str("trace", err.DebugReport()).Msg("error reconciling IP ranges")
+			continue
+		}
+		LogReconcileReport(report)
+	}
+}
+
+// LogReconcileReport logs the summary and the issues of a reconciliation.
+func LogReconcileReport(report *ReconcileReport) {
+	log.Info().Int("organizations", report.Organizations).Int("connections", report.Connections).
+		Int("networks", report.Networks).Int("issues", len(report.Issues)).Int("pending", report.Pending).
+		Int("errors", report.Errors).Msg("IP range reconciliation finished")
+	for _, issue := range report.Issues {
+		log.Warn().Str("kind", issue.Kind).Str("organizationId", issue.OrganizationId).
+			Str("connectionId", issue.ConnectionId).Str("ztNetworkId", issue.ZtNetworkId).Str("range", issue.IpRange).
+			Str("conflictsWith", issue.ConflictsWith).Bool("fixed", issue.Fixed).Msg("IP range issue")
+	}
+}
+
+// Reconcile checks the IP ranges of a set of organizations and of every organization with networks in the
+// controller, fixing the issues that have persisted longer than the grace period if required.
+func (r *RangeReconciler) Reconcile(organizationIds []string) (*ReconcileReport, derrors.Error) {
+	now := time.Now()
+	report := &ReconcileReport{Timestamp: now, Issues: make([]RangeIssue, 0)}
+
+	networks, failed, err := r.manager.ZTClient.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	report.Errors += len(failed)
+	// networks whose details are unknown cannot be considered missing
+	unknown := make(map[string]bool, len(failed))
+	for _, networkError := range failed {
+		unknown[networkError.NetworkId] = true
+	}
+
+	// every network of the controller, a connection is not orphaned while its network exists even if the network
+	// has no organization
+	all := make(map[string]zt.ZTNetwork, len(networks))
+	networksByOrg := make(map[string][]zt.ZTNetwork, 0)
+	for _, organizationId := range organizationIds {
+		networksByOrg[organizationId] = make([]zt.ZTNetwork, 0)
+	}
+	for _, network := range networks {
+		all[network.ID] = network
+		organizationId := network.OrganizationId()
+		if organizationId == "" {
+			// networks without organization are never deleted by the reconciler
+			continue
+		}
+		networksByOrg[organizationId] = append(networksByOrg[organizationId], network)
+	}
+	orgs := make([]string, 0, len(networksByOrg))
+	for organizationId := range networksByOrg {
+		orgs = append(orgs, organizationId)
+	}
+	sort.Strings(orgs)
+
+	stillFound := make(map[string]time.Time, 0)
+	for _, organizationId := range orgs {
+		issues, rErr := r.reconcileOrganization(organizationId, networksByOrg[organizationId], all, unknown, report)
+		if rErr != nil {
+			log.Warn().Str("organizationId", organizationId).Str("trace", rErr.DebugReport()).
+				Msg("unable to reconcile the IP ranges of the organization")
+			report.Errors++
+			continue
+		}
+		report.Organizations++
+		for _, issue := range issues {
+			key := issueKey(issue)
+			since, found := r.found[key]
+			if !found {
+				since = now
+			}
+			if !r.fix || issue.Kind == RangeIssueDuplicated || (r.confirmed != nil && !r.confirmed[issue.ZtNetworkId]) {
+				report.Issues = append(report.Issues, issue)
+				continue
+			}
+			if now.Sub(since) < r.gracePeriod {
+				stillFound[key] = since
+				report.Pending++
+				report.Issues = append(report.Issues, issue)
+				continue
+			}
+			if fErr := r.fixIssue(issue); fErr != nil {
+				log.Warn().Str("kind", issue.Kind).Str("organizationId", issue.OrganizationId).
+					Str("trace", fErr.DebugReport()).Msg("unable to fix IP range issue")
+				stillFound[key] = since
+				report.Errors++
+			} else {
+				issue.Fixed = true
+			}
+			report.Issues = append(report.Issues, issue)
+		}
+	}
+	// issues that are gone are forgotten
+	r.found = stillFound
+
+	return report, nil
+}
+
+// applicationNetworks returns the ZT networks of the application instances of an organization in the system model.
+func (r *RangeReconciler) applicationNetworks(organizationId string) (map[string]bool, derrors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	instances, err := r.manager.applicationClient.ListAppInstances(ctx, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	networks := make(map[string]bool, 0)
+	for _, instance := range instances.Instances {
+		ctxNet, cancelNet := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+		network, err := r.manager.applicationClient.GetAppZtNetwork(ctxNet, &grpc_application_go.GetAppZtNetworkRequest{
+			OrganizationId: organizationId,
+			AppInstanceId:  instance.AppInstanceId,
+		})
+		cancelNet()
+		if err != nil {
+			dErr := conversions.ToDerror(err)
+			if dErr.Type() == derrors.NotFound {
+				// the instance has no network yet
+				continue
+			}
+			return nil, dErr
+		}
+		networks[network.NetworkId] = true
+	}
+	return networks, nil
+}
+
+// reconcileOrganization returns the issues of the IP ranges of an organization. The connections are checked against
+// all the networks of the controller, and only the networks of the organization that are not referenced by its
+// application instances may be reported without connection.
+func (r *RangeReconciler) reconcileOrganization(organizationId string, networks []zt.ZTNetwork, all map[string]zt.ZTNetwork,
+	unknown map[string]bool, report *ReconcileReport) ([]RangeIssue, derrors.Error) {
+	// the application networks are identified before classifying any network
+	referenced, aErr := r.applicationNetworks(organizationId)
+	if aErr != nil {
+		return nil, aErr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	connections, err := r.manager.appNetClient.ListConnections(ctx, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+
+	issues := make([]RangeIssue, 0)
+	// ranges in use by the connections, taken from the controller when the network exists
+	ranges := make([]*ipam.Range, len(connections.Connections))
+
+	for i, conn := range connections.Connections {
+		report.Connections++
+		if conn.ZtNetworkId != "" {
+			referenced[conn.ZtNetworkId] = true
+		}
+		network, exists := all[conn.ZtNetworkId]
+		if exists && network.IpRange() != "" {
+			if connRange, rErr := ipam.ParsePool(network.IpRange()); rErr == nil {
+				ranges[i] = connRange
+			}
+		}
+		if ranges[i] == nil && conn.IpRange != "" {
+			connRange, rErr := ipam.ParsePool(conn.IpRange)
+			if rErr != nil {
+				log.Warn().Str("connectionId", conn.ConnectionId).Str("range", conn.IpRange).Msg("incorrect IP range format")
+				report.Errors++
+				continue
+			}
+			ranges[i] = connRange
+		}
+		if conn.IpRange == "" || conn.ZtNetworkId == "" || exists || unknown[conn.ZtNetworkId] {
+			continue
+		}
+		// the range of a connection that is being created is still pending
+		if r.manager.allocator.IsPending(organizationId, *ranges[i]) {
+			continue
+		}
+		issues = append(issues, RangeIssue{
+			Kind:           RangeIssueOrphaned,
+			OrganizationId: organizationId,
+			ConnectionId:   conn.ConnectionId,
+			ZtNetworkId:    conn.ZtNetworkId,
+			IpRange:        conn.IpRange,
+		})
+	}
+
+	// the ranges only have to be different among the connections of an instance
+	for i, conn := range connections.Connections {
+		for j := i + 1; j < len(connections.Connections); j++ {
+			other := connections.Connections[j]
+			if ranges[i] == nil || ranges[j] == nil || !shareInstance(conn, other) || !ranges[i].Overlaps(*ranges[j]) {
+				continue
+			}
+			issues = append(issues, RangeIssue{
+				Kind:           RangeIssueDuplicated,
+				OrganizationId: organizationId,
+				ConnectionId:   conn.ConnectionId,
+				ZtNetworkId:    conn.ZtNetworkId,
+				IpRange:        ranges[i].String(),
+				ConflictsWith:  other.ConnectionId,
+			})
+		}
+	}
+
+	for _, network := range networks {
+		report.Networks++
+		if referenced[network.ID] || network.IpRange() == "" {
+			continue
+		}
+		networkRange, rErr := ipam.ParsePool(network.IpRange())
+		if rErr != nil {
+			log.Warn().Str("networkId", network.ID).Str("range", network.IpRange()).Msg("incorrect IP range format")
+			report.Errors++
+			continue
+		}
+		if r.manager.allocator.IsPending(organizationId, *networkRange) {
+			continue
+		}
+		issues = append(issues, RangeIssue{
+			Kind:           RangeIssueNoConnection,
+			OrganizationId: organizationId,
+			ConnectionId:   network.ShortName(),
+			ZtNetworkId:    network.ID,
+			IpRange:        network.IpRange(),
+		})
+	}
+
+	return issues, nil
+}
+
+// fixIssue removes the orphaned ranges from their connections and deletes the networks without connection.
+func (r *RangeReconciler) fixIssue(issue RangeIssue) derrors.Error {
+	switch issue.Kind {
+	case RangeIssueOrphaned:
+		conn, err := r.getConnection(issue.OrganizationId, issue.ConnectionId)
+		if err != nil {
+			return err
+		}
+		// the connection may have changed since the issue was found
+		if conn.ZtNetworkId != issue.ZtNetworkId || conn.IpRange != issue.IpRange {
+			return derrors.NewFailedPreconditionError("connection changed since the issue was found").
+				WithParams(issue.ConnectionId)
+		}
+		// a connection is never cleared while its network exists
+		if _, gErr := r.manager.ZTClient.Get(issue.ZtNetworkId); gErr == nil {
+			return derrors.NewFailedPreconditionError("network of the connection exists").WithParams(issue.ZtNetworkId)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+		defer cancel()
+		_, uErr := r.manager.appNetClient.UpdateConnection(ctx, &grpc_application_network_go.UpdateConnectionRequest{
+			OrganizationId:    conn.OrganizationId,
+			SourceInstanceId:  conn.SourceInstanceId,
+			TargetInstanceId:  conn.TargetInstanceId,
+			InboundName:       conn.InboundName,
+			OutboundName:      conn.OutboundName,
+			UpdateIpRange:     true,
+			IpRange:           "",
+			UpdateZtNetworkId: true,
+			ZtNetworkId:       "",
+		})
+		if uErr != nil {
+			return conversions.ToDerror(uErr)
+		}
+		log.Info().Str("organizationId", issue.OrganizationId).Str("connectionId", issue.ConnectionId).
+			Str("range", issue.IpRange).Msg("orphaned IP range removed from connection")
+	case RangeIssueNoConnection:
+		// the network may have been referenced since the issue was found
+		referenced, err := r.isReferenced(issue.OrganizationId, issue.ZtNetworkId)
+		if err != nil {
+			return err
+		}
+		if referenced {
+			return derrors.NewFailedPreconditionError("network referenced by the system model").WithParams(issue.ZtNetworkId)
+		}
+		if err := r.manager.ZTClient.Delete(issue.ZtNetworkId, issue.OrganizationId); err != nil {
+			return err
+		}
+		log.Info().Str("organizationId", issue.OrganizationId).Str("ztNetworkId", issue.ZtNetworkId).
+			Str("range", issue.IpRange).Msg("ZT network without connection deleted")
+	default:
+		return derrors.NewUnimplementedError("IP range issue cannot be fixed").WithParams(issue.Kind)
+	}
+	return nil
+}
+
+// getConnection returns the current state of a connection of an organization.
+func (r *RangeReconciler) getConnection(organizationId string, connectionId string) (*grpc_application_network_go.ConnectionInstance, derrors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	connections, err := r.manager.appNetClient.ListConnections(ctx, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	for _, conn := range connections.Connections {
+		if conn.ConnectionId == connectionId {
+			return conn, nil
+		}
+	}
+	return nil, derrors.NewNotFoundError("connection not found").WithParams(organizationId, connectionId)
+}
+
+// isReferenced checks if a ZT network is referenced by an application instance or a connection of an organization.
+func (r *RangeReconciler) isReferenced(organizationId string, networkId string) (bool, derrors.Error) {
+	networks, err := r.applicationNetworks(organizationId)
+	if err != nil {
+		return false, err
+	}
+	if networks[networkId] {
+		return true, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	connections, cErr := r.manager.appNetClient.ListConnections(ctx, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if cErr != nil {
+		return false, conversions.ToDerror(cErr)
+	}
+	for _, conn := range connections.Connections {
+		if conn.ZtNetworkId == networkId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// shareInstance checks if two connections have an instance in common.
+func shareInstance(conn *grpc_application_network_go.ConnectionInstance, other *grpc_application_network_go.ConnectionInstance) bool {
+	return conn.SourceInstanceId == other.SourceInstanceId || conn.SourceInstanceId == other.TargetInstanceId ||
+		conn.TargetInstanceId == other.SourceInstanceId || conn.TargetInstanceId == other.TargetInstanceId
+}
+
+func issueKey(issue RangeIssue) string {
+	return fmt.Sprintf("%s#%s#%s#%s#%s", issue.Kind, issue.OrganizationId, issue.ConnectionId, issue.ZtNetworkId, issue.IpRange)
+}
@@ -19,7 +19,12 @@ package server
 
 import (
 	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/provider/dns"
+	"github.com/nalej/network-manager/internal/pkg/zt"
 	"github.com/rs/zerolog/log"
+	"time"
 )
 
 type Config struct {
@@ -31,8 +36,58 @@ type Config struct {
 	ZTUrl string
 	// ZT access token
 	ZTAccessToken string
+	// ZTMockup launches an in-memory ZT controller instead of using ZTUrl, for local development
+	ZTMockup bool
+	// ZTIPv6Mode enables dual-stack networks with the given IPv6 assign mode (zt, rfc4193 or 6plane)
+	ZTIPv6Mode string
+	// ZTListWorkers is the number of network details requested concurrently when listing networks
+	ZTListWorkers int
+	// ZTMemberGCInterval is the interval between collections of stale ZT members, zero disables the collector
+	ZTMemberGCInterval time.Duration
+	// ZTMemberGCGracePeriod is the time a ZT member must be unclaimed in the system model before being collected
+	ZTMemberGCGracePeriod time.Duration
+	// IPAMSupernet is the network where the IP ranges of the ZT networks are allocated
+	IPAMSupernet string
+	// IPAMPrefixLength is the prefix length of the IP ranges of the ZT networks
+	IPAMPrefixLength int
+	// IPAMOrganizations with the supernet and prefix length of the organizations that do not use the default ones
+	// (<organizationId>=<supernet>:<prefixLength>)
+	IPAMOrganizations []string
+	// IPAMClusterExclusions with the CIDRs used by the clusters that the IP ranges must not overlap (<clusterId>=<cidr>,
+	// * for every cluster)
+	IPAMClusterExclusions []string
+	// IPAMReconcileInterval is the interval between reconciliations of the IP ranges, zero disables the reconciler
+	IPAMReconcileInterval time.Duration
+	// IPAMReconcileGracePeriod is the time an IP range issue must persist before being fixed
+	IPAMReconcileGracePeriod time.Duration
+	// IPAMReconcileFix fixes the IP range issues instead of only reporting them
+	IPAMReconcileFix bool
+	// DNSProvider is the backend where the DNS entries are stored (consul or memory)
+	DNSProvider string
+	// DNSServerAddress where the built-in DNS server listens, empty disables the server
+	DNSServerAddress string
+	// DNSServerDomain of the zones of the organizations served by the built-in DNS server
+	DNSServerDomain string
+	// DNSServerTTL of the records served by the built-in DNS server
+	DNSServerTTL time.Duration
 	// Consul DNS URL
 	DNSUrl string
+	// ConsulScheme used to connect to Consul (http or https)
+	ConsulScheme string
+	// ConsulDatacenter where the DNS entries are registered
+	ConsulDatacenter string
+	// ConsulToken of the Consul ACL, not printed
+	ConsulToken string `json:"-"`
+	// ConsulTokenFile with the token of the Consul ACL
+	ConsulTokenFile string
+	// ConsulCACertPath path for the CA of the Consul agents
+	ConsulCACertPath string
+	// ConsulClientCertPath path for the client certificate of Consul
+	ConsulClientCertPath string
+	// ConsulClientKeyPath path for the key of the client certificate of Consul
+	ConsulClientKeyPath string
+	// ConsulSkipServerCertValidation skips the validation of the certificates of the Consul agents
+	ConsulSkipServerCertValidation bool
 	// URL for the message queue
 	QueueAddress string
 	// UseTLS to connect to the application cluster API
@@ -58,9 +113,56 @@ func (conf *Config) Validate() derrors.Error {
 	if conf.ZTAccessToken == "" {
 		return derrors.NewInvalidArgumentError("ZT Access Token must be defined")
 	}
-	if conf.DNSUrl == "" {
+	if conf.ZTIPv6Mode != "" && conf.ZTIPv6Mode != zt.IPv6ModeZt && conf.ZTIPv6Mode != zt.IPv6ModeRfc4193 && conf.ZTIPv6Mode != zt.IPv6ModeSixPlane {
+		return derrors.NewInvalidArgumentError("ZT IPv6 mode must be zt, rfc4193 or 6plane")
+	}
+	if conf.ZTListWorkers <= 0 {
+		return derrors.NewInvalidArgumentError("ZT list workers must be positive")
+	}
+	if conf.ZTMemberGCInterval < 0 {
+		return derrors.NewInvalidArgumentError("ZT member GC interval cannot be negative")
+	}
+	if conf.ZTMemberGCInterval > 0 && conf.ZTMemberGCGracePeriod <= 0 {
+		return derrors.NewInvalidArgumentError("ZT member GC grace period must be positive")
+	}
+	if _, err := ipam.NewConfig(conf.IPAMSupernet, conf.IPAMPrefixLength); err != nil {
+		return err
+	}
+	if _, err := ipam.ParseOrganizationConfigs(conf.IPAMOrganizations); err != nil {
+		return err
+	}
+	if _, err := ipam.ParseClusterExclusions(conf.IPAMClusterExclusions); err != nil {
+		return err
+	}
+	if conf.IPAMReconcileInterval < 0 {
+		return derrors.NewInvalidArgumentError("IPAM reconcile interval cannot be negative")
+	}
+	if conf.IPAMReconcileInterval > 0 && conf.IPAMReconcileGracePeriod <= 0 {
+		return derrors.NewInvalidArgumentError("IPAM reconcile grace period must be positive")
+	}
+	if conf.DNSProvider != dns.ConsulBackend && conf.DNSProvider != dns.MemoryBackend {
+		return derrors.NewInvalidArgumentError("DNS provider must be consul or memory")
+	}
+	if conf.DNSProvider == dns.ConsulBackend && conf.DNSUrl == "" {
 		return derrors.NewInvalidArgumentError("DNS URL must be defined")
 	}
+	if conf.DNSServerAddress != "" && conf.DNSServerDomain == "" {
+		return derrors.NewInvalidArgumentError("DNS server domain must be defined")
+	}
+	if conf.DNSServerAddress != "" && conf.DNSServerTTL < time.Second {
+		return derrors.NewInvalidArgumentError("DNS server TTL must be at least one second")
+	}
+	if conf.DNSProvider == dns.ConsulBackend {
+		if conf.ConsulScheme != consul.SchemeHTTP && conf.ConsulScheme != consul.SchemeHTTPS {
+			return derrors.NewInvalidArgumentError("Consul scheme must be http or https")
+		}
+		if conf.ConsulToken != "" && conf.ConsulTokenFile != "" {
+			return derrors.NewInvalidArgumentError("Consul token and token file cannot be both defined")
+		}
+		if (conf.ConsulClientCertPath == "") != (conf.ConsulClientKeyPath == "") {
+			return derrors.NewInvalidArgumentError("Consul client certificate and key must be defined together")
+		}
+	}
 	if conf.QueueAddress == "" {
 		return derrors.NewInvalidArgumentError("Queue URL must be defined")
 	}
@@ -74,6 +176,38 @@ func (conf *Config) Validate() derrors.Error {
 	return nil
 }
 
+// NewAllocator creates the allocator of IP ranges defined by the IPAM configuration.
+func (conf *Config) NewAllocator() (*ipam.Allocator, derrors.Error) {
+	ipamConfig, err := ipam.NewConfig(conf.IPAMSupernet, conf.IPAMPrefixLength)
+	if err != nil {
+		return nil, err
+	}
+	organizations, err := ipam.ParseOrganizationConfigs(conf.IPAMOrganizations)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := ipam.ParseClusterExclusions(conf.IPAMClusterExclusions)
+	if err != nil {
+		return nil, err
+	}
+	return ipam.NewAllocator(*ipamConfig, organizations, exclusions), nil
+}
+
+// ConsulConfig returns the configuration of the connections to Consul.
+func (conf *Config) ConsulConfig() consul.Config {
+	return consul.Config{
+		Address:            conf.DNSUrl,
+		Scheme:             conf.ConsulScheme,
+		Datacenter:         conf.ConsulDatacenter,
+		Token:              conf.ConsulToken,
+		TokenFile:          conf.ConsulTokenFile,
+		CAFile:             conf.ConsulCACertPath,
+		CertFile:           conf.ConsulClientCertPath,
+		KeyFile:            conf.ConsulClientKeyPath,
+		InsecureSkipVerify: conf.ConsulSkipServerCertValidation,
+	}
+}
+
 func (conf *Config) Print() {
 	log.Info().Interface("configuration", conf).Msg("defined network manager configuration")
 }
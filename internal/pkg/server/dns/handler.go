@@ -54,6 +54,24 @@ func (h *Handler) AddDNSEntry(ctx context.Context, entry *grpc_network_go.AddDNS
 	return &grpc_common_go.Success{}, nil
 }
 
+// AddDNSEntries adds a batch of entries of an organization.
+func (h *Handler) AddDNSEntries(ctx context.Context, request *grpc_network_go.AddDNSEntriesRequest) (*grpc_network_go.AddDNSEntriesResponse, error) {
+	log.Debug().Str("organizationId", request.OrganizationId).Int("entries", len(request.Entries)).Msg("add dns entries")
+
+	err := entities.ValidAddDNSEntriesRequest(request)
+	if err != nil {
+		log.Error().Msgf("Invalid DNS entries: %s", err.Error())
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	response, err := h.Manager.AddDNSEntries(request)
+	if err != nil {
+		log.Error().Msgf("Unable to add DNS entries: %s", err.Error())
+		return nil, conversions.ToGRPCError(err)
+	}
+	return response, nil
+}
+
 func (h *Handler) DeleteDNSEntry(ctx context.Context, entry *grpc_network_go.DeleteDNSEntryRequest) (*grpc_common_go.Success, error) {
 	log.Debug().Interface("request", entry).Msg("delete dns entry")
 
@@ -21,18 +21,19 @@ import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-network-go"
 	"github.com/nalej/grpc-organization-go"
-	"github.com/nalej/network-manager/internal/pkg/consul"
 	"github.com/nalej/network-manager/internal/pkg/entities"
+	"github.com/nalej/network-manager/internal/pkg/provider/dns"
 	"github.com/rs/zerolog/log"
+	"strings"
 )
 
 type Manager struct {
-	client consul.ConsulClient
+	provider dns.Provider
 }
 
-func NewManager(consulClient *consul.ConsulClient) (*Manager, derrors.Error) {
+func NewManager(provider dns.Provider) (*Manager, derrors.Error) {
 	return &Manager{
-		client: *consulClient,
+		provider: provider,
 	}, nil
 }
 
@@ -40,7 +41,19 @@ func NewManager(consulClient *consul.ConsulClient) (*Manager, derrors.Error) {
 func (m *Manager) AddDNSEntry(entry *grpc_network_go.AddDNSEntryRequest) derrors.Error {
 	log.Debug().Interface("request", entry).Msg("added DNS entry")
 
-	err := m.client.Add(entry.ServiceName, entry.Fqdn, entry.Ip, entry.Tags)
+	dnsEntry := entities.DNSEntryFromGRPC(entry)
+	if dnsEntry.IsAlias() {
+		existing, err := m.provider.List(entry.OrganizationId)
+		if err != nil {
+			return err
+		}
+		err = entities.ValidAlias(dnsEntry, existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := m.provider.Add(dnsEntry)
 
 	if err != nil {
 		log.Error().Msg("Unable to add DNS entry to the system")
@@ -50,10 +63,116 @@ func (m *Manager) AddDNSEntry(entry *grpc_network_go.AddDNSEntryRequest) derrors
 	return nil
 }
 
+// AddDNSEntries adds a batch of entries of an organization. The entries that already exist are skipped, replaced or
+// make the whole batch fail depending on the conflict policy. If an entry cannot be added, the entries already added
+// are rolled back. In a dry run, the result is returned without adding the entries.
+func (m *Manager) AddDNSEntries(request *grpc_network_go.AddDNSEntriesRequest) (*grpc_network_go.AddDNSEntriesResponse, derrors.Error) {
+	log.Debug().Str("organizationId", request.OrganizationId).Int("entries", len(request.Entries)).
+		Str("conflictPolicy", request.ConflictPolicy.String()).Bool("dryRun", request.DryRun).Msg("add DNS entries")
+
+	existing, err := m.provider.List(request.OrganizationId)
+	if err != nil {
+		return nil, err
+	}
+	previous := make(map[string]entities.DNSEntry, len(existing))
+	for _, entry := range existing {
+		previous[entry.Fqdn] = entry
+	}
+
+	response := &grpc_network_go.AddDNSEntriesResponse{
+		Added:    make([]string, 0),
+		Replaced: make([]string, 0),
+		Skipped:  make([]string, 0),
+	}
+	conflicts := make([]string, 0)
+	toAdd := make([]entities.DNSEntry, 0, len(request.Entries))
+	for _, grpcEntry := range request.Entries {
+		entry := entities.DNSEntryFromGRPC(grpcEntry)
+		entry.OrganizationId = request.OrganizationId
+		if _, exists := previous[entry.Fqdn]; exists {
+			switch request.ConflictPolicy {
+			case grpc_network_go.ConflictPolicy_SKIP:
+				response.Skipped = append(response.Skipped, entry.Fqdn)
+				continue
+			case grpc_network_go.ConflictPolicy_FAIL:
+				conflicts = append(conflicts, entry.Fqdn)
+				continue
+			}
+			response.Replaced = append(response.Replaced, entry.Fqdn)
+		} else {
+			response.Added = append(response.Added, entry.Fqdn)
+		}
+		toAdd = append(toAdd, entry)
+	}
+	if len(conflicts) > 0 {
+		return nil, derrors.NewAlreadyExistsError("DNS entries already exist").WithParams(strings.Join(conflicts, ","))
+	}
+	err = validAliases(toAdd, previous)
+	if err != nil {
+		return nil, err
+	}
+	if request.DryRun {
+		return response, nil
+	}
+
+	for i, entry := range toAdd {
+		err = m.provider.Add(entry)
+		if err != nil {
+			log.Error().Str("fqdn", entry.Fqdn).Str("trace", err.DebugReport()).Msg("unable to add DNS entry, rolling back the batch")
+			m.rollback(request.OrganizationId, toAdd[:i], previous)
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// validAliases checks the aliases of a batch against the entries of the organization once the batch is added.
+func validAliases(toAdd []entities.DNSEntry, previous map[string]entities.DNSEntry) derrors.Error {
+	result := make(map[string]entities.DNSEntry, len(previous)+len(toAdd))
+	for fqdn, entry := range previous {
+		result[fqdn] = entry
+	}
+	for _, entry := range toAdd {
+		result[entry.Fqdn] = entry
+	}
+	entries := make([]entities.DNSEntry, 0, len(result))
+	for _, entry := range result {
+		entries = append(entries, entry)
+	}
+	for _, entry := range toAdd {
+		if !entry.IsAlias() {
+			continue
+		}
+		if err := entities.ValidAlias(entry, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollback restores the previous state of the entries added in a batch.
+func (m *Manager) rollback(organizationId string, added []entities.DNSEntry, previous map[string]entities.DNSEntry) {
+	for _, entry := range added {
+		var err derrors.Error
+		if old, exists := previous[entry.Fqdn]; exists {
+			err = m.provider.Add(old)
+		} else {
+			err = m.provider.DeleteGeneric(organizationId, entry.Fqdn)
+		}
+		if err != nil {
+			log.Error().Str("fqdn", entry.Fqdn).Str("trace", err.DebugReport()).Msg("unable to roll back DNS entry")
+		}
+	}
+}
+
 // DeleteDNSEntry
 func (m *Manager) DeleteDNSEntry(entry *grpc_network_go.DeleteDNSEntryRequest) derrors.Error {
 	log.Debug().Interface("request", entry).Msg("delete DNS entry")
-	err := m.client.Delete(entry.ServiceName, entry.Tags)
+	err := m.provider.Delete(entities.DNSEntry{
+		OrganizationId: entry.OrganizationId,
+		ServiceName:    entry.ServiceName,
+		Tags:           entry.Tags,
+	})
 
 	if err != nil {
 		log.Error().Msg("Unable to delete DNS entry from the system")
@@ -63,21 +182,101 @@ func (m *Manager) DeleteDNSEntry(entry *grpc_network_go.DeleteDNSEntryRequest) d
 	return nil
 }
 
+// DeleteEntriesByOwner deletes the DNS entries of an organization owned by an application instance.
+func (m *Manager) DeleteEntriesByOwner(organizationId string, appInstanceId string) derrors.Error {
+	log.Debug().Str("organizationId", organizationId).Str("appInstanceId", appInstanceId).Msg("delete DNS entries of application instance")
+	if organizationId == "" || appInstanceId == "" {
+		return derrors.NewInvalidArgumentError("organization and application instance are required").WithParams(organizationId, appInstanceId)
+	}
+	return m.provider.DeleteEntriesByOwner(organizationId, appInstanceId)
+}
+
 // ListDNSEntries
 func (m *Manager) ListDNSEntries(organizationId *grpc_organization_go.OrganizationId) ([]entities.DNSEntry, derrors.Error) {
-	serviceList, err := m.client.List(organizationId.OrganizationId)
+	entryList, err := m.provider.List(organizationId.OrganizationId)
 
 	if err != nil {
 		log.Error().Msg("Unable to retrieve DNS list from the system")
 		return nil, derrors.NewGenericError(err.Error())
 	}
 
-	entryList := make([]entities.DNSEntry, len(serviceList))
-	for i, n := range serviceList {
-		entryList[i].OrganizationId = organizationId.OrganizationId
-		entryList[i].Fqdn = n.Service
-		entryList[i].Ip = n.Address
+	return entryList, nil
+}
+
+// AddReverseEntry adds the PTR record of an overlay IP of a network pointing to a target name. A previous record of
+// the IP in the network is replaced.
+func (m *Manager) AddReverseEntry(organizationId string, appInstanceId string, serviceGroupId string, networkId string, ip string, target string) derrors.Error {
+	entry, err := entities.NewReverseEntry(organizationId, appInstanceId, serviceGroupId, networkId, ip, target)
+	if err != nil {
+		return err
 	}
+	log.Debug().Str("organizationId", organizationId).Str("name", entry.Fqdn).Str("target", target).Msg("add reverse DNS entry")
+	return m.provider.AddGeneric(*entry)
+}
 
-	return entryList, nil
+// DeleteReverseEntry deletes the PTR record of an overlay IP of a network, if any.
+func (m *Manager) DeleteReverseEntry(organizationId string, networkId string, ip string) derrors.Error {
+	name, err := entities.ReverseEntryName(networkId, ip)
+	if err != nil {
+		return err
+	}
+	log.Debug().Str("organizationId", organizationId).Str("name", name).Msg("delete reverse DNS entry")
+	err = m.provider.DeleteGeneric(organizationId, name)
+	if err != nil && err.Type() != derrors.NotFound {
+		return err
+	}
+	return nil
+}
+
+// AddEndpointEntry adds the address record of the endpoint of a connection in a cluster. A previous record of the
+// endpoint in the cluster is replaced, and the records of the other clusters are kept.
+func (m *Manager) AddEndpointEntry(organizationId string, appInstanceId string, serviceGroupId string, networkId string, clusterId string, name string, ip string) derrors.Error {
+	log.Debug().Str("organizationId", organizationId).Str("name", name).Str("clusterId", clusterId).Str("ip", ip).
+		Msg("add endpoint DNS entry")
+	return m.provider.AddGeneric(entities.DNSEntry{
+		OrganizationId: organizationId,
+		AppInstanceId:  appInstanceId,
+		ServiceGroupId: serviceGroupId,
+		NetworkId:      networkId,
+		ClusterId:      clusterId,
+		Fqdn:           name,
+		Ip:             ip,
+	})
+}
+
+// DeleteEndpointEntries deletes the records of an overlay IP of a network, its PTR record and the address record of
+// its endpoint.
+func (m *Manager) DeleteEndpointEntries(organizationId string, networkId string, ip string) derrors.Error {
+	return m.deleteNetworkEntries(organizationId, networkId, func(entry entities.DNSEntry) bool {
+		return entry.Ip == ip
+	})
+}
+
+// DeleteNetworkEntries deletes the records of the overlay IPs of a network.
+func (m *Manager) DeleteNetworkEntries(organizationId string, networkId string) derrors.Error {
+	return m.deleteNetworkEntries(organizationId, networkId, func(entry entities.DNSEntry) bool {
+		return true
+	})
+}
+
+func (m *Manager) deleteNetworkEntries(organizationId string, networkId string, matches func(entry entities.DNSEntry) bool) derrors.Error {
+	entries, err := m.provider.List(organizationId)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if networkId == "" || entry.NetworkId != networkId || !matches(entry) {
+			continue
+		}
+		if entry.ClusterId != "" {
+			// the endpoint keeps the records of the other clusters
+			err = m.provider.DeleteClusterEntry(organizationId, entry.Fqdn, entry.ClusterId)
+		} else {
+			err = m.provider.DeleteGeneric(organizationId, entry.Fqdn)
+		}
+		if err != nil && err.Type() != derrors.NotFound {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/rs/zerolog/log"
+)
+
+// ClaimReport with the result of claiming the networks created without organization.
+type ClaimReport struct {
+	// Claimed are the networks tagged with the organization that references them in the system model.
+	Claimed []string
+	// Unowned are the networks not referenced by exactly one organization, they stay without organization.
+	Unowned []string
+	// Errors found claiming the networks.
+	Errors int
+}
+
+// ClaimNetworks tags the networks created without organization with the organization whose application networks
+// or connections reference them in the system model. Networks without organization are denied to every
+// organization, so this migration runs before the networks are served.
+func (m *Manager) ClaimNetworks() (*ClaimReport, derrors.Error) {
+	report := &ClaimReport{Claimed: make([]string, 0), Unowned: make([]string, 0)}
+
+	networks, failed, err := m.ZTClient.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	report.Errors += len(failed)
+
+	ownerless := make([]string, 0)
+	for _, network := range networks {
+		if network.OrganizationId() == "" {
+			ownerless = append(ownerless, network.ID)
+		}
+	}
+	if len(ownerless) == 0 {
+		return report, nil
+	}
+
+	modelByOrg, err := m.getSystemModel()
+	if err != nil {
+		return nil, err
+	}
+	for _, networkId := range ownerless {
+		organizationId := resolveOwner(networkId, modelByOrg)
+		if organizationId == "" {
+			log.Warn().Str("networkId", networkId).Msg("network without organization not referenced by the system model")
+			report.Unowned = append(report.Unowned, networkId)
+			continue
+		}
+		if _, cErr := m.ZTClient.Claim(networkId, organizationId); cErr != nil {
+			log.Warn().Str("networkId", networkId).Str("organizationId", organizationId).Str("trace", cErr.DebugReport()).
+				Msg("unable to claim the network")
+			report.Errors++
+			continue
+		}
+		report.Claimed = append(report.Claimed, networkId)
+	}
+	return report, nil
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// CollectedMember with a member removed from the controller by the collector.
+type CollectedMember struct {
+	OrganizationId string
+	NetworkId      string
+	MemberId       string
+	// UnclaimedSince is the time the member was first found without an owner in the system model.
+	UnclaimedSince time.Time
+}
+
+// CollectorReport with the result of a collection.
+type CollectorReport struct {
+	// Timestamp of the collection.
+	Timestamp time.Time
+	// Networks checked.
+	Networks int
+	// Members checked.
+	Members int
+	// Pending are the unclaimed members that are still in their grace period.
+	Pending int
+	// Collected are the members that have been removed.
+	Collected []CollectedMember
+	// Errors found during the collection.
+	Errors int
+	// Unowned are the networks without organization that are not referenced by exactly one organization and the
+	// networks of organizations that are not in the system model, their members are not collected.
+	Unowned []string
+}
+
+// MemberCollector periodically removes from the controller the members that are not claimed by any authorized
+// member or ZT connection in the system model.
+type MemberCollector struct {
+	manager *Manager
+	// interval between collections
+	interval time.Duration
+	// gracePeriod a member must stay unclaimed before being removed
+	gracePeriod time.Duration
+	// unclaimed members (networkId#memberId) and the first time they were found unclaimed
+	unclaimed map[string]time.Time
+}
+
+// NewMemberCollector creates a new collector of stale members.
+func NewMemberCollector(manager *Manager, interval time.Duration, gracePeriod time.Duration) *MemberCollector {
+	return &MemberCollector{
+		manager:     manager,
+		interval:    interval,
+		gracePeriod: gracePeriod,
+		unclaimed:   make(map[string]time.Time, 0),
+	}
+}
+
+// Run launches the periodic collection. This method blocks.
+func (c *MemberCollector) Run() {
+	log.Info().Str("interval", c.interval.String()).Str("gracePeriod", c.gracePeriod.String()).Msg("launching stale member collector")
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		report, err := c.Collect()
+		if err != nil {
+			log.Error().Str("trace", err.DebugReport()).Msg("error collecting stale members")
+			continue
+		}
+		log.Info().Int("networks", report.Networks).Int("members", report.Members).Int("pending", report.Pending).
+			Int("collected", len(report.Collected)).Int("errors", report.Errors).Int("unowned", len(report.Unowned)).Msg("stale member collection finished")
+		for _, collected := range report.Collected {
+			log.Info().Str("organizationId", collected.OrganizationId).Str("networkId", collected.NetworkId).
+				Str("memberId", collected.MemberId).Time("unclaimedSince", collected.UnclaimedSince).
+				Msg("stale member collected")
+		}
+	}
+}
+
+// Collect removes the members that have been unclaimed longer than the grace period. The networks without
+// organization are claimed by the organization whose system model references them, or reported as unowned. The
+// collection is aborted if the system model of any organization cannot be retrieved, as its members would be
+// considered unclaimed.
+func (c *MemberCollector) Collect() (*CollectorReport, derrors.Error) {
+	now := time.Now()
+	report := &CollectorReport{Timestamp: now, Collected: make([]CollectedMember, 0), Unowned: make([]string, 0)}
+
+	networks, failed, err := c.manager.ZTClient.ListAll()
+	if err != nil {
+		return nil, err
+	}
+	report.Errors += len(failed)
+
+	// system model data by organization
+	modelByOrg, err := c.manager.getSystemModel()
+	if err != nil {
+		return nil, err
+	}
+	stillUnclaimed := make(map[string]time.Time, 0)
+
+	ownerless := make([]zt.ZTNetwork, 0)
+	for _, network := range networks {
+		organizationId := network.OrganizationId()
+		if organizationId == "" {
+			ownerless = append(ownerless, network)
+			continue
+		}
+		model, found := modelByOrg[organizationId]
+		if !found {
+			log.Warn().Str("networkId", network.ID).Str("organizationId", organizationId).
+				Msg("network of an organization that is not in the system model")
+			report.Unowned = append(report.Unowned, network.ID)
+			continue
+		}
+		c.collectNetwork(organizationId, network.ID, model.claimed, now, stillUnclaimed, report)
+	}
+
+	for _, network := range ownerless {
+		organizationId := resolveOwner(network.ID, modelByOrg)
+		if organizationId == "" {
+			log.Warn().Str("networkId", network.ID).Msg("network without organization not referenced by the system model")
+			report.Unowned = append(report.Unowned, network.ID)
+			continue
+		}
+		if _, cErr := c.manager.ZTClient.Claim(network.ID, organizationId); cErr != nil {
+			log.Warn().Str("networkId", network.ID).Str("organizationId", organizationId).Str("trace", cErr.DebugReport()).
+				Msg("unable to claim the network")
+			report.Errors++
+			continue
+		}
+		log.Info().Str("networkId", network.ID).Str("organizationId", organizationId).Msg("network without organization claimed")
+		c.collectNetwork(organizationId, network.ID, modelByOrg[organizationId].claimed, now, stillUnclaimed, report)
+	}
+
+	// members that are gone or claimed again are forgotten
+	c.unclaimed = stillUnclaimed
+
+	return report, nil
+}
+
+// resolveOwner returns the only organization whose system model references a network, or an empty string if there
+// is none or there are several.
+func resolveOwner(networkId string, modelByOrg map[string]*organizationModel) string {
+	owner := ""
+	for organizationId, model := range modelByOrg {
+		if !model.networks[networkId] {
+			continue
+		}
+		if owner != "" {
+			return ""
+		}
+		owner = organizationId
+	}
+	return owner
+}
+
+// collectNetwork removes the members of a network that have been unclaimed longer than the grace period.
+func (c *MemberCollector) collectNetwork(organizationId string, networkId string, claimed map[string]bool, now time.Time,
+	stillUnclaimed map[string]time.Time, report *CollectorReport) {
+
+	report.Networks++
+	members, err := c.manager.ZTClient.ListMembers(networkId)
+	if err != nil {
+		log.Warn().Str("networkId", networkId).Str("trace", err.DebugReport()).Msg("unable to list the members of the network")
+		report.Errors++
+		return
+	}
+	for _, member := range members {
+		report.Members++
+		key := memberKey(networkId, member.ID)
+		if claimed[key] {
+			continue
+		}
+		since, found := c.unclaimed[key]
+		if !found {
+			since = now
+		}
+		if now.Sub(since) < c.gracePeriod {
+			stillUnclaimed[key] = since
+			report.Pending++
+			continue
+		}
+		if rErr := c.manager.ZTClient.RemoveMember(organizationId, networkId, member.ID, zt.RemovalReasonStale); rErr != nil {
+			log.Warn().Str("networkId", networkId).Str("memberId", member.ID).Str("trace", rErr.DebugReport()).
+				Msg("unable to remove stale member")
+			stillUnclaimed[key] = since
+			report.Errors++
+			continue
+		}
+		report.Collected = append(report.Collected, CollectedMember{
+			OrganizationId: organizationId,
+			NetworkId:      networkId,
+			MemberId:       member.ID,
+			UnclaimedSince: since,
+		})
+	}
+}
+
+func memberKey(networkId string, memberId string) string {
+	return fmt.Sprintf("%s#%s", networkId, memberId)
+}
@@ -0,0 +1,108 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"context"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-network-go"
+	"github.com/nalej/grpc-network-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/rs/zerolog/log"
+	"regexp"
+	"strings"
+)
+
+// OverlayDomain is the domain of the names of the endpoints of the connections
+const OverlayDomain = "zt"
+
+// invalidLabelChars matches the characters that are not allowed in a DNS label
+var invalidLabelChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// dnsLabel turns a value into a valid DNS label.
+func dnsLabel(value string) string {
+	return strings.Trim(invalidLabelChars.ReplaceAllString(strings.ToLower(value), "-"), "-")
+}
+
+// endpointName returns the name of an endpoint of a connection: <service>.<outbound>.<appInstance>.<organization>.zt.
+// A service joins the connection once per cluster where it is deployed, and each cluster adds an address record to
+// the name.
+func endpointName(serviceName string, outboundName string, appInstanceId string, organizationId string) string {
+	return fmt.Sprintf("%s.%s.%s.%s.%s", dnsLabel(serviceName), dnsLabel(outboundName), dnsLabel(appInstanceId),
+		dnsLabel(organizationId), OverlayDomain)
+}
+
+// getEndpointName returns the name of the endpoint of a connection registered by a member.
+func (m *Manager) getEndpointName(request *grpc_network_go.RegisterZTConnectionRequest) (string, derrors.Error) {
+	serviceName, err := m.getServiceName(request.OrganizationId, request.AppInstanceId, request.ServiceId)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	conn, cErr := m.AppNetClient.GetConnectionByZtNetworkId(ctx, &grpc_application_network_go.ZTNetworkId{
+		OrganizationId: request.OrganizationId,
+		ZtNetworkId:    request.NetworkId,
+	})
+	if cErr != nil {
+		return "", conversions.ToDerror(cErr)
+	}
+	return endpointName(serviceName, conn.OutboundName, request.AppInstanceId, request.OrganizationId), nil
+}
+
+// registerEndpointEntries adds the address record of the endpoint of a connection with the IP registered by its member,
+// and the PTR record of the IP, removing the record of its previous IP. The DNS is not critical for the connection,
+// so the errors are only logged.
+func (m *Manager) registerEndpointEntries(request *grpc_network_go.RegisterZTConnectionRequest, previousIp string) {
+	if m.dnsManager == nil || request.ZtIp == "" {
+		return
+	}
+	if previousIp != "" && previousIp != request.ZtIp {
+		m.deleteReverseEntry(request.OrganizationId, request.NetworkId, previousIp)
+	}
+	name, err := m.getEndpointName(request)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("ztIp", request.ZtIp).Msg("unable to get the name of the connection endpoint")
+		return
+	}
+	serviceGroupId, err := m.getServiceGroupId(request.OrganizationId, request.AppInstanceId, request.ServiceId)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("serviceId", request.ServiceId).Msg("unable to get the service group of the connection endpoint")
+	}
+	err = m.dnsManager.AddEndpointEntry(request.OrganizationId, request.AppInstanceId, serviceGroupId, request.NetworkId,
+		request.ClusterId, name, request.ZtIp)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("name", name).Msg("unable to add the DNS entry of the connection endpoint")
+	}
+	err = m.dnsManager.AddReverseEntry(request.OrganizationId, request.AppInstanceId, serviceGroupId, request.NetworkId, request.ZtIp, name)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("ztIp", request.ZtIp).Msg("unable to add the reverse DNS entry")
+	}
+}
+
+// deleteReverseEntry deletes the PTR record of an overlay IP of a network, the errors are only logged.
+func (m *Manager) deleteReverseEntry(organizationId string, networkId string, ip string) {
+	if m.dnsManager == nil || ip == "" {
+		return
+	}
+	err := m.dnsManager.DeleteReverseEntry(organizationId, networkId, ip)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("ip", ip).Msg("unable to delete the reverse DNS entry")
+	}
+}
@@ -25,6 +25,15 @@ import (
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/nalej/network-manager/internal/pkg/entities"
 	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"strconv"
+)
+
+const (
+	// NetworkErrorsTrailer is the trailer with the number of networks of unknown organization that could not be
+	// retrieved when listing networks
+	NetworkErrorsTrailer = "network-errors"
 )
 
 type Handler struct {
@@ -70,6 +79,23 @@ func (h *Handler) GetNetwork(ctx context.Context, networkID *grpc_network_go.Net
 	return network.ToGRPC(), nil
 }
 
+// UpdateNetwork updates an existing network.
+func (h *Handler) UpdateNetwork(ctx context.Context, updateNetworkRequest *grpc_network_go.UpdateNetworkRequest) (*grpc_network_go.Network, error) {
+	log.Debug().Interface("updateNetworkRequest", updateNetworkRequest).Msg("update network")
+	err := entities.ValidUpdateNetworkRequest(updateNetworkRequest)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	network, err := h.Manager.UpdateNetwork(updateNetworkRequest)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+	log.Debug().Str("networkID", network.NetworkId).Msg("network has been updated")
+
+	return network.ToGRPC(), nil
+}
+
 // DeleteNetwork deletes a network from the system.
 func (h *Handler) DeleteNetwork(ctx context.Context, deleteNetworkRequest *grpc_network_go.DeleteNetworkRequest) (*grpc_common_go.Success, error) {
 	log.Debug().Str("organizationID", deleteNetworkRequest.OrganizationId).
@@ -93,6 +119,10 @@ func (h *Handler) JoinNetwork(ctx context.Context, in *grpc_network_go.NetworkId
 	return nil, nil
 }
 
+// ListNetworks retrieves the networks of an organization. The networks of the organization that cannot be retrieved
+// are reported in the errors of the list instead of failing the request. The number of networks that cannot be
+// retrieved and whose organization is unknown is reported in the NetworkErrorsTrailer trailer, as they may belong
+// to other organizations.
 func (h *Handler) ListNetworks(ctx context.Context, organizationID *grpc_organization_go.OrganizationId) (*grpc_network_go.NetworkList, error) {
 	log.Debug().Str("organizationID", organizationID.OrganizationId).Msg("list networks")
 	err := entities.ValidOrganizationId(organizationID)
@@ -101,18 +131,108 @@ func (h *Handler) ListNetworks(ctx context.Context, organizationID *grpc_organiz
 		return nil, conversions.ToGRPCError(err)
 	}
 
-	networkList, err := h.Manager.ListNetworks(organizationID)
+	networkList, networkErrors, unknown, err := h.Manager.ListNetworks(organizationID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	if unknown > 0 {
+		log.Warn().Int("failed", unknown).Msg("some networks of unknown organization could not be retrieved")
+		tErr := grpc.SetTrailer(ctx, metadata.Pairs(NetworkErrorsTrailer, strconv.Itoa(unknown)))
+		if tErr != nil {
+			log.Warn().Err(tErr).Msg("unable to report the networks that could not be retrieved")
+		}
+	}
 
 	foundNetworks := make([]*grpc_network_go.Network, len(networkList))
 	for i, n := range networkList {
 		foundNetworks[i] = n.ToGRPC()
 	}
 
-	grpcNetworkList := grpc_network_go.NetworkList{Networks: foundNetworks}
+	failedNetworks := make([]*grpc_network_go.NetworkError, len(networkErrors))
+	for i, e := range networkErrors {
+		failedNetworks[i] = e.ToGRPC()
+	}
+
+	grpcNetworkList := grpc_network_go.NetworkList{Networks: foundNetworks, Errors: failedNetworks}
 
 	return &grpcNetworkList, nil
 }
 
+// GetControllerStatus retrieves the health information of the ZeroTier controller.
+func (h *Handler) GetControllerStatus(ctx context.Context, empty *grpc_common_go.Empty) (*grpc_network_go.ControllerStatus, error) {
+	log.Debug().Msg("get controller status")
+
+	status, err := h.Manager.GetControllerStatus()
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	return status.ToGRPC(), nil
+}
+
+// ListMemberRemovals retrieves the members removed from a network, newest first.
+func (h *Handler) ListMemberRemovals(ctx context.Context, networkID *grpc_network_go.NetworkId) (*grpc_network_go.MemberRemovalList, error) {
+	log.Debug().Str("organizationID", networkID.OrganizationId).
+		Str("networkID", networkID.NetworkId).Msg("list member removals")
+	err := entities.ValidNetworkId(networkID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	removalList, err := h.Manager.ListMemberRemovals(networkID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	foundRemovals := make([]*grpc_network_go.MemberRemoval, len(removalList))
+	for i, removal := range removalList {
+		foundRemovals[i] = removal.ToGRPC()
+	}
+
+	return &grpc_network_go.MemberRemovalList{Removals: foundRemovals}, nil
+}
+
+// ListMembers retrieves the members of a network.
+func (h *Handler) ListMembers(ctx context.Context, networkID *grpc_network_go.NetworkId) (*grpc_network_go.NetworkMemberList, error) {
+	log.Debug().Str("organizationID", networkID.OrganizationId).
+		Str("networkID", networkID.NetworkId).Msg("list members")
+	err := entities.ValidNetworkId(networkID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	memberList, err := h.Manager.ListMembers(networkID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	foundMembers := make([]*grpc_network_go.NetworkMember, len(memberList))
+	for i, member := range memberList {
+		foundMembers[i] = member.ToGRPC()
+	}
+
+	return &grpc_network_go.NetworkMemberList{Members: foundMembers}, nil
+}
+
+// GetMember retrieves the information of a member of a network.
+func (h *Handler) GetMember(ctx context.Context, memberID *grpc_network_go.MemberId) (*grpc_network_go.NetworkMember, error) {
+	log.Debug().Str("organizationID", memberID.OrganizationId).
+		Str("networkID", memberID.NetworkId).
+		Str("memberID", memberID.MemberId).Msg("get member")
+	err := entities.ValidMemberId(memberID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	member, err := h.Manager.GetMember(memberID)
+	if err != nil {
+		return nil, conversions.ToGRPCError(err)
+	}
+
+	return member.ToGRPC(), nil
+}
+
 func (h *Handler) AuthorizeMember(ctx context.Context, authorizeMemberRequest *grpc_network_go.AuthorizeMemberRequest) (*grpc_common_go.Success, error) {
 	log.Debug().Str("organizationID", authorizeMemberRequest.OrganizationId).
 		Str("networkID", authorizeMemberRequest.NetworkId).
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import "sync"
+
+// networkLocks serializes the operations on the same network. The static IPs are chosen from the members and the
+// reservations of the network, so two authorizations in the same network must not choose an IP at the same time.
+// The lock of a network is removed once no operation holds it or waits for it.
+type networkLocks struct {
+	sync.Mutex
+	locks map[string]*networkLock
+}
+
+// networkLock with the number of operations holding or waiting for the lock of a network.
+type networkLock struct {
+	sync.Mutex
+	references int
+}
+
+func newNetworkLocks() *networkLocks {
+	return &networkLocks{locks: make(map[string]*networkLock, 0)}
+}
+
+// lock locks a network and returns the function that unlocks it.
+func (l *networkLocks) lock(networkId string) func() {
+	l.Lock()
+	netLock, exists := l.locks[networkId]
+	if !exists {
+		netLock = &networkLock{}
+		l.locks[networkId] = netLock
+	}
+	netLock.references++
+	l.Unlock()
+
+	netLock.Lock()
+	return func() {
+		netLock.Unlock()
+		l.Lock()
+		netLock.references--
+		if netLock.references == 0 {
+			delete(l.locks, networkId)
+		}
+		l.Unlock()
+	}
+}
@@ -30,10 +30,14 @@ import (
 	"github.com/nalej/grpc-organization-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/nalej/network-manager/internal/pkg/entities"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/rules"
+	"github.com/nalej/network-manager/internal/pkg/server/dns"
 	"github.com/nalej/network-manager/internal/pkg/utils"
 	"github.com/nalej/network-manager/internal/pkg/zt"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"net"
 	"strings"
 	"time"
 )
@@ -42,8 +46,6 @@ const (
 	// timeout for queries about network values
 	NetworkQueryTimeout             = time.Second * 10
 	ApplicationManagerTimeout       = time.Second * 3
-	ZTRangeMin                      = "192.168.0.1"
-	ZTRangeMax                      = "192.168.0.254"
 	ApplicationManagerUpdateRetries = 5
 	ApplicationManagerJoinTimeout   = time.Second * 10
 )
@@ -59,10 +61,17 @@ type Manager struct {
 	connHelper *utils.ConnectionsHelper
 	// cluster infrastructure client
 	clusterInfrastructure grpc_infrastructure_go.ClustersClient
+	// allocator of the IP ranges of the networks
+	allocator *ipam.Allocator
+	// DNS manager of the records of the overlay IPs
+	dnsManager *dns.Manager
+	// locks of the networks where static IPs are being allocated
+	ipLocks *networkLocks
 }
 
 // NewManager creates a new manager.
-func NewManager(organizationConn *grpc.ClientConn, ztClient *zt.ZTClient, helper *utils.ConnectionsHelper) (*Manager, error) {
+func NewManager(organizationConn *grpc.ClientConn, ztClient *zt.ZTClient, helper *utils.ConnectionsHelper, allocator *ipam.Allocator,
+	dnsManager *dns.Manager) (*Manager, error) {
 	orgClient := grpc_organization_go.NewOrganizationsClient(organizationConn)
 	appClient := grpc_application_go.NewApplicationsClient(organizationConn)
 	appnetClient := grpc_application_network_go.NewApplicationNetworkClient(organizationConn)
@@ -75,6 +84,9 @@ func NewManager(organizationConn *grpc.ClientConn, ztClient *zt.ZTClient, helper
 		ZTClient:              ztClient,
 		connHelper:            helper,
 		clusterInfrastructure: clusterClient,
+		allocator:             allocator,
+		dnsManager:            dnsManager,
+		ipLocks:               newNetworkLocks(),
 	}, nil
 }
 
@@ -89,14 +101,16 @@ func (m *Manager) AddNetwork(addNetworkRequest *grpc_network_go.AddNetworkReques
 	}
 
 	// Check if application exists
-	_, err = m.ApplicationClient.GetAppInstance(context.Background(), &grpc_application_go.AppInstanceId{
+	appInstance, err := m.ApplicationClient.GetAppInstance(context.Background(), &grpc_application_go.AppInstanceId{
 		OrganizationId: addNetworkRequest.OrganizationId, AppInstanceId: addNetworkRequest.AppInstanceId})
 	if err != nil {
 		return nil, derrors.NewNotFoundError("not found application instance")
 	}
 
-	// use zt client to add network
-	ztNetwork, err := m.ZTClient.Add(addNetworkRequest.Name, addNetworkRequest.OrganizationId, ZTRangeMin, ZTRangeMax)
+	// use zt client to add network with the rules of the application
+	ruleSet := rules.CompileApplicationRules(appInstance)
+	ztNetwork, err := m.ZTClient.Add(addNetworkRequest.Name, addNetworkRequest.OrganizationId,
+		m.allocator.ApplicationRange(addNetworkRequest.OrganizationId), ruleSet)
 
 	if err != nil {
 		return nil, derrors.NewGenericError("Cannot add ZeroTier network", err)
@@ -131,6 +145,13 @@ func (m *Manager) DeleteNetwork(deleteNetworkRequest *grpc_network_go.DeleteNetw
 		return derrors.NewInternalError("impossible to get network id to delete", err)
 	}
 
+	// the system model proves the network belongs to the organization, networks created without organization
+	// are claimed so they can be deleted
+	_, err = m.ZTClient.Claim(ztNetwork.NetworkId, deleteNetworkRequest.OrganizationId)
+	if err != nil {
+		return derrors.NewGenericError("Cannot delete ZeroTier network", err)
+	}
+
 	// Use zt client to delete network
 	err = m.ZTClient.Delete(ztNetwork.NetworkId, deleteNetworkRequest.OrganizationId)
 	if err != nil {
@@ -181,6 +202,190 @@ func (m *Manager) DeleteNetwork(deleteNetworkRequest *grpc_network_go.DeleteNetw
 	return nil
 }
 
+// UpdateNetwork updates an existing network. Application networks must match the network stored for the
+// application instance, and connection networks keep the IP range of the connection up to date.
+func (m *Manager) UpdateNetwork(updateNetworkRequest *grpc_network_go.UpdateNetworkRequest) (*entities.Network, derrors.Error) {
+
+	patch := &zt.ZTNetworkPatch{}
+	if updateNetworkRequest.UpdateName {
+		patch.Name = &updateNetworkRequest.Name
+	}
+	if updateNetworkRequest.UpdateRoutes {
+		patch.Routes = make([]zt.Route, len(updateNetworkRequest.Routes))
+		for i, target := range updateNetworkRequest.Routes {
+			patch.Routes[i] = zt.Route{Target: target}
+		}
+	}
+	if updateNetworkRequest.UpdateIpRanges {
+		patch.IpAssignmentPools = make([]zt.IpAssignmentPool, len(updateNetworkRequest.IpRanges))
+		for i, ipRange := range updateNetworkRequest.IpRanges {
+			pool, err := zt.ParseIpAssignmentPool(ipRange)
+			if err != nil {
+				return nil, err
+			}
+			patch.IpAssignmentPools[i] = *pool
+		}
+	}
+	if updateNetworkRequest.UpdateMulticastLimit {
+		multicastLimit := int(updateNetworkRequest.MulticastLimit)
+		patch.MulticastLimit = &multicastLimit
+	}
+	if updateNetworkRequest.UpdateEnableBroadcast {
+		patch.EnableBroadcast = &updateNetworkRequest.EnableBroadcast
+	}
+
+	var connection *grpc_application_network_go.ConnectionInstance
+	if updateNetworkRequest.AppInstanceId != "" {
+		// application network, check it is the one of the instance
+		ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		defer cancel()
+		appNetwork, err := m.ApplicationClient.GetAppZtNetwork(ctx, &grpc_application_go.GetAppZtNetworkRequest{
+			OrganizationId: updateNetworkRequest.OrganizationId,
+			AppInstanceId:  updateNetworkRequest.AppInstanceId,
+		})
+		if err != nil {
+			return nil, derrors.NewNotFoundError("impossible to find the requested network", err)
+		}
+		if appNetwork.NetworkId != updateNetworkRequest.NetworkId {
+			return nil, derrors.NewFailedPreconditionError(fmt.Sprintf("application network %s does not match %s",
+				appNetwork.NetworkId, updateNetworkRequest.NetworkId))
+		}
+		if updateNetworkRequest.UpdateIpRanges {
+			// the range of the application networks of an organization is assigned by the allocator
+			return nil, derrors.NewFailedPreconditionError("the IP ranges of the application networks cannot be updated").
+				WithParams(updateNetworkRequest.NetworkId)
+		}
+		if updateNetworkRequest.UpdateRules {
+			// recompile the rules from the current application descriptor
+			ctxApp, cancelApp := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+			defer cancelApp()
+			appInstance, err := m.ApplicationClient.GetAppInstance(ctxApp, &grpc_application_go.AppInstanceId{
+				OrganizationId: updateNetworkRequest.OrganizationId,
+				AppInstanceId:  updateNetworkRequest.AppInstanceId,
+			})
+			if err != nil {
+				return nil, derrors.NewNotFoundError("not found application instance", err)
+			}
+			ruleSet := rules.CompileApplicationRules(appInstance)
+			patch.Rules = ruleSet.Rules
+			patch.Tags = ruleSet.Tags
+		}
+	} else {
+		// connection network
+		ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		defer cancel()
+		conn, err := m.AppNetClient.GetConnectionByZtNetworkId(ctx, &grpc_application_network_go.ZTNetworkId{
+			OrganizationId: updateNetworkRequest.OrganizationId,
+			ZtNetworkId:    updateNetworkRequest.NetworkId,
+		})
+		if err != nil {
+			return nil, derrors.NewNotFoundError("impossible to find the connection of the network", err)
+		}
+		connection = conn
+		if updateNetworkRequest.UpdateIpRanges {
+			reserved, rErr := m.reserveConnectionRanges(connection, patch.IpAssignmentPools)
+			if rErr != nil {
+				return nil, rErr
+			}
+			// the ranges are stored in the connection below
+			defer m.releaseRanges(connection.OrganizationId, reserved)
+		}
+	}
+
+	ztNetwork, err := m.ZTClient.Update(updateNetworkRequest.NetworkId, updateNetworkRequest.OrganizationId, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	if connection != nil && updateNetworkRequest.UpdateIpRanges {
+		ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		defer cancel()
+		_, uErr := m.AppNetClient.UpdateConnection(ctx, &grpc_application_network_go.UpdateConnectionRequest{
+			OrganizationId:   connection.OrganizationId,
+			SourceInstanceId: connection.SourceInstanceId,
+			TargetInstanceId: connection.TargetInstanceId,
+			InboundName:      connection.InboundName,
+			OutboundName:     connection.OutboundName,
+			UpdateIpRange:    true,
+			IpRange:          ztNetwork.IpRange(),
+		})
+		if uErr != nil {
+			return nil, derrors.NewUnavailableError("impossible to update the ip range of the connection", uErr)
+		}
+	}
+
+	toReturn := ztNetwork.ToNetwork(updateNetworkRequest.OrganizationId)
+	return &toReturn, nil
+}
+
+// reserveConnectionRanges reserves in the allocator the IPv4 ranges of the new assignment pools of a connection
+// network. They cannot overlap the application networks, the other connections of the instances of the connection,
+// the ranges being allocated or the networks of the clusters where its services are deployed. The reserved ranges
+// must be released once the connection is updated.
+func (m *Manager) reserveConnectionRanges(connection *grpc_application_network_go.ConnectionInstance, pools []zt.IpAssignmentPool) ([]ipam.Range, derrors.Error) {
+	organizationId := connection.OrganizationId
+	ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancel()
+	list, err := m.AppNetClient.ListConnections(ctx, &grpc_organization_go.OrganizationId{OrganizationId: organizationId})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	used := []ipam.Range{m.allocator.ApplicationRange(organizationId)}
+	for _, conn := range list.Connections {
+		if conn.ZtNetworkId == connection.ZtNetworkId || conn.IpRange == "" {
+			continue
+		}
+		if conn.SourceInstanceId == connection.SourceInstanceId || conn.SourceInstanceId == connection.TargetInstanceId ||
+			conn.TargetInstanceId == connection.SourceInstanceId || conn.TargetInstanceId == connection.TargetInstanceId {
+			connRange, rErr := ipam.ParsePool(conn.IpRange)
+			if rErr != nil {
+				return nil, derrors.NewInternalError("incorrect IP range format", rErr).WithParams(conn.IpRange)
+			}
+			used = append(used, *connRange)
+		}
+	}
+
+	ctxMembers, cancelMembers := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancelMembers()
+	members, err := m.AppNetClient.ListZTNetworkConnection(ctxMembers, &grpc_application_network_go.ZTNetworkId{
+		OrganizationId: organizationId,
+		ZtNetworkId:    connection.ZtNetworkId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	clusterIds := make([]string, 0, len(members.Connections))
+	for _, member := range members.Connections {
+		clusterIds = append(clusterIds, member.ClusterId)
+	}
+	excluded := m.connHelper.ExcludedRanges(organizationId, clusterIds, m.allocator, m.clusterInfrastructure)
+
+	reserved := make([]ipam.Range, 0, len(pools))
+	for _, pool := range pools {
+		if first := net.ParseIP(pool.IpRangeStart); first != nil && first.To4() == nil {
+			// the IPv6 pools do not overlap the cluster networks
+			continue
+		}
+		poolRange, rErr := ipam.ParsePool(fmt.Sprintf("%s%s%s", pool.IpRangeStart, ipam.PoolSeparator, pool.IpRangeEnd))
+		if rErr == nil {
+			rErr = m.allocator.Reserve(organizationId, *poolRange, used, excluded)
+		}
+		if rErr != nil {
+			m.releaseRanges(organizationId, reserved)
+			return nil, rErr.WithParams(connection.ZtNetworkId)
+		}
+		reserved = append(reserved, *poolRange)
+	}
+	return reserved, nil
+}
+
+// releaseRanges releases ranges reserved in the allocator
+func (m *Manager) releaseRanges(organizationId string, ranges []ipam.Range) {
+	for _, r := range ranges {
+		m.allocator.Release(organizationId, r)
+	}
+}
+
 // GetNetwork gets an existing network from the system.
 func (m *Manager) GetNetwork(networkId *grpc_network_go.NetworkId) (*entities.Network, derrors.Error) {
 
@@ -192,7 +397,7 @@ func (m *Manager) GetNetwork(networkId *grpc_network_go.NetworkId) (*entities.Ne
 	}
 
 	// use zt client to get network
-	ztNetwork, err := m.ZTClient.Get(networkId.NetworkId)
+	ztNetwork, err := m.ZTClient.GetOrganizationNetwork(networkId.NetworkId, networkId.OrganizationId)
 
 	if err != nil {
 		return nil, derrors.NewGenericError("Cannot get ZeroTier network", err)
@@ -203,20 +408,22 @@ func (m *Manager) GetNetwork(networkId *grpc_network_go.NetworkId) (*entities.Ne
 	return &toReturn, nil
 }
 
-// ListNetworks gets a list of existing networks from an organization.
-func (m *Manager) ListNetworks(organizationId *grpc_organization_go.OrganizationId) ([]entities.Network, derrors.Error) {
+// ListNetworks gets a list of existing networks from an organization. The networks of the controller that cannot
+// be retrieved are skipped. Their organization is unknown, so they are returned as errors only if the system model
+// shows they belong to the organization, and counted otherwise.
+func (m *Manager) ListNetworks(organizationId *grpc_organization_go.OrganizationId) ([]entities.Network, []entities.NetworkError, int, derrors.Error) {
 
 	// Check if organization exists
 	_, err := m.OrganizationClient.GetOrganization(context.Background(),
 		&grpc_organization_go.OrganizationId{OrganizationId: organizationId.OrganizationId})
 	if err != nil {
-		return nil, derrors.NewNotFoundError("invalid organizationID", err)
+		return nil, nil, 0, derrors.NewNotFoundError("invalid organizationID", err)
 	}
 
 	// use zt client to get network
-	ztNetworkList, err := m.ZTClient.List(organizationId.OrganizationId)
+	ztNetworkList, failed, err := m.ZTClient.ListPartial(organizationId.OrganizationId)
 	if err != nil {
-		return nil, derrors.NewGenericError("Cannot get ZeroTier network list", err)
+		return nil, nil, 0, derrors.NewGenericError("Cannot get ZeroTier network list", err)
 	}
 
 	networkList := make([]entities.Network, len(ztNetworkList))
@@ -225,7 +432,115 @@ func (m *Manager) ListNetworks(organizationId *grpc_organization_go.Organization
 		networkList[i] = n.ToNetwork(organizationId.OrganizationId)
 	}
 
-	return networkList, nil
+	networkErrors := make([]entities.NetworkError, 0)
+	if len(failed) == 0 {
+		return networkList, networkErrors, 0, nil
+	}
+	model, mErr := m.getOrganizationModel(organizationId.OrganizationId)
+	if mErr != nil {
+		log.Warn().Str("organizationId", organizationId.OrganizationId).Str("trace", mErr.DebugReport()).
+			Msg("unable to identify the networks that could not be retrieved")
+		return networkList, networkErrors, len(failed), nil
+	}
+	for _, f := range failed {
+		if model.networks[f.NetworkId] {
+			networkErrors = append(networkErrors, entities.NetworkError{NetworkId: f.NetworkId, Error: f.Error.Error()})
+		}
+	}
+
+	return networkList, networkErrors, len(failed) - len(networkErrors), nil
+}
+
+// GetControllerStatus gets the health information of the ZeroTier controller.
+func (m *Manager) GetControllerStatus() (*entities.ControllerStatus, derrors.Error) {
+	status, err := m.ZTClient.GetStatus()
+	if err != nil {
+		return nil, derrors.NewUnavailableError("Cannot get ZeroTier controller status", err)
+	}
+
+	toReturn := status.ToControllerStatus()
+
+	return &toReturn, nil
+}
+
+// ListMemberRemovals gets the members removed from a network, newest first.
+func (m *Manager) ListMemberRemovals(networkId *grpc_network_go.NetworkId) ([]entities.MemberRemoval, derrors.Error) {
+
+	// Check if organization exists
+	_, err := m.OrganizationClient.GetOrganization(context.Background(),
+		&grpc_organization_go.OrganizationId{OrganizationId: networkId.OrganizationId})
+	if err != nil {
+		return nil, derrors.NewNotFoundError("invalid organizationID", err)
+	}
+
+	// the network may have been deleted, the history is filtered by organization
+	removals, hErr := m.ZTClient.MemberRemovals(networkId.OrganizationId, networkId.NetworkId)
+	if hErr != nil {
+		return nil, hErr
+	}
+	removalList := make([]entities.MemberRemoval, len(removals))
+	for i, removal := range removals {
+		removalList[i] = removal.ToMemberRemoval()
+	}
+
+	return removalList, nil
+}
+
+// ListMembers gets the list of members of a network.
+func (m *Manager) ListMembers(networkId *grpc_network_go.NetworkId) ([]entities.NetworkMember, derrors.Error) {
+
+	// Check if organization exists
+	_, err := m.OrganizationClient.GetOrganization(context.Background(),
+		&grpc_organization_go.OrganizationId{OrganizationId: networkId.OrganizationId})
+	if err != nil {
+		return nil, derrors.NewNotFoundError("invalid organizationID", err)
+	}
+
+	// the network must belong to the organization
+	_, err = m.ZTClient.GetOrganizationNetwork(networkId.NetworkId, networkId.OrganizationId)
+	if err != nil {
+		return nil, derrors.NewGenericError("Cannot get ZeroTier network", err)
+	}
+
+	// use zt client to get the members
+	ztMembers, err := m.ZTClient.ListMembers(networkId.NetworkId)
+	if err != nil {
+		return nil, derrors.NewGenericError("Cannot get ZeroTier member list", err)
+	}
+
+	memberList := make([]entities.NetworkMember, len(ztMembers))
+	for i, member := range ztMembers {
+		memberList[i] = member.ToNetworkMember(networkId.OrganizationId)
+	}
+
+	return memberList, nil
+}
+
+// GetMember gets a member of a network.
+func (m *Manager) GetMember(memberId *grpc_network_go.MemberId) (*entities.NetworkMember, derrors.Error) {
+
+	// Check if organization exists
+	_, err := m.OrganizationClient.GetOrganization(context.Background(),
+		&grpc_organization_go.OrganizationId{OrganizationId: memberId.OrganizationId})
+	if err != nil {
+		return nil, derrors.NewNotFoundError("invalid organizationID", err)
+	}
+
+	// the network must belong to the organization
+	_, err = m.ZTClient.GetOrganizationNetwork(memberId.NetworkId, memberId.OrganizationId)
+	if err != nil {
+		return nil, derrors.NewGenericError("Cannot get ZeroTier network", err)
+	}
+
+	// use zt client to get the member
+	ztMember, err := m.ZTClient.GetMember(memberId.NetworkId, memberId.MemberId)
+	if err != nil {
+		return nil, derrors.NewGenericError("Cannot get ZeroTier member", err)
+	}
+
+	toReturn := ztMember.ToNetworkMember(memberId.OrganizationId)
+
+	return &toReturn, nil
 }
 
 // Authorize a member to join a network
@@ -247,7 +562,34 @@ func (m *Manager) AuthorizeMember(authorizeMemberRequest *grpc_network_go.Author
 			net.NetworkId, authorizeMemberRequest.NetworkId))
 	}
 
-	err = m.ZTClient.Authorize(authorizeMemberRequest.NetworkId, authorizeMemberRequest.MemberId)
+	// the member is tagged with its service so the network rules apply to it. If the service cannot be found, the
+	// member is authorized without tag as before the rules existed, and it only reaches the ports open to all the
+	// services of the application.
+	tags := make([]zt.MemberTag, 0, 1)
+	serviceTag, sErr := m.getServiceTag(authorizeMemberRequest.OrganizationId, authorizeMemberRequest.AppInstanceId,
+		authorizeMemberRequest.ServiceApplicationInstanceId)
+	if sErr != nil {
+		log.Warn().Str("appInstanceId", authorizeMemberRequest.AppInstanceId).
+			Str("serviceInstanceId", authorizeMemberRequest.ServiceApplicationInstanceId).Str("trace", sErr.DebugReport()).
+			Msg("service of the member not found, authorizing it without service tag")
+	} else {
+		tags = append(tags, *serviceTag)
+	}
+
+	ztIp := ""
+	if authorizeMemberRequest.StaticIp {
+		// the IP is not reserved until the member is added to the system model
+		unlock := m.ipLocks.lock(authorizeMemberRequest.NetworkId)
+		defer unlock()
+		ip, ipErr := m.getAuthorizedMemberIp(authorizeMemberRequest)
+		if ipErr != nil {
+			return ipErr
+		}
+		ztIp = ip
+		err = m.ZTClient.AuthorizeWithIp(authorizeMemberRequest.NetworkId, authorizeMemberRequest.MemberId, ztIp, tags...)
+	} else {
+		err = m.ZTClient.Authorize(authorizeMemberRequest.NetworkId, authorizeMemberRequest.MemberId, tags...)
+	}
 	if err != nil {
 		return derrors.NewNotFoundError("Unable to authorize member", err)
 	}
@@ -261,6 +603,7 @@ func (m *Manager) AuthorizeMember(authorizeMemberRequest *grpc_network_go.Author
 		NetworkId:                    authorizeMemberRequest.NetworkId,
 		MemberId:                     authorizeMemberRequest.MemberId,
 		IsProxy:                      authorizeMemberRequest.IsProxy,
+		ZtIp:                         ztIp,
 	}
 
 	ctx2, cancel2 := context.WithTimeout(context.Background(), NetworkQueryTimeout)
@@ -273,6 +616,30 @@ func (m *Manager) AuthorizeMember(authorizeMemberRequest *grpc_network_go.Author
 	return nil
 }
 
+// getAuthorizedMemberIp returns the IP already reserved for the service instance of an authorization request in
+// the system model, or a free IP of the network if there is none.
+func (m *Manager) getAuthorizedMemberIp(authorizeMemberRequest *grpc_network_go.AuthorizeMemberRequest) (string, derrors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancel()
+
+	previous, err := m.ApplicationClient.GetAuthorizedZtNetworkMember(ctx, &grpc_application_go.GetAuthorizedZtNetworkMemberRequest{
+		OrganizationId:               authorizeMemberRequest.OrganizationId,
+		ServiceGroupInstanceId:       authorizeMemberRequest.ServiceGroupInstanceId,
+		ServiceApplicationInstanceId: authorizeMemberRequest.ServiceApplicationInstanceId,
+		AppInstanceId:                authorizeMemberRequest.AppInstanceId,
+	})
+	if err == nil {
+		for _, member := range previous.Members {
+			if member.NetworkId == authorizeMemberRequest.NetworkId && member.ZtIp != "" {
+				log.Debug().Str("ip", member.ZtIp).Msg("reusing IP reserved for the service instance")
+				return member.ZtIp, nil
+			}
+		}
+	}
+
+	return m.getFreeIp(authorizeMemberRequest.OrganizationId, authorizeMemberRequest.NetworkId, nil)
+}
+
 // Unauthorize member to join a network
 func (m *Manager) UnauthorizeMember(unauthorizeMemberRequest *grpc_network_go.DisauthorizeMemberRequest) derrors.Error {
 	// Check if there is already a member
@@ -316,7 +683,8 @@ func (m *Manager) UnauthorizeMember(unauthorizeMemberRequest *grpc_network_go.Di
 	for _, serviceMember := range member.Members {
 		log.Debug().Str("networkId", serviceMember.NetworkId).Str("memberId", serviceMember.MemberId).
 			Msg("unauthorize access to ZT member")
-		err = m.ZTClient.Unauthorize(serviceMember.NetworkId, serviceMember.MemberId)
+		m.deleteMemberReverseEntries(serviceMember.OrganizationId, serviceMember.NetworkId, serviceMember.MemberId, serviceMember.ZtIp)
+		err = m.ZTClient.RemoveMember(serviceMember.OrganizationId, serviceMember.NetworkId, serviceMember.MemberId, zt.RemovalReasonUnauthorized)
 		if err != nil {
 			return derrors.NewNotFoundError("impossible to unauthorize member in zt network", err)
 		}
@@ -325,9 +693,34 @@ func (m *Manager) UnauthorizeMember(unauthorizeMemberRequest *grpc_network_go.Di
 	return nil
 }
 
+// deleteMemberReverseEntries deletes the PTR records of the IPs of a member, the reserved one and the ones assigned
+// by the controller.
+func (m *Manager) deleteMemberReverseEntries(organizationId string, networkId string, memberId string, reservedIp string) {
+	if m.dnsManager == nil {
+		return
+	}
+	m.deleteReverseEntry(organizationId, networkId, reservedIp)
+	ztMember, err := m.ZTClient.GetMember(networkId, memberId)
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Str("memberId", memberId).Msg("unable to get the IPs of the member")
+		return
+	}
+	for _, ip := range ztMember.IpAssignments {
+		if ip != reservedIp {
+			m.deleteReverseEntry(organizationId, networkId, ip)
+		}
+	}
+}
+
 // AuthorizeZTConnection message received from ZT-NALEJ to authorize the member in a ZTNetwork
 func (m *Manager) AuthorizeZTConnection(request *grpc_network_go.AuthorizeZTConnectionRequest) derrors.Error {
 
+	if request.StaticIp {
+		// the connections are read under the lock so the IPs reserved meanwhile are not chosen again
+		unlock := m.ipLocks.lock(request.NetworkId)
+		defer unlock()
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
 	defer cancel()
 	// Check if the instance is joined in this zt-network
@@ -339,19 +732,18 @@ func (m *Manager) AuthorizeZTConnection(request *grpc_network_go.AuthorizeZTConn
 		return conversions.ToDerror(err)
 	}
 
-	found := false
-	for _, conn := range list.Connections {
-		if conn.AppInstanceId == request.AppInstanceId {
-			found = true
-		}
-	}
-	if !found {
-		return derrors.NewNotFoundError("instance not found for this zt-network").WithParams(request.AppInstanceId)
+	found, dErr := selectZTConnection(request, list.Connections)
+	if dErr != nil {
+		return dErr
 	}
 
 	// the instance is allowed for this ZT-network
-	// send the authorize request
-	err = m.ZTClient.Authorize(request.NetworkId, request.MemberId)
+	// send the authorize request, the member is tagged with its side so only the inbound exposes its port
+	sideTag := rules.SideTag(found.Side == grpc_application_network_go.ConnectionSide_SIDE_INBOUND)
+	if request.StaticIp {
+		return m.authorizeZTConnectionWithIp(request, found, list.Connections, sideTag)
+	}
+	err = m.ZTClient.Authorize(request.NetworkId, request.MemberId, sideTag)
 	if err != nil {
 		return derrors.NewInternalError("Unable to authorize member", err)
 	}
@@ -361,6 +753,115 @@ func (m *Manager) AuthorizeZTConnection(request *grpc_network_go.AuthorizeZTConn
 	return nil
 }
 
+// selectZTConnection returns the connection of the network joined by the member of an authorization request. The
+// connection the member already belongs to is preferred, then the one of the service and cluster of the request. An
+// application instance may have several connections in the same network, so it only identifies the connection when
+// it is unique.
+func selectZTConnection(request *grpc_network_go.AuthorizeZTConnectionRequest,
+	connections []*grpc_application_network_go.ZTNetworkConnection) (*grpc_application_network_go.ZTNetworkConnection, derrors.Error) {
+
+	candidates := make([]*grpc_application_network_go.ZTNetworkConnection, 0)
+	for _, conn := range connections {
+		if conn.AppInstanceId != request.AppInstanceId {
+			continue
+		}
+		if conn.ZtMember == request.MemberId {
+			return conn, nil
+		}
+		if request.ServiceId != "" && (conn.ServiceId != request.ServiceId || conn.ClusterId != request.ClusterId) {
+			continue
+		}
+		candidates = append(candidates, conn)
+	}
+
+	if len(candidates) == 0 {
+		return nil, derrors.NewNotFoundError("instance not found for this zt-network").WithParams(request.AppInstanceId)
+	}
+	if len(candidates) > 1 {
+		return nil, derrors.NewFailedPreconditionError("the instance has several connections in this zt-network, service and cluster are required").
+			WithParams(request.AppInstanceId, request.NetworkId)
+	}
+	return candidates[0], nil
+}
+
+// authorizeZTConnectionWithIp authorizes the member of a ZT connection with the IP reserved for the connection in
+// the system model. If there is no IP reserved, a free one is chosen from the network range and reserved. The caller
+// holds the lock of the network. The member is tagged with the given side tag.
+func (m *Manager) authorizeZTConnectionWithIp(request *grpc_network_go.AuthorizeZTConnectionRequest,
+	conn *grpc_application_network_go.ZTNetworkConnection, connections []*grpc_application_network_go.ZTNetworkConnection,
+	sideTag zt.MemberTag) derrors.Error {
+
+	ip := conn.ZtIp
+	if ip == "" {
+		reserved := make([]string, 0, len(connections))
+		for _, other := range connections {
+			reserved = append(reserved, other.ZtIp)
+		}
+		freeIp, err := m.getFreeIp(request.OrganizationId, request.NetworkId, reserved)
+		if err != nil {
+			return err
+		}
+		ip = freeIp
+	} else if conn.ZtMember != "" && conn.ZtMember != request.MemberId {
+		// the previous member of the connection is gone, it must not keep the IP
+		log.Debug().Str("memberId", conn.ZtMember).Str("ip", ip).Msg("unauthorize previous member of the connection")
+		err := m.ZTClient.RemoveMember(request.OrganizationId, request.NetworkId, conn.ZtMember, zt.RemovalReasonReplaced)
+		if err != nil {
+			log.Warn().Str("trace", err.DebugReport()).Msg("unable to unauthorize previous member of the connection")
+		}
+	}
+
+	// reserve the IP in the system model
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	_, err := m.AppNetClient.UpdateZTNetworkConnection(ctx, &grpc_application_network_go.UpdateZTNetworkConnectionRequest{
+		OrganizationId: conn.OrganizationId,
+		ZtNetworkId:    conn.ZtNetworkId,
+		AppInstanceId:  conn.AppInstanceId,
+		ServiceId:      conn.ServiceId,
+		ClusterId:      conn.ClusterId,
+		UpdateZtIp:     true,
+		ZtIp:           ip,
+	})
+	if err != nil {
+		return derrors.NewInternalError("Unable to reserve the IP of the connection", err).WithParams(ip)
+	}
+
+	dErr := m.ZTClient.AuthorizeWithIp(request.NetworkId, request.MemberId, ip, sideTag)
+	if dErr != nil {
+		return derrors.NewInternalError("Unable to authorize member", dErr)
+	}
+
+	log.Info().Interface("authorize", request).Str("ip", ip).Msg("Authorization with static IP sent to zt-client")
+
+	return nil
+}
+
+// getFreeIp chooses an IP of a network that is neither assigned to a member nor reserved
+func (m *Manager) getFreeIp(organizationId string, networkId string, reserved []string) (string, derrors.Error) {
+	network, err := m.ZTClient.GetOrganizationNetwork(networkId, organizationId)
+	if err != nil {
+		return "", err
+	}
+	members, err := m.ZTClient.ListMembers(networkId)
+	if err != nil {
+		return "", err
+	}
+
+	used := make(map[string]bool, 0)
+	for _, member := range members {
+		for _, ip := range member.IpAssignments {
+			used[ip] = true
+		}
+	}
+	for _, ip := range reserved {
+		if ip != "" {
+			used[ip] = true
+		}
+	}
+	return network.FreeIp(used)
+}
+
 func (m *Manager) getFQDN(serviceName string, organizationId string, appInstanceId string, outboundName string) string {
 	// replace any space
 	aux := strings.Replace(strings.ToLower(serviceName), " ", "", -1)
@@ -435,6 +936,28 @@ func (m *Manager) getServiceName(organizationId string, appInstanceId string, se
 	return serviceName, nil
 }
 
+// getServiceTag returns the tag of the service of a service instance in the network of its application instance
+func (m *Manager) getServiceTag(organizationId string, appInstanceId string, serviceInstanceId string) (*zt.MemberTag, derrors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
+	defer cancel()
+	instance, err := m.ApplicationClient.GetAppInstance(ctx, &grpc_application_go.AppInstanceId{
+		OrganizationId: organizationId,
+		AppInstanceId:  appInstanceId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	for _, group := range instance.Groups {
+		for _, service := range group.ServiceInstances {
+			if service.ServiceInstanceId == serviceInstanceId {
+				tag := rules.ServiceTag(instance, service.Name)
+				return &tag, nil
+			}
+		}
+	}
+	return nil, derrors.NewNotFoundError("service instance not found in the instance").WithParams(appInstanceId, serviceInstanceId)
+}
+
 // getServiceGroupId returns the serviceGroupId to which the service belongs
 func (m *Manager) getServiceGroupId(organizationID string, applicationId string, serviceID string) (string, derrors.Error) {
 	ctx, cancel := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
@@ -610,11 +1133,22 @@ func (m *Manager) RegisterZTConnection(request *grpc_network_go.RegisterZTConnec
 	ctxList, cancelList := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
 	defer cancelList()
 
+	// list contains the inbound and the outbound appInstanceId
+	// get all the services involved in this connection
+	list, err := m.AppNetClient.ListZTNetworkConnection(ctxList, &grpc_application_network_go.ZTNetworkId{
+		OrganizationId: request.OrganizationId,
+		ZtNetworkId:    request.NetworkId,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("error getting zt-networkConnection")
+		return conversions.ToDerror(err)
+	}
+
 	log.Debug().Interface("request", request).Msg("update zt-networkConnection")
 	ctxUpdate, cancelUpdate := context.WithTimeout(context.Background(), ApplicationManagerTimeout)
 	defer cancelUpdate()
 
-	_, err := m.AppNetClient.UpdateZTNetworkConnection(ctxUpdate, &grpc_application_network_go.UpdateZTNetworkConnectionRequest{
+	_, err = m.AppNetClient.UpdateZTNetworkConnection(ctxUpdate, &grpc_application_network_go.UpdateZTNetworkConnectionRequest{
 		OrganizationId: request.OrganizationId,
 		ZtNetworkId:    request.NetworkId,
 		AppInstanceId:  request.AppInstanceId,
@@ -629,22 +1163,21 @@ func (m *Manager) RegisterZTConnection(request *grpc_network_go.RegisterZTConnec
 		log.Error().Err(err).Interface("request", request).Msg("error updating ztIp in the inbound")
 	}
 
-	// list contains the inbound and the outbound appInstanceId
-	// get all the services involved in this connection
-	list, err := m.AppNetClient.ListZTNetworkConnection(ctxList, &grpc_application_network_go.ZTNetworkId{
-		OrganizationId: request.OrganizationId,
-		ZtNetworkId:    request.NetworkId,
-	})
-	if err != nil {
-		log.Error().Err(err).Msg("error getting zt-networkConnection")
-		return conversions.ToDerror(err)
-	}
 	outboundList := make([]*grpc_application_network_go.ZTNetworkConnection, 0)
 	inboundList := make([]*grpc_application_network_go.ZTNetworkConnection, 0)
 
 	allConnected := true
+	// a previous member of the requester registered the same IP (static IP), the outbounds already have the route
+	unchanged := false
+	previousIp := ""
 
 	for _, conn := range list.Connections {
+		if conn.AppInstanceId == request.AppInstanceId && conn.ServiceId == request.ServiceId && conn.ClusterId == request.ClusterId {
+			unchanged = conn.ZtIp == request.ZtIp && conn.ZtMember != "" && conn.ZtMember != request.MemberId
+			previousIp = conn.ZtIp
+			conn.ZtIp = request.ZtIp
+			conn.ZtMember = request.MemberId
+		}
 		if conn.Side == grpc_application_network_go.ConnectionSide_SIDE_OUTBOUND {
 			outboundList = append(outboundList, conn)
 		} else {
@@ -656,7 +1189,13 @@ func (m *Manager) RegisterZTConnection(request *grpc_network_go.RegisterZTConnec
 		}
 	}
 
+	m.registerEndpointEntries(request, previousIp)
+
 	if request.IsInbound {
+		if unchanged {
+			log.Debug().Str("ztIp", request.ZtIp).Msg("inbound IP has not changed, routes are not updated")
+			return nil
+		}
 		// send to all the outbound pods a message to add the new route
 		return m.sendUpdateRouteToOutbounds(request, outboundList, allConnected)
 	}
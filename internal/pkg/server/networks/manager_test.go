@@ -0,0 +1,300 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-network-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/rules"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"google.golang.org/grpc"
+)
+
+// organizationsClient is a fake of the system model client of the organizations that knows a single organization.
+type organizationsClient struct {
+	grpc_organization_go.OrganizationsClient
+	organizationId string
+}
+
+func (c *organizationsClient) GetOrganization(ctx context.Context, in *grpc_organization_go.OrganizationId, opts ...grpc.CallOption) (*grpc_organization_go.Organization, error) {
+	if in.OrganizationId != c.organizationId {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("organization not found").WithParams(in.OrganizationId))
+	}
+	return &grpc_organization_go.Organization{OrganizationId: c.organizationId}, nil
+}
+
+// applicationsClient is a fake of the system model client of the applications. It keeps the application
+// instances, their networks and their authorized members in memory.
+type applicationsClient struct {
+	grpc_application_go.ApplicationsClient
+	// application instances indexed by identifier
+	instances map[string]*grpc_application_go.AppInstance
+	// networks indexed by application instance
+	networks map[string]string
+	// authorized members indexed by service instance
+	members map[string]*grpc_application_go.ZtNetworkMember
+}
+
+func newApplicationsClient(instances ...*grpc_application_go.AppInstance) *applicationsClient {
+	client := &applicationsClient{
+		instances: make(map[string]*grpc_application_go.AppInstance, 0),
+		networks:  make(map[string]string, 0),
+		members:   make(map[string]*grpc_application_go.ZtNetworkMember, 0),
+	}
+	for _, instance := range instances {
+		client.instances[instance.AppInstanceId] = instance
+	}
+	return client
+}
+
+func (c *applicationsClient) GetAppInstance(ctx context.Context, in *grpc_application_go.AppInstanceId, opts ...grpc.CallOption) (*grpc_application_go.AppInstance, error) {
+	instance, found := c.instances[in.AppInstanceId]
+	if !found || instance.OrganizationId != in.OrganizationId {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("application instance not found").WithParams(in.AppInstanceId))
+	}
+	return instance, nil
+}
+
+func (c *applicationsClient) AddAppZtNetwork(ctx context.Context, in *grpc_application_go.AddAppZtNetworkRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	c.networks[in.AppInstanceId] = in.NetworkId
+	return &grpc_common_go.Success{}, nil
+}
+
+func (c *applicationsClient) GetAppZtNetwork(ctx context.Context, in *grpc_application_go.GetAppZtNetworkRequest, opts ...grpc.CallOption) (*grpc_application_go.AppZtNetwork, error) {
+	networkId, found := c.networks[in.AppInstanceId]
+	if !found {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("application network not found").WithParams(in.AppInstanceId))
+	}
+	return &grpc_application_go.AppZtNetwork{OrganizationId: in.OrganizationId, AppInstanceId: in.AppInstanceId, NetworkId: networkId}, nil
+}
+
+func (c *applicationsClient) AddAuthorizedZtNetworkMember(ctx context.Context, in *grpc_application_go.AddAuthorizedZtNetworkMemberRequest, opts ...grpc.CallOption) (*grpc_application_go.ZtNetworkMember, error) {
+	member := &grpc_application_go.ZtNetworkMember{
+		OrganizationId:               in.OrganizationId,
+		AppInstanceId:                in.AppInstanceId,
+		ServiceGroupInstanceId:       in.ServiceGroupInstanceId,
+		ServiceApplicationInstanceId: in.ServiceApplicationInstanceId,
+		NetworkId:                    in.NetworkId,
+		MemberId:                     in.MemberId,
+		IsProxy:                      in.IsProxy,
+		ZtIp:                         in.ZtIp,
+	}
+	c.members[in.ServiceApplicationInstanceId] = member
+	return member, nil
+}
+
+func (c *applicationsClient) GetAuthorizedZtNetworkMember(ctx context.Context, in *grpc_application_go.GetAuthorizedZtNetworkMemberRequest, opts ...grpc.CallOption) (*grpc_application_go.ZtNetworkMembers, error) {
+	member, found := c.members[in.ServiceApplicationInstanceId]
+	if !found {
+		return nil, conversions.ToGRPCError(derrors.NewNotFoundError("member not found").WithParams(in.ServiceApplicationInstanceId))
+	}
+	return &grpc_application_go.ZtNetworkMembers{Members: []*grpc_application_go.ZtNetworkMember{member}}, nil
+}
+
+func (c *applicationsClient) RemoveAuthorizedZtNetworkMember(ctx context.Context, in *grpc_application_go.RemoveAuthorizedZtNetworkMemberRequest, opts ...grpc.CallOption) (*grpc_common_go.Success, error) {
+	delete(c.members, in.ServiceApplicationInstanceId)
+	return &grpc_common_go.Success{}, nil
+}
+
+// testInstance returns an application instance where the web service reaches the port of the database.
+func testInstance() *grpc_application_go.AppInstance {
+	return &grpc_application_go.AppInstance{
+		OrganizationId: "org1",
+		AppInstanceId:  "app1",
+		Groups: []*grpc_application_go.ServiceGroupInstance{
+			{
+				ServiceGroupId:         "group1",
+				ServiceGroupInstanceId: "groupInstance1",
+				ServiceInstances: []*grpc_application_go.ServiceInstance{
+					{ServiceId: "web", ServiceInstanceId: "webInstance", Name: "web"},
+					{ServiceId: "db", ServiceInstanceId: "dbInstance", Name: "db"},
+				},
+			},
+		},
+		Rules: []*grpc_application_go.SecurityRule{
+			{RuleId: "r1", TargetServiceName: "db", TargetPort: 5432, Access: grpc_application_go.PortAccess_APP_SERVICES,
+				AuthServices: []string{"web"}},
+		},
+	}
+}
+
+var _ = ginkgo.Describe("Networks manager", func() {
+
+	var applications *applicationsClient
+	var client *zt.ZTClient
+	var manager *Manager
+
+	ginkgo.BeforeEach(func() {
+		controller.Clear()
+		var err derrors.Error
+		client, err = zt.NewZTClient(controller.URL(), testAccessToken)
+		gomega.Expect(err).To(gomega.Succeed())
+		config, err := ipam.NewConfig(ipam.DefaultSupernet, ipam.DefaultPrefixLength)
+		gomega.Expect(err).To(gomega.Succeed())
+		applications = newApplicationsClient(testInstance())
+		manager = &Manager{
+			OrganizationClient: &organizationsClient{organizationId: "org1"},
+			ApplicationClient:  applications,
+			ZTClient:           client,
+			allocator:          ipam.NewAllocator(*config, nil, nil),
+			ipLocks:            newNetworkLocks(),
+		}
+	})
+
+	// addNetwork adds the network of the test application instance.
+	addNetwork := func() string {
+		added, err := manager.AddNetwork(&grpc_network_go.AddNetworkRequest{
+			OrganizationId: "org1",
+			AppInstanceId:  "app1",
+			Name:           "network",
+		})
+		gomega.Expect(err).To(gomega.Succeed())
+		return added.NetworkId
+	}
+
+	// authorize authorizes the member of a service instance of the test application instance.
+	authorize := func(networkId string, serviceInstanceId string, memberId string, staticIp bool) derrors.Error {
+		return manager.AuthorizeMember(&grpc_network_go.AuthorizeMemberRequest{
+			OrganizationId:               "org1",
+			AppInstanceId:                "app1",
+			ServiceGroupInstanceId:       "groupInstance1",
+			ServiceApplicationInstanceId: serviceInstanceId,
+			NetworkId:                    networkId,
+			MemberId:                     memberId,
+			StaticIp:                     staticIp,
+		})
+	}
+
+	ginkgo.Context("adding networks", func() {
+
+		ginkgo.It("should add the network of an application instance with its rules", func() {
+			networkId := addNetwork()
+			gomega.Expect(applications.networks["app1"]).To(gomega.Equal(networkId))
+
+			network, err := client.GetOrganizationNetwork(networkId, "org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(network.IpRange()).To(gomega.Equal("192.168.0.1-192.168.0.254"))
+			gomega.Expect(network.Rules).NotTo(gomega.BeEmpty())
+		})
+
+		ginkgo.It("should not add a network of a missing application instance", func() {
+			_, err := manager.AddNetwork(&grpc_network_go.AddNetworkRequest{
+				OrganizationId: "org1",
+				AppInstanceId:  "missing",
+				Name:           "network",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.NotFound))
+
+			networks, err := client.List("org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(networks).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("authorizing members", func() {
+
+		var networkId string
+
+		ginkgo.BeforeEach(func() {
+			networkId = addNetwork()
+		})
+
+		ginkgo.It("should authorize a member tagged with its service", func() {
+			gomega.Expect(authorize(networkId, "webInstance", "a1b2c3d4e5", false)).To(gomega.Succeed())
+
+			member, err := client.GetMember(networkId, "a1b2c3d4e5")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*member.Authorized).To(gomega.BeTrue())
+			tag := rules.ServiceTag(testInstance(), "web")
+			gomega.Expect(member.Tags).To(gomega.ContainElement([]uint32{rules.ServiceTagId, tag.Value}))
+			gomega.Expect(applications.members).To(gomega.HaveKey("webInstance"))
+			gomega.Expect(applications.members["webInstance"].MemberId).To(gomega.Equal("a1b2c3d4e5"))
+		})
+
+		ginkgo.It("should reserve a different static IP for each member", func() {
+			gomega.Expect(authorize(networkId, "webInstance", "a1b2c3d4e5", true)).To(gomega.Succeed())
+			gomega.Expect(authorize(networkId, "dbInstance", "f6a7b8c9d0", true)).To(gomega.Succeed())
+
+			webIp := applications.members["webInstance"].ZtIp
+			dbIp := applications.members["dbInstance"].ZtIp
+			gomega.Expect(webIp).NotTo(gomega.BeEmpty())
+			gomega.Expect(dbIp).NotTo(gomega.BeEmpty())
+			gomega.Expect(webIp).NotTo(gomega.Equal(dbIp))
+			member, err := client.GetMember(networkId, "a1b2c3d4e5")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(member.IpAssignments).To(gomega.Equal([]string{webIp}))
+		})
+
+		ginkgo.It("should not authorize a member in another network", func() {
+			other, err := client.Add("other", "org1", manager.allocator.ApplicationRange("org1"), nil)
+			gomega.Expect(err).To(gomega.Succeed())
+
+			err = authorize(other.ID, "webInstance", "a1b2c3d4e5", false)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.FailedPrecondition))
+			members, err := client.ListMembers(other.ID)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(members).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("unauthorizing members", func() {
+
+		ginkgo.It("should remove the member from the network and the system model", func() {
+			networkId := addNetwork()
+			gomega.Expect(authorize(networkId, "webInstance", "a1b2c3d4e5", false)).To(gomega.Succeed())
+
+			err := manager.UnauthorizeMember(&grpc_network_go.DisauthorizeMemberRequest{
+				OrganizationId:               "org1",
+				AppInstanceId:                "app1",
+				ServiceGroupInstanceId:       "groupInstance1",
+				ServiceApplicationInstanceId: "webInstance",
+			})
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(applications.members).To(gomega.BeEmpty())
+
+			members, err := client.ListMembers(networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(members).To(gomega.BeEmpty())
+			removals, err := client.MemberRemovals("org1", networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removals).To(gomega.HaveLen(1))
+			gomega.Expect(removals[0].Reason).To(gomega.Equal(zt.RemovalReasonUnauthorized))
+		})
+
+		ginkgo.It("should fail if the member was not authorized", func() {
+			err := manager.UnauthorizeMember(&grpc_network_go.DisauthorizeMemberRequest{
+				OrganizationId:               "org1",
+				AppInstanceId:                "app1",
+				ServiceGroupInstanceId:       "groupInstance1",
+				ServiceApplicationInstanceId: "webInstance",
+			})
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.NotFound))
+		})
+	})
+})
@@ -0,0 +1,147 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"context"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-application-go"
+	"github.com/nalej/grpc-application-network-go"
+	"github.com/nalej/grpc-common-go"
+	"github.com/nalej/grpc-organization-go"
+	"github.com/nalej/grpc-utils/pkg/conversions"
+)
+
+// organizationModel with the networks and members of an organization stored in the system model.
+type organizationModel struct {
+	// networks of the applications and connections
+	networks map[string]bool
+	// members (networkId#memberId) authorized in an application network or joined to a ZT connection
+	claimed map[string]bool
+}
+
+// getOrganizationModel returns the networks and members of an organization stored in the system model, either
+// as authorized members of an application network or as members of a ZT connection.
+func (m *Manager) getOrganizationModel(organizationId string) (*organizationModel, derrors.Error) {
+	claimed := make(map[string]bool, 0)
+	networks := make(map[string]bool, 0)
+
+	// application networks
+	ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancel()
+	instances, err := m.ApplicationClient.ListAppInstances(ctx, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	for _, instance := range instances.Instances {
+		ctxNet, cancelNet := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		network, err := m.ApplicationClient.GetAppZtNetwork(ctxNet, &grpc_application_go.GetAppZtNetworkRequest{
+			OrganizationId: organizationId,
+			AppInstanceId:  instance.AppInstanceId,
+		})
+		cancelNet()
+		if err != nil {
+			dErr := conversions.ToDerror(err)
+			if dErr.Type() == derrors.NotFound {
+				// the instance has no network yet
+				continue
+			}
+			return nil, dErr
+		}
+		networks[network.NetworkId] = true
+		ctxMembers, cancelMembers := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		members, err := m.ApplicationClient.ListAuthorizedZTNetworkMembers(ctxMembers, &grpc_application_go.ListAuthorizedZtNetworkMemberRequest{
+			OrganizationId: organizationId,
+			AppInstanceId:  instance.AppInstanceId,
+			ZtNetworkId:    network.NetworkId,
+		})
+		cancelMembers()
+		if err != nil {
+			return nil, conversions.ToDerror(err)
+		}
+		for _, member := range members.Members {
+			claimed[memberKey(member.NetworkId, member.MemberId)] = true
+		}
+	}
+
+	// connection networks
+	ctxConn, cancelConn := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancelConn()
+	connections, err := m.AppNetClient.ListConnections(ctxConn, &grpc_organization_go.OrganizationId{
+		OrganizationId: organizationId,
+	})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	for _, connection := range connections.Connections {
+		if connection.ZtNetworkId == "" {
+			continue
+		}
+		networks[connection.ZtNetworkId] = true
+		ctxZt, cancelZt := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+		ztConnections, err := m.AppNetClient.ListZTNetworkConnection(ctxZt, &grpc_application_network_go.ZTNetworkId{
+			OrganizationId: organizationId,
+			ZtNetworkId:    connection.ZtNetworkId,
+		})
+		cancelZt()
+		if err != nil {
+			return nil, conversions.ToDerror(err)
+		}
+		for _, ztConnection := range ztConnections.Connections {
+			if ztConnection.ZtMember != "" {
+				claimed[memberKey(ztConnection.ZtNetworkId, ztConnection.ZtMember)] = true
+			}
+		}
+	}
+
+	return &organizationModel{networks: networks, claimed: claimed}, nil
+}
+
+// listOrganizationIds returns the identifiers of all the organizations of the system model.
+func (m *Manager) listOrganizationIds() ([]string, derrors.Error) {
+	ctx, cancel := context.WithTimeout(context.Background(), NetworkQueryTimeout)
+	defer cancel()
+	list, err := m.OrganizationClient.ListOrganizations(ctx, &grpc_common_go.Empty{})
+	if err != nil {
+		return nil, conversions.ToDerror(err)
+	}
+	organizationIds := make([]string, 0, len(list.Organizations))
+	for _, organization := range list.Organizations {
+		organizationIds = append(organizationIds, organization.OrganizationId)
+	}
+	return organizationIds, nil
+}
+
+// getSystemModel returns the networks and members of all the organizations of the system model.
+func (m *Manager) getSystemModel() (map[string]*organizationModel, derrors.Error) {
+	organizationIds, err := m.listOrganizationIds()
+	if err != nil {
+		return nil, err
+	}
+	modelByOrg := make(map[string]*organizationModel, len(organizationIds))
+	for _, organizationId := range organizationIds {
+		model, err := m.getOrganizationModel(organizationId)
+		if err != nil {
+			return nil, err
+		}
+		modelByOrg[organizationId] = model
+	}
+	return modelByOrg, nil
+}
@@ -0,0 +1,43 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package networks
+
+import (
+	"github.com/nalej/network-manager/internal/pkg/zt/zttest"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"testing"
+)
+
+const testAccessToken = "testAccessToken"
+
+// controller shared by the specs of the suite, cleared before each spec
+var controller *zttest.MockupController
+
+var _ = ginkgo.BeforeSuite(func() {
+	controller = zttest.NewMockupController(testAccessToken)
+})
+
+var _ = ginkgo.AfterSuite(func() {
+	controller.Close()
+})
+
+func TestNetworksPackage(t *testing.T) {
+	gomega.RegisterFailHandler(ginkgo.Fail)
+	ginkgo.RunSpecs(t, "Networks package suite")
+}
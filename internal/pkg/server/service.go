@@ -23,8 +23,11 @@ import (
 	"github.com/nalej/grpc-utils/pkg/tools"
 	"github.com/nalej/nalej-bus/pkg/bus/pulsar-comcast"
 	"github.com/nalej/nalej-bus/pkg/queue/application/events"
+	appops "github.com/nalej/nalej-bus/pkg/queue/application/ops"
 	"github.com/nalej/nalej-bus/pkg/queue/network/ops"
 	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/dnsserver"
+	dnsprovider "github.com/nalej/network-manager/internal/pkg/provider/dns"
 	"github.com/nalej/network-manager/internal/pkg/queue"
 	"github.com/nalej/network-manager/internal/pkg/server/application"
 	"github.com/nalej/network-manager/internal/pkg/server/dns"
@@ -65,6 +68,16 @@ func (s *Service) Launch() {
 		return
 	}
 
+	if s.Configuration.ZTMockup {
+		url, stop, mErr := launchZTMockup(s.Configuration.ZTAccessToken)
+		if mErr != nil {
+			log.Fatal().Str("trace", mErr.DebugReport()).Msg("impossible to launch the in-memory ZT controller")
+		}
+		defer stop()
+		s.Configuration.ZTUrl = url
+		log.Warn().Str("ZTUrl", s.Configuration.ZTUrl).Msg("using in-memory ZT controller, networks will be lost on exit")
+	}
+
 	// Create ZTClient
 	ztClient, err := zt.NewZTClient(s.Configuration.ZTUrl, s.Configuration.ZTAccessToken)
 
@@ -72,42 +85,97 @@ func (s *Service) Launch() {
 		log.Error().Err(err).Str("ZTUrl", s.Configuration.ZTAccessToken).Msg("impossible to create network for url")
 		return
 	}
+	if s.Configuration.ZTIPv6Mode != "" {
+		err = ztClient.EnableIPv6(s.Configuration.ZTIPv6Mode)
+		if err != nil {
+			log.Fatal().Err(err).Msg("impossible to enable dual-stack networks")
+		}
+	}
+	err = ztClient.SetListWorkers(s.Configuration.ZTListWorkers)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid number of ZT list workers")
+	}
 
-	// Instantiate network manager
-	netManager, err := networks.NewManager(smConn, ztClient, s.ConnHelper)
+	// Create the allocator of IP ranges, the configuration has already been validated
+	allocator, err := s.Configuration.NewAllocator()
 	if err != nil {
-		log.Fatal().Msg("failed creating network manager")
-		return
+		log.Fatal().Err(err).Msg("invalid IPAM configuration")
 	}
-	netHandler := networks.NewHandler(*netManager)
 
 	// Instantiate DNS manager
-	consulClient, err := consul.NewConsulClient(s.Configuration.DNSUrl)
+	var dnsProvider dnsprovider.Provider
+	if s.Configuration.DNSProvider == dnsprovider.MemoryBackend {
+		log.Warn().Msg("using in-memory DNS provider, entries and member removals will be lost on exit")
+		dnsProvider = dnsprovider.NewMockupDNSEntryProvider()
+	} else {
+		consulClient, err := consul.NewConsulClient(s.Configuration.ConsulConfig())
+		if err != nil {
+			log.Fatal().Msg("failed creating dns consul client")
+			return
+		}
+		dnsProvider = dnsprovider.NewConsulProvider(consulClient)
+		// the member removals are kept with the DNS entries
+		ztClient.SetMemberHistory(consul.NewMemberHistory(consulClient, zt.DefaultMemberHistorySize))
+	}
+
+	if s.Configuration.DNSServerAddress != "" {
+		dnsServer := dnsserver.NewServer(dnsProvider, s.Configuration.DNSServerDomain, uint32(s.Configuration.DNSServerTTL.Seconds()))
+		defer dnsServer.Shutdown()
+		go func() {
+			if err := dnsServer.Run(s.Configuration.DNSServerAddress); err != nil {
+				log.Fatal().Str("trace", err.DebugReport()).Msg("DNS server failed")
+			}
+		}()
+	}
+
+	dnsManager, err := dns.NewManager(dnsProvider)
 	if err != nil {
-		log.Fatal().Msg("failed creating dns consul client")
+		log.Fatal().Msg("failed creating dns manager")
 		return
 	}
 
-	dnsManager, err := dns.NewManager(consulClient)
+	// Instantiate network manager
+	netManager, err := networks.NewManager(smConn, ztClient, s.ConnHelper, allocator, dnsManager)
 	if err != nil {
-		log.Fatal().Msg("failed creating dns manager")
+		log.Fatal().Msg("failed creating network manager")
 		return
 	}
+	netHandler := networks.NewHandler(*netManager)
+
+	// networks created without organization are claimed from the system model before they are served
+	claimReport, cErr := netManager.ClaimNetworks()
+	if cErr != nil {
+		log.Error().Str("trace", cErr.DebugReport()).Msg("impossible to claim the networks without organization")
+	} else {
+		log.Info().Int("claimed", len(claimReport.Claimed)).Int("unowned", len(claimReport.Unowned)).
+			Int("errors", claimReport.Errors).Msg("networks without organization claimed")
+	}
+
+	if s.Configuration.ZTMemberGCInterval > 0 {
+		collector := networks.NewMemberCollector(netManager, s.Configuration.ZTMemberGCInterval, s.Configuration.ZTMemberGCGracePeriod)
+		go collector.Run()
+	}
 
 	dnsHandler := dns.NewHandler(*dnsManager)
 
 	// ServiceDNS
-	servDNSManager := servicedns.NewManager(consulClient)
+	servDNSManager := servicedns.NewManager(dnsProvider)
 	servDNSHandler := servicedns.NewHandler(servDNSManager)
 
 	// Service Net application
-	netAppManager, err := application.NewManager(smConn, s.ConnHelper, ztClient)
+	netAppManager, err := application.NewManager(smConn, s.ConnHelper, ztClient, allocator, dnsManager)
 	if err != nil {
 		log.Fatal().Msg("failed creating netapp manager")
 		return
 	}
 	servNetAppHandler := application.NewHandler(*netAppManager)
 
+	if s.Configuration.IPAMReconcileInterval > 0 {
+		reconciler := application.NewRangeReconciler(netAppManager, s.Configuration.IPAMReconcileInterval,
+			s.Configuration.IPAMReconcileGracePeriod, s.Configuration.IPAMReconcileFix)
+		go reconciler.Run()
+	}
+
 	// Queue manager
 	log.Info().Str("queueURL", s.Configuration.QueueAddress).Msg("instantiate message queue")
 	pulsarclient := pulsar_comcast.NewClient(s.Configuration.QueueAddress, nil)
@@ -139,6 +207,19 @@ func (s *Service) Launch() {
 	appEventsQueue.Run()
 	log.Info().Msg("initialize application events manager done")
 
+	// application ops consumer, the undeploy requests remove the DNS entries of the application instances
+	log.Info().Msg("initialize application ops manager")
+	appOpsConfig := appops.NewConfigApplicationOpsConsumer(1, appops.ConsumableStructsApplicationOpsConsumer{
+		UndeployRequest: true,
+	})
+	appOpsConsumer, err := appops.NewApplicationOpsConsumer(pulsarclient, "network-manager-application-ops", true, appOpsConfig)
+	if err != nil {
+		log.Panic().Err(err).Msg("impossible to initialize application ops manager")
+	}
+	appOpsQueue := queue.NewAppOpsHandler(dnsManager, appOpsConsumer)
+	appOpsQueue.Run()
+	log.Info().Msg("initialize application ops manager done")
+
 	// gRPC Service
 	grpcServer := grpc.NewServer()
 	grpc_network_go.RegisterNetworksServer(grpcServer, netHandler)
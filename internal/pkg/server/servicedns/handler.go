@@ -20,7 +20,6 @@ package servicedns
 import (
 	"github.com/nalej/grpc-common-go"
 	"github.com/nalej/grpc-network-go"
-	"github.com/nalej/grpc-organization-go"
 	"github.com/nalej/grpc-utils/pkg/conversions"
 	"github.com/nalej/network-manager/internal/pkg/entities"
 	"github.com/rs/zerolog/log"
@@ -61,16 +60,18 @@ func (h *Handler) DeleteEntry(ctx context.Context, request *grpc_network_go.Dele
 	return &grpc_common_go.Success{}, nil
 }
 
-func (h *Handler) ListEntries(ctx context.Context, request *grpc_organization_go.OrganizationId) (*grpc_network_go.ServiceDNSEntryList, error) {
-	vErr := entities.ValidOrganizationId(request)
+func (h *Handler) ListEntries(ctx context.Context, request *grpc_network_go.ListServiceDNSEntriesRequest) (*grpc_network_go.ServiceDNSEntryList, error) {
+	vErr := entities.ValidListServiceDNSEntriesRequest(request)
 	if vErr != nil {
 		return nil, conversions.ToGRPCError(vErr)
 	}
-	list, err := h.Manager.ListEntries(request)
+	log.Debug().Str("organization_id", request.OrganizationId).Str("page_token", request.PageToken).Int32("page_size", request.PageSize).Msg("List service DNS entries")
+	list, next, err := h.Manager.ListEntries(request)
 	if err != nil {
 		return nil, conversions.ToGRPCError(err)
 	}
 	return &grpc_network_go.ServiceDNSEntryList{
-		Entries: list,
+		Entries:       list,
+		NextPageToken: next,
 	}, nil
 }
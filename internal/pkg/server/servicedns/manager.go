@@ -20,30 +20,66 @@ package servicedns
 import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/grpc-network-go"
-	"github.com/nalej/grpc-organization-go"
-	"github.com/nalej/network-manager/internal/pkg/consul"
+	"github.com/nalej/network-manager/internal/pkg/entities"
+	"github.com/nalej/network-manager/internal/pkg/provider/dns"
+)
+
+const (
+	// DefaultPageSize is the number of entries listed when the request does not set a page size
+	DefaultPageSize = 100
+	// MaxPageSize is the maximum number of entries listed in a page
+	MaxPageSize = 1000
 )
 
 type Manager struct {
-	client consul.ConsulClient
+	provider dns.Provider
 }
 
-func NewManager(consulClient *consul.ConsulClient) Manager {
+func NewManager(provider dns.Provider) Manager {
 	return Manager{
-		client: *consulClient,
+		provider: provider,
 	}
 }
 
+// AddEntry adds an entry of an organization. The target of an alias must be an entry of the organization.
 func (m *Manager) AddEntry(request *grpc_network_go.AddServiceDNSEntryRequest) derrors.Error {
-	err := m.client.AddGenericEntry(request.OrganizationId, request.Fqdn, request.Ip, request.Tags...)
+	entry := entities.DNSEntryFromServiceGRPC(request)
+	if entry.IsAlias() {
+		existing, err := m.provider.List(request.OrganizationId)
+		if err != nil {
+			return err
+		}
+		err = entities.ValidAlias(entry, existing)
+		if err != nil {
+			return err
+		}
+	}
+	err := m.provider.AddGeneric(entry)
 	return err
 }
 
 func (m *Manager) DeleteEntry(request *grpc_network_go.DeleteServiceDNSEntryRequest) derrors.Error {
-	err := m.client.DeleteGenericEntry(request.OrganizationId, request.Fqdn)
+	err := m.provider.DeleteGeneric(request.OrganizationId, request.Fqdn)
 	return err
 }
 
-func (m *Manager) ListEntries(request *grpc_organization_go.OrganizationId) ([]*grpc_network_go.ServiceDNSEntry, derrors.Error) {
-	panic("implement me")
+// ListEntries lists a page of the entries of an organization sorted by FQDN. The token of the next page is empty
+// when there are no more entries.
+func (m *Manager) ListEntries(request *grpc_network_go.ListServiceDNSEntriesRequest) ([]*grpc_network_go.ServiceDNSEntry, string, derrors.Error) {
+	pageSize := int(request.PageSize)
+	if pageSize == 0 {
+		pageSize = DefaultPageSize
+	}
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	entries, next, err := m.provider.ListGeneric(request.OrganizationId, request.PageToken, pageSize)
+	if err != nil {
+		return nil, "", err
+	}
+	result := make([]*grpc_network_go.ServiceDNSEntry, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.ToServiceDNSEntry()
+	}
+	return result, next, nil
 }
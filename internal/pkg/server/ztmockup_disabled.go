@@ -0,0 +1,28 @@
+//go:build !ztmockup
+// +build !ztmockup
+
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package server
+
+import "github.com/nalej/derrors"
+
+// launchZTMockup fails as the in-memory ZT controller is only available in the builds with the ztmockup tag.
+func launchZTMockup(accessToken string) (string, func(), derrors.Error) {
+	return "", nil, derrors.NewUnimplementedError("in-memory ZT controller not available, build with the ztmockup tag")
+}
@@ -28,16 +28,20 @@ import (
 	"github.com/nalej/grpc-infrastructure-go"
 	"github.com/nalej/grpc-organization-go"
 	"github.com/nalej/grpc-utils/pkg/tools"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
 	"io/ioutil"
+	"strings"
 	"sync"
 )
 
 const (
 	// App cluster api port
 	APP_CLUSTER_API_PORT uint32 = 443
+	// Label of the clusters with the CIDRs used by the cluster (pods, services, nodes), separated by commas
+	ExcludedCIDRsLabel = "nalej-excluded-cidrs"
 )
 
 // Internal struct to store information about a cluster connection. This struct can be used to query the latest
@@ -47,6 +51,8 @@ type ClusterEntry struct {
 	Hostname string
 	// Cordon true if this cluster is in a cordon status
 	Cordon bool
+	// ExcludedCIDRs with the networks used by the cluster that the overlay networks must not overlap
+	ExcludedCIDRs []string
 }
 
 // The connection helpers assists in the maintenance and connection of several app clusters.
@@ -197,7 +203,8 @@ func (h *ConnectionsHelper) UpdateClusterConnections(organizationId string, clie
 		if h.isClusterAvailable(cluster) {
 			targetHostname := fmt.Sprintf("appcluster.%s", cluster.Hostname)
 			clusterCordon := cluster.ClusterStatus == grpc_connectivity_manager_go.ClusterStatus_ONLINE_CORDON || cluster.ClusterStatus == grpc_connectivity_manager_go.ClusterStatus_OFFLINE_CORDON
-			h.ClusterReference[cluster.ClusterId] = ClusterEntry{Hostname: targetHostname, Cordon: clusterCordon}
+			h.ClusterReference[cluster.ClusterId] = ClusterEntry{Hostname: targetHostname, Cordon: clusterCordon,
+				ExcludedCIDRs: getExcludedCIDRs(cluster)}
 			targetPort := int(APP_CLUSTER_API_PORT)
 			params := make([]interface{}, 0)
 			params = append(params, h.useTLS)
@@ -212,6 +219,53 @@ func (h *ConnectionsHelper) UpdateClusterConnections(organizationId string, clie
 	return nil
 }
 
+// ExcludedRanges returns the networks of a set of clusters that the ranges of the connections must not overlap, both
+// configured in the allocator and taken from the cluster labels.
+//  params:
+//   organizationId
+//   clusterIds
+//   allocator with the configured exclusions
+//   client to update the clusters
+func (h *ConnectionsHelper) ExcludedRanges(organizationId string, clusterIds []string, allocator *ipam.Allocator,
+	client grpc_infrastructure_go.ClustersClient) []ipam.Range {
+	excluded := allocator.ClusterExclusions(clusterIds)
+
+	if err := h.UpdateClusterConnections(organizationId, client); err != nil {
+		log.Warn().Err(err).Msg("unable to update clusters, only the configured CIDRs are excluded")
+		return excluded
+	}
+	for _, clusterId := range clusterIds {
+		cluster, found := h.ClusterReference[clusterId]
+		if !found {
+			continue
+		}
+		for _, cidr := range cluster.ExcludedCIDRs {
+			clusterRange, err := ipam.ParseRange(cidr)
+			if err != nil {
+				log.Warn().Str("clusterId", clusterId).Str("cidr", cidr).Msg("ignoring invalid excluded CIDR of cluster")
+				continue
+			}
+			excluded = append(excluded, *clusterRange)
+		}
+	}
+	return excluded
+}
+
+// Internal function to get the CIDRs of a cluster that the overlay networks must not overlap.
+func getExcludedCIDRs(cluster *grpc_infrastructure_go.Cluster) []string {
+	excluded := make([]string, 0)
+	value, found := cluster.Labels[ExcludedCIDRsLabel]
+	if !found {
+		return excluded
+	}
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr != "" {
+			excluded = append(excluded, cidr)
+		}
+	}
+	return excluded
+}
+
 // Internal function to check if a cluster meets all the conditions to be added to the list of available clusters.
 func (h *ConnectionsHelper) isClusterAvailable(cluster *grpc_infrastructure_go.Cluster) bool {
 	// TODO: when state is implemented, check this ->
@@ -0,0 +1,224 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package zonefile converts the DNS entries of an organization from and to the zone file format of RFC 1035.
+//
+// Each entry has an A or AAAA record with its FQDN, or a CNAME record if it is an alias. The service name and the tags of the entry are written in a TXT
+// record with the same name, and its port in a SRV record named _<service>._<protocol>.<fqdn> pointing to the entry.
+package zonefile
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"github.com/nalej/derrors"
+	"github.com/nalej/grpc-network-go"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultTTL of the exported records in seconds
+	DefaultTTL = 30
+	// Keys of the strings of the TXT records
+	serviceNameKey = "nalej-service-name="
+	tagKey         = "nalej-tag="
+	// Zones of the reverse names
+	reverseZoneIPv4 = "in-addr.arpa."
+	reverseZoneIPv6 = "ip6.arpa."
+)
+
+// IsManaged checks if an entry is managed by the network manager, the entries of the connections and the reverse
+// records. These entries are not exported.
+func IsManaged(entry *grpc_network_go.DNSEntry) bool {
+	name := dns.Fqdn(strings.ToLower(entry.Fqdn))
+	return entry.NetworkId != "" || dns.IsSubDomain(reverseZoneIPv4, name) || dns.IsSubDomain(reverseZoneIPv6, name)
+}
+
+// entryService returns the service label of the SRV record of an entry, its service name or the first label of its
+// FQDN if it has none.
+func entryService(serviceName string, fqdn string) string {
+	if serviceName != "" {
+		return serviceName
+	}
+	return strings.SplitN(fqdn, ".", 2)[0]
+}
+
+// Records returns the records of an entry.
+func Records(entry *grpc_network_go.DNSEntry, ttl uint32) ([]dns.RR, derrors.Error) {
+	name := dns.Fqdn(entry.Fqdn)
+	if _, ok := dns.IsDomainName(name); !ok {
+		return nil, derrors.NewInvalidArgumentError("invalid FQDN").WithParams(entry.Fqdn)
+	}
+	header := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+	records := make([]dns.RR, 0)
+	if entry.Target != "" {
+		records = append(records, &dns.CNAME{Hdr: header(dns.TypeCNAME), Target: dns.Fqdn(entry.Target)})
+	} else {
+		ip := net.ParseIP(entry.Ip)
+		if ip == nil {
+			return nil, derrors.NewInvalidArgumentError("invalid IP").WithParams(entry.Fqdn, entry.Ip)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			records = append(records, &dns.A{Hdr: header(dns.TypeA), A: ip4})
+		} else {
+			records = append(records, &dns.AAAA{Hdr: header(dns.TypeAAAA), AAAA: ip})
+		}
+	}
+	txt := make([]string, 0, len(entry.Tags)+1)
+	if entry.ServiceName != "" {
+		txt = append(txt, serviceNameKey+entry.ServiceName)
+	}
+	for _, tag := range entry.Tags {
+		txt = append(txt, tagKey+tag)
+	}
+	if len(txt) > 0 {
+		records = append(records, &dns.TXT{Hdr: header(dns.TypeTXT), Txt: txt})
+	}
+	if entry.Port != 0 {
+		srv := &dns.SRV{Hdr: header(dns.TypeSRV), Priority: 1, Weight: 1, Port: uint16(entry.Port), Target: name}
+		srv.Hdr.Name = fmt.Sprintf("_%s._%s.%s", entryService(entry.ServiceName, entry.Fqdn), entry.Protocol, name)
+		records = append(records, srv)
+	}
+	return records, nil
+}
+
+// Write writes the entries of an organization in zone file format.
+func Write(w io.Writer, organizationId string, entries []*grpc_network_go.DNSEntry, ttl uint32) derrors.Error {
+	if _, err := fmt.Fprintf(w, "; DNS entries of the organization %s\n$TTL %d\n", organizationId, ttl); err != nil {
+		return derrors.NewInternalError("unable to write zone file", err)
+	}
+	for _, entry := range entries {
+		records, err := Records(entry, ttl)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if _, wErr := fmt.Fprintln(w, record.String()); wErr != nil {
+				return derrors.NewInternalError("unable to write zone file", wErr)
+			}
+		}
+	}
+	return nil
+}
+
+// Parse reads the entries of a zone file. The SOA and NS records are ignored, any other record that does not
+// describe an entry is an error. The aliases are returned after the entries of the file they point to.
+func Parse(r io.Reader, file string) ([]*grpc_network_go.AddDNSEntryRequest, derrors.Error) {
+	entries := make([]*grpc_network_go.AddDNSEntryRequest, 0)
+	byName := make(map[string]*grpc_network_go.AddDNSEntryRequest, 0)
+	getEntry := func(name string) *grpc_network_go.AddDNSEntryRequest {
+		fqdn := strings.TrimSuffix(name, ".")
+		entry, exists := byName[strings.ToLower(fqdn)]
+		if !exists {
+			entry = &grpc_network_go.AddDNSEntryRequest{Fqdn: fqdn, Tags: make([]string, 0)}
+			byName[strings.ToLower(fqdn)] = entry
+			entries = append(entries, entry)
+		}
+		return entry
+	}
+
+	parser := dns.NewZoneParser(r, ".", file)
+	for record, ok := parser.Next(); ok; record, ok = parser.Next() {
+		name := record.Header().Name
+		switch rr := record.(type) {
+		case *dns.A:
+			if err := setIp(getEntry(name), rr.A.String()); err != nil {
+				return nil, err
+			}
+		case *dns.AAAA:
+			if err := setIp(getEntry(name), rr.AAAA.String()); err != nil {
+				return nil, err
+			}
+		case *dns.CNAME:
+			entry := getEntry(name)
+			target := strings.TrimSuffix(rr.Target, ".")
+			if entry.Target != "" && !strings.EqualFold(entry.Target, target) {
+				return nil, derrors.NewInvalidArgumentError("entry with several CNAME records").WithParams(entry.Fqdn, entry.Target, target)
+			}
+			entry.Target = target
+		case *dns.TXT:
+			entry := getEntry(name)
+			for _, value := range rr.Txt {
+				switch {
+				case strings.HasPrefix(value, serviceNameKey):
+					entry.ServiceName = strings.TrimPrefix(value, serviceNameKey)
+				case strings.HasPrefix(value, tagKey):
+					entry.Tags = append(entry.Tags, strings.TrimPrefix(value, tagKey))
+				}
+			}
+		case *dns.SRV:
+			labels := dns.SplitDomainName(name)
+			if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.HasPrefix(labels[1], "_") {
+				return nil, derrors.NewInvalidArgumentError("SRV record must be named _<service>._<protocol>.<fqdn>").WithParams(name)
+			}
+			target := dns.Fqdn(strings.Join(labels[2:], "."))
+			if !strings.EqualFold(target, rr.Target) {
+				return nil, derrors.NewInvalidArgumentError("SRV record must point to its entry").WithParams(name, rr.Target)
+			}
+			entry := getEntry(target)
+			entry.Port = int32(rr.Port)
+			entry.Protocol = strings.TrimPrefix(labels[1], "_")
+		case *dns.SOA, *dns.NS:
+			// the records of the zone itself are not entries
+		default:
+			return nil, derrors.NewInvalidArgumentError("unsupported record").WithParams(record.String())
+		}
+	}
+	if err := parser.Err(); err != nil {
+		return nil, derrors.NewInvalidArgumentError("invalid zone file", err).WithParams(file)
+	}
+	for _, entry := range entries {
+		if entry.Ip == "" && entry.Target == "" {
+			return nil, derrors.NewInvalidArgumentError("entry without A, AAAA or CNAME record").WithParams(entry.Fqdn)
+		}
+		if entry.Ip != "" && entry.Target != "" {
+			return nil, derrors.NewInvalidArgumentError("CNAME record with other address records").WithParams(entry.Fqdn)
+		}
+	}
+	depths := make(map[*grpc_network_go.AddDNSEntryRequest]int, len(entries))
+	for _, entry := range entries {
+		depths[entry] = aliasDepth(entry, byName)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return depths[entries[i]] < depths[entries[j]]
+	})
+	return entries, nil
+}
+
+// aliasDepth returns the number of aliases of the file followed from an entry until an entry that is not an alias
+// of the file, 0 for the entries that are not aliases.
+func aliasDepth(entry *grpc_network_go.AddDNSEntryRequest, byName map[string]*grpc_network_go.AddDNSEntryRequest) int {
+	depth := 0
+	for entry != nil && entry.Target != "" && depth <= len(byName) {
+		depth++
+		entry = byName[strings.ToLower(entry.Target)]
+	}
+	return depth
+}
+
+// setIp sets the IP of an entry, each entry has a single address.
+func setIp(entry *grpc_network_go.AddDNSEntryRequest, ip string) derrors.Error {
+	if entry.Ip != "" && entry.Ip != ip {
+		return derrors.NewInvalidArgumentError("entry with several addresses").WithParams(entry.Fqdn, entry.Ip, ip)
+	}
+	entry.Ip = ip
+	return nil
+}
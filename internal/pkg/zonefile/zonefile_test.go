@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zonefile
+
+import (
+	"bytes"
+	"github.com/nalej/grpc-network-go"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"strings"
+)
+
+func parseString(zone string) ([]*grpc_network_go.AddDNSEntryRequest, error) {
+	entries, err := Parse(strings.NewReader(zone), "test.zone")
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+var _ = ginkgo.Describe("Zone file", func() {
+
+	ginkgo.It("should read the entries it writes", func() {
+		entries := []*grpc_network_go.DNSEntry{
+			{
+				Fqdn:        "web.example.com",
+				Ip:          "10.0.0.1",
+				ServiceName: "web",
+				Port:        8080,
+				Protocol:    "tcp",
+				Tags:        []string{"frontend", "public"},
+			},
+			{Fqdn: "db.example.com", Ip: "fd00::1"},
+			{Fqdn: "www.example.com", Target: "web.example.com"},
+		}
+		buffer := &bytes.Buffer{}
+		gomega.Expect(Write(buffer, "org1", entries, DefaultTTL)).To(gomega.Succeed())
+
+		parsed, err := Parse(buffer, "org1.zone")
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(parsed).To(gomega.HaveLen(len(entries)))
+		for i, entry := range entries {
+			gomega.Expect(parsed[i].Fqdn).To(gomega.Equal(entry.Fqdn))
+			gomega.Expect(parsed[i].Ip).To(gomega.Equal(entry.Ip))
+			gomega.Expect(parsed[i].Target).To(gomega.Equal(entry.Target))
+			gomega.Expect(parsed[i].ServiceName).To(gomega.Equal(entry.ServiceName))
+			gomega.Expect(parsed[i].Port).To(gomega.Equal(entry.Port))
+			gomega.Expect(parsed[i].Protocol).To(gomega.Equal(entry.Protocol))
+			if entry.Tags == nil {
+				gomega.Expect(parsed[i].Tags).To(gomega.BeEmpty())
+			} else {
+				gomega.Expect(parsed[i].Tags).To(gomega.Equal(entry.Tags))
+			}
+		}
+	})
+
+	ginkgo.It("should return the aliases after their targets", func() {
+		zone := `$TTL 30
+alias2.example.com. IN CNAME alias1.example.com.
+alias1.example.com. IN CNAME web.example.com.
+external.example.com. IN CNAME web.example.org.
+web.example.com. IN A 10.0.0.1
+`
+		parsed, err := parseString(zone)
+		gomega.Expect(err).To(gomega.Succeed())
+		names := make([]string, len(parsed))
+		for i, entry := range parsed {
+			names[i] = entry.Fqdn
+		}
+		gomega.Expect(names).To(gomega.Equal([]string{
+			"web.example.com", "alias1.example.com", "external.example.com", "alias2.example.com",
+		}))
+	})
+
+	ginkgo.It("should ignore the records of the zone", func() {
+		zone := `$TTL 30
+example.com. IN SOA ns.example.com. admin.example.com. 1 3600 600 86400 30
+example.com. IN NS ns.example.com.
+web.example.com. IN A 10.0.0.1
+`
+		parsed, err := parseString(zone)
+		gomega.Expect(err).To(gomega.Succeed())
+		gomega.Expect(parsed).To(gomega.HaveLen(1))
+	})
+
+	ginkgo.It("should reject the records that do not describe an entry", func() {
+		invalid := []string{
+			// unsupported record
+			"example.com. 30 IN MX 10 mail.example.com.",
+			// alias with an address
+			"web.example.com. 30 IN A 10.0.0.1\nweb.example.com. 30 IN CNAME other.example.com.",
+			// several addresses
+			"web.example.com. 30 IN A 10.0.0.1\nweb.example.com. 30 IN A 10.0.0.2",
+			// entry without address
+			"web.example.com. 30 IN TXT \"nalej-tag=frontend\"",
+			// SRV record of another entry
+			"web.example.com. 30 IN A 10.0.0.1\n_web._tcp.web.example.com. 30 IN SRV 1 1 80 db.example.com.",
+			// syntax error
+			"web.example.com. 30 IN A 10.0.0",
+		}
+		for _, zone := range invalid {
+			_, err := parseString(zone)
+			gomega.Expect(err).To(gomega.HaveOccurred(), zone)
+		}
+	})
+
+	ginkgo.It("should not export the entries managed by the network manager", func() {
+		gomega.Expect(IsManaged(&grpc_network_go.DNSEntry{Fqdn: "web.example.com", Ip: "10.0.0.1"})).To(gomega.BeFalse())
+		gomega.Expect(IsManaged(&grpc_network_go.DNSEntry{Fqdn: "web.example.com", Ip: "10.0.0.1", NetworkId: "net1"})).To(gomega.BeTrue())
+		gomega.Expect(IsManaged(&grpc_network_go.DNSEntry{Fqdn: "1.0.0.10.in-addr.arpa", Target: "web.example.com"})).To(gomega.BeTrue())
+	})
+})
@@ -22,8 +22,9 @@ import (
 	"github.com/nalej/derrors"
 	"github.com/nalej/dhttp"
 	"github.com/nalej/network-manager/internal/pkg/entities"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
 	"github.com/rs/zerolog/log"
-	"strings"
+	"sync"
 )
 
 // Constants
@@ -34,11 +35,36 @@ const (
 	networkPath           = controllerPath + "/network"
 	networkDetailPath     = networkPath + "/%s"
 	networkAuthMemberPath = networkPath + "/%s" + "/member" + "/%s"
+	networkMembersPath    = networkPath + "/%s" + "/member"
 	PeerAddressLength     = 10
+	// Default number of network details requested concurrently when listing networks
+	DefaultListWorkers = 8
+	// ULA prefix (fd00::/8 + 40-bit global ID) of the IPv6 ranges of dual-stack networks
+	IPv6Prefix = "fd6e:616c:656a"
+)
+
+// IPv6 assign modes of dual-stack networks
+const (
+	// Addresses are assigned from the IPv6 pool of the network
+	IPv6ModeZt = "zt"
+	// Besides the pool, every member gets a /128 on a /88 network
+	IPv6ModeRfc4193 = "rfc4193"
+	// Besides the pool, every member gets a /80 within a /40 network
+	IPv6ModeSixPlane = "6plane"
 )
 
 type ZTClient struct {
 	client dhttp.Client
+	// IPv6 assign mode of the new networks, nil if dual-stack is disabled
+	v6AssignMode *V6AssignMode
+	// Maximum number of concurrent requests when listing networks
+	listWorkers int
+	// Protects the cached controller address
+	addressLock sync.Mutex
+	// ZeroTier address of the controller, empty until it is retrieved
+	address string
+	// Members removed by the client
+	history MemberHistory
 }
 
 func NewZTClient(url string, accessToken string) (*ZTClient, derrors.Error) {
@@ -57,78 +83,197 @@ func NewZTClient(url string, accessToken string) (*ZTClient, derrors.Error) {
 
 	client := dhttp.NewClientSling(conf)
 
-	return &ZTClient{client: client}, nil
+	ztClient := &ZTClient{
+		client:      client,
+		listWorkers: DefaultListWorkers,
+		history:     NewMemoryMemberHistory(DefaultMemberHistorySize),
+	}
+	// the address is retrieved again on the first request if the controller is not ready yet
+	_, err = ztClient.controllerAddress()
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Msg("unable to retrieve the controller address")
+	}
+
+	return ztClient, nil
+}
+
+// controllerAddress returns the ZeroTier address of the controller, retrieving it if it is not cached.
+func (ztc *ZTClient) controllerAddress() (string, derrors.Error) {
+	ztc.addressLock.Lock()
+	defer ztc.addressLock.Unlock()
+
+	if ztc.address != "" {
+		return ztc.address, nil
+	}
+
+	status, err := ztc.GetStatus()
+	if err != nil {
+		return "", derrors.NewUnavailableError("error getting controller status", err)
+	}
+	// Check if we have an address
+	if len(status.Address) != PeerAddressLength {
+		return "", derrors.NewInvalidArgumentError("Invalid address in peer status").WithParams(status)
+	}
+	ztc.address = status.Address
+	log.Debug().Str("address", ztc.address).Msg("controller address retrieved")
+	return ztc.address, nil
+}
+
+// refreshControllerAddress discards the cached address of the controller and retrieves it again.
+//   returns:
+//     True if the address has changed.
+func (ztc *ZTClient) refreshControllerAddress() bool {
+	ztc.addressLock.Lock()
+	previous := ztc.address
+	ztc.address = ""
+	ztc.addressLock.Unlock()
+
+	current, err := ztc.controllerAddress()
+	if err != nil {
+		log.Warn().Str("trace", err.DebugReport()).Msg("unable to refresh the controller address")
+		return false
+	}
+	return current != previous
+}
+
+// SetListWorkers sets the maximum number of network details requested concurrently when listing networks.
+func (ztc *ZTClient) SetListWorkers(workers int) derrors.Error {
+	if workers <= 0 {
+		return derrors.NewInvalidArgumentError("the number of list workers must be positive").WithParams(workers)
+	}
+	ztc.listWorkers = workers
+	return nil
+}
+
+// EnableIPv6 creates the new networks in dual-stack mode. Besides the IPv4 range, each network gets a /64
+// IPv6 range inside the IPv6Prefix ULA prefix.
+//   params:
+//     mode The IPv6 assign mode: zt, rfc4193 or 6plane
+//   returns:
+//     Error, if the mode is not valid.
+func (ztc *ZTClient) EnableIPv6(mode string) derrors.Error {
+	assignMode := &V6AssignMode{Zt: true}
+	switch mode {
+	case IPv6ModeZt:
+	case IPv6ModeRfc4193:
+		assignMode.Rfc4193 = true
+	case IPv6ModeSixPlane:
+		assignMode.SixPlane = true
+	default:
+		return derrors.NewInvalidArgumentError("invalid IPv6 assign mode").WithParams(mode)
+	}
+	ztc.v6AssignMode = assignMode
+	return nil
 }
 
 // Add a ZeroTier network to the controller
 //   params:
-//     entity The Network to be created
+//     networkName The name of the network
+//     organizationId The organization the network belongs to
+//     ipRange The IPv4 network routed and assigned to the members
+//     ruleSet The traffic rules of the network, if nil all traffic is accepted
 //   returns:
 //     The added network.
 //     Error, if there is an internal error.
 // The entries marked [rw] can be set during creation. From those,
 // only "name" is required.
-func (ztc *ZTClient) Add(networkName string, organizationId string, IpRangeMin string, IpRangeMax string) (*ZTNetwork, derrors.Error) {
+func (ztc *ZTClient) Add(networkName string, organizationId string, ipRange ipam.Range, ruleSet *RuleSet) (*ZTNetwork, derrors.Error) {
 
-	ip := strings.Split(IpRangeMin, ".")
 	log.Debug().Str("networkName", networkName).Str("organizationID", organizationId).
-		Str("rangeMin", IpRangeMin).Str("rangeMax", IpRangeMax).Msg("Adding network")
+		Str("range", ipRange.String()).Msg("Adding network")
 
 	// Get Controller ZT address, as that's needed to create the proper
-	status, err := ztc.GetStatus()
+	address, err := ztc.controllerAddress()
 
 	if err != nil {
-		log.Error().Err(err).Msg("error getting status when adding network")
+		log.Error().Err(err).Msg("error getting controller address when adding network")
 		return nil, err
 	}
 
-	// Check if we have an address
-	if len(status.Address) != PeerAddressLength {
-		return nil, derrors.NewInvalidArgumentError("Invalid address in peer status").WithParams(status)
-	}
-
-	path := fmt.Sprintf(networkAddPath, status.Address)
-
 	// Send create network request to controller
 
 	network := &ZTNetwork{}
 
 	entity := &ZTNetwork{
-		Name: networkName,
+		Name: organizationName(organizationId, networkName),
 		IpAssignmentPools: []IpAssignmentPool{
 			{
-				IpRangeStart: IpRangeMin, //"192.168.0.1",
-				IpRangeEnd:   IpRangeMax, //"192.168.15.254",
+				IpRangeStart: ipRange.First().String(),
+				IpRangeEnd:   ipRange.Last().String(),
 			},
-			/*
-					    {
-					        IpRangeStart: "fd00:feed:feed:beef:0000:0000:0000:0000",
-					        IpRangeEnd: "fd00:feed:feed:beef:ffff:ffff:ffff:ffff",
-				        },
-			*/
 		},
 		V4AssignMode: &V4AssignMode{
 			Zt: true,
 		},
-		/*
-			V6AssignMode: &V6AssignMode{
-				Zt:       true,
-				Rfc4193:  true,
-				SixPlane: true,
-			},
-		*/
 		Routes: []Route{
-			{Target: fmt.Sprintf("192.168.%s.0/24", ip[2])},
+			{Target: ipRange.String()},
 		},
 	}
+	if ztc.v6AssignMode != nil {
+		// the IPv6 subnet is taken from the lower 16 bits of the IPv4 network number
+		v6Prefix := fmt.Sprintf("%s:%x", IPv6Prefix, ipRange.Number()&0xffff)
+		entity.IpAssignmentPools = append(entity.IpAssignmentPools, IpAssignmentPool{
+			IpRangeStart: fmt.Sprintf("%s::1", v6Prefix),
+			IpRangeEnd:   fmt.Sprintf("%s:ffff:ffff:ffff:fffe", v6Prefix),
+		})
+		entity.V6AssignMode = ztc.v6AssignMode
+		entity.Routes = append(entity.Routes, Route{Target: fmt.Sprintf("%s::/64", v6Prefix)})
+	}
+	if ruleSet != nil {
+		entity.Rules = ruleSet.Rules
+		entity.Tags = ruleSet.Tags
+	}
 
-	response := ztc.client.Post(path, entity, network)
+	response := ztc.client.Post(fmt.Sprintf(networkAddPath, address), entity, network)
+	if response.Error != nil && ztc.refreshControllerAddress() {
+		// the controller has been replaced, retry with the new address
+		address, err = ztc.controllerAddress()
+		if err != nil {
+			return nil, err
+		}
+		log.Warn().Str("address", address).Msg("controller address changed, retrying network creation")
+		response = ztc.client.Post(fmt.Sprintf(networkAddPath, address), entity, network)
+	}
 	if response.Error != nil {
 		return nil, derrors.NewInternalError("Error creating new network", response.Error)
 	}
 	return network, nil
 }
 
+// Update an existing ZeroTier network
+//   params:
+//     networkId The ZeroTier network ID to be updated
+//     organizationId The organization the network belongs to
+//     patch The fields to be modified, nil fields are left unchanged
+//   returns:
+//     The updated network.
+//     Error, if the resulting network is not valid or there is an internal error.
+func (ztc *ZTClient) Update(networkId string, organizationId string, patch *ZTNetworkPatch) (*ZTNetwork, derrors.Error) {
+	current, err := ztc.GetOrganizationNetwork(networkId, organizationId)
+	if err != nil {
+		return nil, err
+	}
+	if patch.Name != nil {
+		name := organizationName(organizationId, *patch.Name)
+		patch.Name = &name
+	}
+
+	// validate the resulting network before sending anything to the controller
+	err = patch.ApplyTo(current).Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug().Str("networkId", networkId).Interface("patch", patch).Msg("Updating network")
+	path := fmt.Sprintf(networkDetailPath, networkId)
+	network := &ZTNetwork{}
+	response := ztc.client.Post(path, patch, network)
+	if response.Error != nil {
+		return nil, derrors.NewInternalError("Error updating network", response.Error).WithParams(networkId)
+	}
+	return network, nil
+}
+
 // Delete a ZeroTier network from the controller
 //   params:
 //     entity The Network to be deleted
@@ -136,17 +281,10 @@ func (ztc *ZTClient) Add(networkName string, organizationId string, IpRangeMin s
 //     Error, if there is an internal error.
 //func (ztc *ZTClient) Delete(entity *ZTNetwork) derrors.Error {
 func (ztc *ZTClient) Delete(networkId string, organizationId string) derrors.Error {
-	// Get Controller ZT address, as that's needed to create the proper
-	status, err := ztc.GetStatus()
-
+	// Check the network belongs to the organization
+	_, err := ztc.GetOrganizationNetwork(networkId, organizationId)
 	if err != nil {
-		log.Error().Err(err).Msg("error getting status when deleting network")
-		return derrors.NewNotFoundError("Error deleting network", err)
-	}
-
-	// Check if we have an address
-	if len(status.Address) != PeerAddressLength {
-		return derrors.NewInvalidArgumentError("Invalid address in peer status").WithParams(status)
+		return err
 	}
 
 	entity := &entities.Network{
@@ -186,46 +324,194 @@ func (ztc *ZTClient) Get(networkID string) (*ZTNetwork, derrors.Error) {
 	return response.Result.(*ZTNetwork), nil
 }
 
+// Get ZeroTier network information from the controller, checking that it belongs to an organization
+//   params:
+//     networkID The ZeroTier network ID to get detailed information for
+//     organizationID The organization requesting the network
+//   returns:
+//     The network.
+//     Error, if the network does not belong to the organization or there is an internal error.
+func (ztc *ZTClient) GetOrganizationNetwork(networkID string, organizationID string) (*ZTNetwork, derrors.Error) {
+	network, err := ztc.Get(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if !network.OwnedBy(organizationID) {
+		// do not disclose networks of other organizations
+		log.Warn().Str("networkId", networkID).Str("organizationId", organizationID).
+			Msg("network requested by another organization")
+		return nil, derrors.NewNotFoundError("Error retrieving network").WithParams(networkID)
+	}
+	return network, nil
+}
+
+// Claim tags a network created without organization with the organization that owns it. The caller must have
+// checked the owner of the network, usually in the system model. Networks that already belong to the
+// organization are returned as they are.
+//   params:
+//     networkID The ZeroTier network ID to be claimed
+//     organizationID The organization that owns the network
+//   returns:
+//     The network.
+//     Error, if the network belongs to another organization or there is an internal error.
+func (ztc *ZTClient) Claim(networkID string, organizationID string) (*ZTNetwork, derrors.Error) {
+	network, err := ztc.Get(networkID)
+	if err != nil {
+		return nil, err
+	}
+	if network.OwnedBy(organizationID) {
+		return network, nil
+	}
+	if network.OrganizationId() != "" || organizationID == "" {
+		log.Warn().Str("networkId", networkID).Str("organizationId", organizationID).
+			Msg("network claimed by another organization")
+		return nil, derrors.NewNotFoundError("Error retrieving network").WithParams(networkID)
+	}
+
+	name := organizationName(organizationID, network.Name)
+	path := fmt.Sprintf(networkDetailPath, networkID)
+	claimed := &ZTNetwork{}
+	response := ztc.client.Post(path, &ZTNetworkPatch{Name: &name}, claimed)
+	if response.Error != nil {
+		return nil, derrors.NewInternalError("Error claiming network", response.Error).WithParams(networkID, organizationID)
+	}
+	log.Info().Str("networkId", networkID).Str("organizationId", organizationID).Msg("network without organization claimed")
+	return claimed, nil
+}
+
 // Retrieves a list of ZeroTier networks from an existing organization
 //   params:
 //     organizationID The ZeroTier organization ID to get detailed information for
 //   returns:
 //     The list of networks.
-//     Error, if there is an internal error.
+//     Error, if any of the networks cannot be retrieved or there is an internal error.
 func (ztc *ZTClient) List(organizationID string) ([]ZTNetwork, derrors.Error) {
+	networks, failed, err := ztc.ListPartial(organizationID)
+	if err != nil {
+		return nil, err
+	}
+	if len(failed) > 0 {
+		return nil, derrors.NewUnavailableError("networks could not be retrieved").WithParams(organizationID, len(failed))
+	}
+	return networks, nil
+}
+
+// Retrieves the ZeroTier networks of an existing organization, skipping the networks that cannot be retrieved
+//   params:
+//     organizationID The ZeroTier organization ID to get detailed information for
+//   returns:
+//     The list of networks that were retrieved.
+//     The networks of the controller that could not be retrieved. Their organization is unknown, so they may
+//     belong to other organizations and must not be disclosed unless the system model shows they belong to it.
+//     Error, if the list of networks cannot be retrieved.
+func (ztc *ZTClient) ListPartial(organizationID string) ([]ZTNetwork, []NetworkError, derrors.Error) {
+	networks, failed, err := ztc.ListAll()
+	if err != nil {
+		return nil, nil, err.WithParams(organizationID)
+	}
+	return filterByOrganization(networks, organizationID), failed, nil
+}
+
+// Retrieves all the ZeroTier networks of the controller, regardless of their organization
+//   returns:
+//     The list of networks that were retrieved.
+//     The networks that could not be retrieved.
+//     Error, if the list of networks cannot be retrieved.
+func (ztc *ZTClient) ListAll() ([]ZTNetwork, []NetworkError, derrors.Error) {
 	// Send get network request to controller
 	networkList := make([]string, 0)
 	response := ztc.client.Get(networkPath, &networkList)
 	if response.Error != nil {
-		return nil, derrors.NewNotFoundError("Error retrieving networks", response.Error).WithParams(organizationID)
+		return nil, nil, derrors.NewNotFoundError("Error retrieving networks", response.Error)
 	}
-	//var networks []ZTNetwork
-	networks := make([]ZTNetwork, len(networkList))
-	for i, n := range networkList {
-		//for i := 0; i < len(networkList); i++ {
-		converted, err := ztc.Get(n)
-		if err != nil {
-			log.Error().Msgf("Impossible to get network %s", n)
-			return nil, err
+	networks, failed := ztc.getNetworks(networkList)
+	return networks, failed, nil
+}
+
+// getNetworks retrieves the details of a list of networks using a bounded pool of workers. The order of
+// the networks is preserved.
+func (ztc *ZTClient) getNetworks(networkIDs []string) ([]ZTNetwork, []NetworkError) {
+	retrieved := make([]*ZTNetwork, len(networkIDs))
+	errors := make([]derrors.Error, len(networkIDs))
+
+	workers := ztc.listWorkers
+	if workers > len(networkIDs) {
+		workers = len(networkIDs)
+	}
+	pending := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				retrieved[i], errors[i] = ztc.Get(networkIDs[i])
+			}
+		}()
+	}
+	for i := range networkIDs {
+		pending <- i
+	}
+	close(pending)
+	wg.Wait()
+
+	networks := make([]ZTNetwork, 0, len(networkIDs))
+	failed := make([]NetworkError, 0)
+	for i, networkID := range networkIDs {
+		if errors[i] != nil {
+			log.Error().Str("networkId", networkID).Str("trace", errors[i].DebugReport()).Msg("Impossible to get network")
+			failed = append(failed, NetworkError{NetworkId: networkID, Error: errors[i]})
+			continue
 		}
-		networks[i] = *converted
+		networks = append(networks, *retrieved[i])
 	}
-	return networks, nil
+	return networks, failed
 }
 
 // Authorize a member to join a network
 //	params:
 //		Network ID
 //		Member ID
+//		Tags to be assigned to the member, if any
 //	returns:
 //		Error, if there's one
-func (ztc *ZTClient) Authorize(networkId string, memberId string) derrors.Error {
+func (ztc *ZTClient) Authorize(networkId string, memberId string, tags ...MemberTag) derrors.Error {
 	// Create new authorized member
 	member := &ZTMember{
 		ID:         memberId,
 		Nwid:       networkId,
 		Authorized: True(),
 	}
+	return ztc.authorize(member, tags)
+}
+
+// Authorize a member to join a network with a static IP. The controller does not assign it any other IP.
+//	params:
+//		Network ID
+//		Member ID
+//		IP to be assigned to the member
+//		Tags to be assigned to the member, if any
+//	returns:
+//		Error, if there's one
+func (ztc *ZTClient) AuthorizeWithIp(networkId string, memberId string, ip string, tags ...MemberTag) derrors.Error {
+	// Create new authorized member with a fixed IP
+	member := &ZTMember{
+		ID:              memberId,
+		Nwid:            networkId,
+		Authorized:      True(),
+		IpAssignments:   []string{ip},
+		NoAutoAssignIps: True(),
+	}
+	return ztc.authorize(member, tags)
+}
+
+// authorize sends an authorized member to the controller
+func (ztc *ZTClient) authorize(member *ZTMember, tags []MemberTag) derrors.Error {
+	networkId := member.Nwid
+	memberId := member.ID
+	for _, tag := range tags {
+		member.Tags = append(member.Tags, tag.toTuple())
+	}
 
 	// Form path of the request
 	path := fmt.Sprintf(networkAuthMemberPath, networkId, memberId)
@@ -270,3 +556,132 @@ func (ztc *ZTClient) Unauthorize(networkId string, memberId string) derrors.Erro
 
 	return nil
 }
+
+// ListMembers retrieves the members of a network
+//	params:
+//		Network ID
+//	returns:
+//		The list of members.
+//		Error, if there's one
+func (ztc *ZTClient) ListMembers(networkId string) ([]ZTMember, derrors.Error) {
+	// The controller returns a map with the member ID and its revision
+	memberList := make(map[string]int, 0)
+	path := fmt.Sprintf(networkMembersPath, networkId)
+	response := ztc.client.Get(path, &memberList)
+	if response.Error != nil {
+		return nil, derrors.NewNotFoundError("Error retrieving members", response.Error).WithParams(networkId)
+	}
+
+	members := make([]ZTMember, 0, len(memberList))
+	for memberId := range memberList {
+		member, err := ztc.GetMember(networkId, memberId)
+		if err != nil {
+			log.Error().Str("networkId", networkId).Str("memberId", memberId).Msg("Impossible to get member")
+			return nil, err
+		}
+		members = append(members, *member)
+	}
+	return members, nil
+}
+
+// GetMember retrieves a member of a network
+//	params:
+//		Network ID
+//		Member ID
+//	returns:
+//		The member.
+//		Error, if there's one
+func (ztc *ZTClient) GetMember(networkId string, memberId string) (*ZTMember, derrors.Error) {
+	path := fmt.Sprintf(networkAuthMemberPath, networkId, memberId)
+
+	member := &ZTMember{}
+	response := ztc.client.Get(path, member)
+	if response.Error != nil {
+		return nil, derrors.NewNotFoundError("Error retrieving member", response.Error).WithParams(networkId, memberId)
+	}
+
+	return member, nil
+}
+
+// DeleteMember removes a member from a network in the controller
+//	params:
+//		Network ID
+//		Member ID
+//	returns:
+//		Error, if there's one
+func (ztc *ZTClient) DeleteMember(networkId string, memberId string) derrors.Error {
+	// Form path of the request
+	path := fmt.Sprintf(networkAuthMemberPath, networkId, memberId)
+
+	// Send request to the controller
+	output := &ZTMember{}
+	request := ztc.client.Delete(path, output)
+	if request.Error != nil {
+		return derrors.NewInternalError("Error deleting member", request.Error).WithParams(networkId, memberId)
+	}
+
+	return nil
+}
+
+// SetMemberHistory sets the history where the member removals are recorded. By default, they are kept in memory.
+func (ztc *ZTClient) SetMemberHistory(history MemberHistory) {
+	ztc.history = history
+}
+
+// RemoveMember unauthorizes a member and deletes it from a network, recording the removal in the history
+//	params:
+//		Organization ID that owns the network
+//		Network ID
+//		Member ID
+//		Reason of the removal
+//	returns:
+//		Error, if there's one
+func (ztc *ZTClient) RemoveMember(organizationId string, networkId string, memberId string, reason string) derrors.Error {
+	removal := MemberRemoval{
+		OrganizationId: organizationId,
+		NetworkId:      networkId,
+		MemberId:       memberId,
+		Reason:         reason,
+	}
+	// the member details are recorded for incident analysis
+	member, err := ztc.GetMember(networkId, memberId)
+	if err == nil {
+		removal.Identity = member.Identity
+		removal.IpAssignments = member.IpAssignments
+	}
+
+	err = ztc.Unauthorize(networkId, memberId)
+	if err != nil {
+		return err
+	}
+	err = ztc.DeleteMember(networkId, memberId)
+	if err != nil {
+		return err
+	}
+
+	if hErr := ztc.history.Add(removal); hErr != nil {
+		// the member is already removed
+		log.Warn().Str("networkId", networkId).Str("memberId", memberId).Str("trace", hErr.DebugReport()).
+			Msg("unable to record the member removal")
+	}
+	log.Info().Str("networkId", networkId).Str("memberId", memberId).Str("reason", reason).Msg("member removed")
+
+	return nil
+}
+
+// MemberRemovals returns the members removed from a network of an organization by the client, newest first.
+// The history is kept after the network is deleted.
+func (ztc *ZTClient) MemberRemovals(organizationId string, networkId string) ([]MemberRemoval, derrors.Error) {
+	return ztc.history.List(organizationId, networkId)
+}
+
+// filterByOrganization returns the networks tagged with the organization
+func filterByOrganization(networks []ZTNetwork, organizationID string) []ZTNetwork {
+	filtered := make([]ZTNetwork, 0, len(networks))
+	for _, network := range networks {
+		if network.OwnedBy(organizationID) {
+			filtered = append(filtered, network)
+		}
+	}
+	return filtered
+}
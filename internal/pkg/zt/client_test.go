@@ -0,0 +1,194 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zt_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/nalej/network-manager/internal/pkg/zt/zttest"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+	"net/http"
+	"strings"
+)
+
+// postNetwork sends a network creation request directly to the controller, as the networks created outside the
+// network manager.
+func postNetwork(body string) (*http.Response, error) {
+	url := fmt.Sprintf("%s/controller/network/%s______", controller.URL(), zttest.MockupControllerAddress)
+	request, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-ZT1-Auth", testAccessToken)
+	return http.DefaultClient.Do(request)
+}
+
+var _ = ginkgo.Describe("ZeroTier client", func() {
+
+	var client *zt.ZTClient
+	var ipRange *ipam.Range
+
+	ginkgo.BeforeEach(func() {
+		controller.Clear()
+		var err derrors.Error
+		client, err = zt.NewZTClient(controller.URL(), testAccessToken)
+		gomega.Expect(err).To(gomega.Succeed())
+		ipRange, err = ipam.ParseRange("192.168.10.0/24")
+		gomega.Expect(err).To(gomega.Succeed())
+	})
+
+	ginkgo.Context("networks", func() {
+
+		ginkgo.It("should add a network of an organization", func() {
+			added, err := client.Add("network", "org1", *ipRange, nil)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(added.OrganizationId()).To(gomega.Equal("org1"))
+			gomega.Expect(added.ShortName()).To(gomega.Equal("network"))
+			gomega.Expect(added.IpRange()).To(gomega.Equal("192.168.10.1-192.168.10.254"))
+
+			retrieved, err := client.GetOrganizationNetwork(added.ID, "org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(retrieved.ID).To(gomega.Equal(added.ID))
+		})
+
+		ginkgo.It("should not disclose the networks of other organizations", func() {
+			added, err := client.Add("network", "org1", *ipRange, nil)
+			gomega.Expect(err).To(gomega.Succeed())
+			_, err = client.Add("other", "org2", *ipRange, nil)
+			gomega.Expect(err).To(gomega.Succeed())
+
+			_, err = client.GetOrganizationNetwork(added.ID, "org2")
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			gomega.Expect(err.Type()).To(gomega.Equal(derrors.NotFound))
+			gomega.Expect(client.Delete(added.ID, "org2")).NotTo(gomega.Succeed())
+
+			networks, err := client.List("org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(networks).To(gomega.HaveLen(1))
+			gomega.Expect(networks[0].ID).To(gomega.Equal(added.ID))
+		})
+
+		ginkgo.It("should delete a network", func() {
+			added, err := client.Add("network", "org1", *ipRange, nil)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(client.Delete(added.ID, "org1")).To(gomega.Succeed())
+			_, err = client.Get(added.ID)
+			gomega.Expect(err).To(gomega.HaveOccurred())
+		})
+
+		ginkgo.It("should claim a network without organization", func() {
+			response, httpErr := postNetwork(`{"name": "legacy"}`)
+			gomega.Expect(httpErr).To(gomega.Succeed())
+			defer response.Body.Close()
+			gomega.Expect(response.StatusCode).To(gomega.Equal(http.StatusOK))
+			legacy := &zt.ZTNetwork{}
+			gomega.Expect(json.NewDecoder(response.Body).Decode(legacy)).To(gomega.Succeed())
+			gomega.Expect(legacy.OrganizationId()).To(gomega.BeEmpty())
+
+			networks, err := client.List("org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(networks).To(gomega.BeEmpty())
+
+			claimed, err := client.Claim(legacy.ID, "org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(claimed.OwnedBy("org1")).To(gomega.BeTrue())
+			gomega.Expect(claimed.ShortName()).To(gomega.Equal("legacy"))
+
+			_, err = client.Claim(legacy.ID, "org2")
+			gomega.Expect(err).To(gomega.HaveOccurred())
+			networks, err = client.List("org1")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(networks).To(gomega.HaveLen(1))
+		})
+
+		ginkgo.It("should not create a network if the request is not valid", func() {
+			response, httpErr := postNetwork("not a network")
+			gomega.Expect(httpErr).To(gomega.Succeed())
+			response.Body.Close()
+			gomega.Expect(response.StatusCode).To(gomega.Equal(http.StatusBadRequest))
+
+			networks, failed, err := client.ListAll()
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(failed).To(gomega.BeEmpty())
+			gomega.Expect(networks).To(gomega.BeEmpty())
+		})
+	})
+
+	ginkgo.Context("members", func() {
+
+		var networkId string
+
+		ginkgo.BeforeEach(func() {
+			added, err := client.Add("network", "org1", *ipRange, nil)
+			gomega.Expect(err).To(gomega.Succeed())
+			networkId = added.ID
+		})
+
+		ginkgo.It("should authorize a member with an IP of the network", func() {
+			gomega.Expect(controller.Join(networkId, "a1b2c3d4e5")).To(gomega.BeTrue())
+			member, err := client.GetMember(networkId, "a1b2c3d4e5")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*member.Authorized).To(gomega.BeFalse())
+
+			gomega.Expect(client.Authorize(networkId, "a1b2c3d4e5")).To(gomega.Succeed())
+			member, err = client.GetMember(networkId, "a1b2c3d4e5")
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(*member.Authorized).To(gomega.BeTrue())
+			gomega.Expect(member.IpAssignments).To(gomega.Equal([]string{"192.168.10.1"}))
+		})
+
+		ginkgo.It("should authorize a member with a static IP", func() {
+			gomega.Expect(client.AuthorizeWithIp(networkId, "a1b2c3d4e5", "192.168.10.20")).To(gomega.Succeed())
+			gomega.Expect(client.Authorize(networkId, "f6a7b8c9d0")).To(gomega.Succeed())
+
+			members, err := client.ListMembers(networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(members).To(gomega.HaveLen(2))
+			for _, member := range members {
+				if member.ID == "a1b2c3d4e5" {
+					gomega.Expect(member.IpAssignments).To(gomega.Equal([]string{"192.168.10.20"}))
+				} else {
+					gomega.Expect(member.IpAssignments).To(gomega.Equal([]string{"192.168.10.1"}))
+				}
+			}
+		})
+
+		ginkgo.It("should record the removed members", func() {
+			gomega.Expect(client.Authorize(networkId, "a1b2c3d4e5")).To(gomega.Succeed())
+			gomega.Expect(client.RemoveMember("org1", networkId, "a1b2c3d4e5", zt.RemovalReasonUnauthorized)).To(gomega.Succeed())
+
+			members, err := client.ListMembers(networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(members).To(gomega.BeEmpty())
+
+			removals, err := client.MemberRemovals("org1", networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removals).To(gomega.HaveLen(1))
+			gomega.Expect(removals[0].MemberId).To(gomega.Equal("a1b2c3d4e5"))
+			gomega.Expect(removals[0].Reason).To(gomega.Equal(zt.RemovalReasonUnauthorized))
+			gomega.Expect(removals[0].IpAssignments).To(gomega.Equal([]string{"192.168.10.1"}))
+			removals, err = client.MemberRemovals("org2", networkId)
+			gomega.Expect(err).To(gomega.Succeed())
+			gomega.Expect(removals).To(gomega.BeEmpty())
+		})
+	})
+})
@@ -18,13 +18,25 @@
 package zt
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/nalej/derrors"
 	"github.com/nalej/dhttp"
 	"github.com/nalej/network-manager/internal/pkg/entities"
+	"github.com/nalej/network-manager/internal/pkg/ipam"
 	"github.com/rs/zerolog/log"
+	"net"
+	"strings"
 	"time"
 )
 
+// IpRangeSeparator separates the IPv4 and IPv6 ranges of a dual-stack network
+const IpRangeSeparator = ipam.StackSeparator
+
+// OrganizationSeparator separates the organization from the name of the network in the controller
+// (<organizationId>/<networkName>)
+const OrganizationSeparator = "/"
+
 type ZTNetwork struct {
 	// 16-digit ZeroTier network ID [ro]
 	ID string `json:"id,omitempty"`
@@ -73,17 +85,169 @@ type ZTNetwork struct {
 	IpAssignmentPools []IpAssignmentPool `json:"ipAssignmentPools,omitempty"`
 	// Traffic rules; see below [rw]
 	Rules []Rule `json:"rules,omitempty"`
+	// Tags referenced by the traffic rules [rw]
+	Tags []Tag `json:"tags,omitempty"`
 }
 
 func (n *ZTNetwork) ToNetwork(organizationId string) entities.Network {
 	return entities.Network{
 		OrganizationId:    organizationId,
 		NetworkId:         n.ID,
-		NetworkName:       n.Name,
+		NetworkName:       n.ShortName(),
 		CreationTimestamp: time.Now().Unix(),
 	}
 }
 
+// organizationName returns the name of a network in the controller, tagged with its organization.
+func organizationName(organizationId string, networkName string) string {
+	return fmt.Sprintf("%s%s%s", organizationId, OrganizationSeparator, networkName)
+}
+
+// OrganizationId returns the organization the network belongs to, or an empty string for networks created
+// without organization.
+func (n *ZTNetwork) OrganizationId() string {
+	tokens := strings.SplitN(n.Name, OrganizationSeparator, 2)
+	if len(tokens) != 2 {
+		return ""
+	}
+	return tokens[0]
+}
+
+// ShortName returns the name of the network without its organization.
+func (n *ZTNetwork) ShortName() string {
+	tokens := strings.SplitN(n.Name, OrganizationSeparator, 2)
+	return tokens[len(tokens)-1]
+}
+
+// OwnedBy checks if the network is tagged with the given organization. Networks created without organization
+// are not owned by any organization until they are claimed.
+func (n *ZTNetwork) OwnedBy(organizationId string) bool {
+	return organizationId != "" && n.OrganizationId() == organizationId
+}
+
+// IpRange returns the assignment pools of the network as a list of ranges separated by commas,
+// the IPv4 range first (192.168.3.1-192.168.3.254,fd6e:616c:656a:3::1-fd6e:616c:656a:3:ffff:ffff:ffff:fffe).
+func (n *ZTNetwork) IpRange() string {
+	ranges := make([]string, len(n.IpAssignmentPools))
+	for i, pool := range n.IpAssignmentPools {
+		ranges[i] = fmt.Sprintf("%s-%s", pool.IpRangeStart, pool.IpRangeEnd)
+	}
+	return strings.Join(ranges, IpRangeSeparator)
+}
+
+// Validate checks that the multicast limit is not negative and that every assignment pool is inside
+// a routed network.
+func (n *ZTNetwork) Validate() derrors.Error {
+	if n.MulticastLimit != nil && *n.MulticastLimit < 0 {
+		return derrors.NewInvalidArgumentError("multicast limit cannot be negative").WithParams(*n.MulticastLimit)
+	}
+	routed := make([]*net.IPNet, 0, len(n.Routes))
+	for _, route := range n.Routes {
+		_, target, err := net.ParseCIDR(route.Target)
+		if err != nil {
+			return derrors.NewInvalidArgumentError("invalid route target").WithParams(route.Target)
+		}
+		routed = append(routed, target)
+	}
+	for _, pool := range n.IpAssignmentPools {
+		start := net.ParseIP(pool.IpRangeStart)
+		end := net.ParseIP(pool.IpRangeEnd)
+		if start == nil || end == nil {
+			return derrors.NewInvalidArgumentError("invalid assignment pool").WithParams(pool)
+		}
+		inside := false
+		for _, target := range routed {
+			if target.Contains(start) && target.Contains(end) {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return derrors.NewInvalidArgumentError("assignment pool is not inside any routed network").WithParams(pool)
+		}
+	}
+	return nil
+}
+
+// ParseIpAssignmentPool parses a range with the format start-end (192.168.3.1-192.168.3.254).
+func ParseIpAssignmentPool(ipRange string) (*IpAssignmentPool, derrors.Error) {
+	limits := strings.Split(ipRange, "-")
+	if len(limits) != 2 || net.ParseIP(limits[0]) == nil || net.ParseIP(limits[1]) == nil {
+		return nil, derrors.NewInvalidArgumentError("incorrect IP range format").WithParams(ipRange)
+	}
+	return &IpAssignmentPool{IpRangeStart: limits[0], IpRangeEnd: limits[1]}, nil
+}
+
+// FreeIp returns the first IPv4 address of the assignment pools of the network that is not in use.
+//   params:
+//     used The addresses already assigned or reserved
+//   returns:
+//     The free address.
+//     Error, if the pools are exhausted.
+func (n *ZTNetwork) FreeIp(used map[string]bool) (string, derrors.Error) {
+	for _, pool := range n.IpAssignmentPools {
+		start := net.ParseIP(pool.IpRangeStart).To4()
+		end := net.ParseIP(pool.IpRangeEnd).To4()
+		if start == nil || end == nil {
+			// IPv6 pools are assigned by the controller
+			continue
+		}
+		for value := binary.BigEndian.Uint32(start); value <= binary.BigEndian.Uint32(end); value++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, value)
+			if !used[ip.String()] {
+				return ip.String(), nil
+			}
+		}
+	}
+	return "", derrors.NewFailedPreconditionError("no free IP found in the network").WithParams(n.ID)
+}
+
+// ZTNetworkPatch with the [rw] fields of a network that can be updated. Nil fields are not modified.
+type ZTNetworkPatch struct {
+	// Short name of network
+	Name *string `json:"name,omitempty"`
+	// IPv4 and IPv6 routes
+	Routes []Route `json:"routes,omitempty"`
+	// IP auto-assign ranges
+	IpAssignmentPools []IpAssignmentPool `json:"ipAssignmentPools,omitempty"`
+	// Maximum recipients for a multicast packet
+	MulticastLimit *int `json:"multicastLimit,omitempty"`
+	// Ethernet ff:ff:ff:ff:ff:ff allowed?
+	EnableBroadcast *bool `json:"enableBroadcast,omitempty"`
+	// Traffic rules
+	Rules []Rule `json:"rules,omitempty"`
+	// Tags referenced by the traffic rules
+	Tags []Tag `json:"tags,omitempty"`
+}
+
+// ApplyTo returns the result of applying the patch to a network.
+func (p *ZTNetworkPatch) ApplyTo(network *ZTNetwork) *ZTNetwork {
+	result := *network
+	if p.Name != nil {
+		result.Name = *p.Name
+	}
+	if p.Routes != nil {
+		result.Routes = p.Routes
+	}
+	if p.IpAssignmentPools != nil {
+		result.IpAssignmentPools = p.IpAssignmentPools
+	}
+	if p.MulticastLimit != nil {
+		result.MulticastLimit = p.MulticastLimit
+	}
+	if p.EnableBroadcast != nil {
+		result.EnableBroadcast = p.EnableBroadcast
+	}
+	if p.Rules != nil {
+		result.Rules = p.Rules
+	}
+	if p.Tags != nil {
+		result.Tags = p.Tags
+	}
+	return &result
+}
+
 type PeerNC struct {
 	client dhttp.Client
 }
@@ -128,6 +292,26 @@ type Rule struct {
 	Not bool `json:"not"`
 	// If true, match is ORed with previous match result state
 	Or bool `json:"or"`
+	// Ethernet frame type (MATCH_ETHERTYPE)
+	EtherType *int `json:"etherType,omitempty"`
+	// IP protocol number (MATCH_IP_PROTOCOL)
+	IpProtocol *int `json:"ipProtocol,omitempty"`
+	// First port of the range (MATCH_IP_SOURCE_PORT_RANGE, MATCH_IP_DEST_PORT_RANGE)
+	Start *int `json:"start,omitempty"`
+	// Last port of the range, inclusive (MATCH_IP_SOURCE_PORT_RANGE, MATCH_IP_DEST_PORT_RANGE)
+	End *int `json:"end,omitempty"`
+	// Tag identifier (MATCH_TAGS_*, MATCH_TAG_*)
+	Id *uint32 `json:"id,omitempty"`
+	// Tag value (MATCH_TAGS_*, MATCH_TAG_*)
+	Value *uint32 `json:"value,omitempty"`
+}
+
+// Tag definition object format
+type Tag struct {
+	// Tag identifier
+	Id uint32 `json:"id"`
+	// Value assigned to members without an explicit value for this tag
+	Default uint32 `json:"default"`
 }
 
 // Peer status, /status
@@ -162,6 +346,17 @@ type PeerStatus struct {
 	VersionRev int `json:"versionRev"`
 }
 
+func (s *PeerStatus) ToControllerStatus() entities.ControllerStatus {
+	return entities.ControllerStatus{
+		Address:           s.Address,
+		Version:           s.Version,
+		Online:            s.Online,
+		TcpFallbackActive: s.TcpFallbackActive,
+		PublicIdentity:    s.PublicIdentity,
+		Clock:             int64(s.Clock),
+	}
+}
+
 func (ztc *ZTClient) GetStatus() (*PeerStatus, derrors.Error) {
 	result := PeerStatus{}
 	response := ztc.client.Get("/status", &result)
@@ -207,6 +402,23 @@ type ZTMember struct {
 	NoAutoAssignIps *bool `json:"noAutoAssignIps,omitempty"`
 	// Member revision counter [ro]
 	MemberRevision *int `json:"memberRevision,omitempty"`
+	// Tags as [id, value] tuples [rw]
+	Tags [][]uint32 `json:"tags,omitempty"`
+}
+
+func (m *ZTMember) ToNetworkMember(organizationId string) entities.NetworkMember {
+	member := entities.NetworkMember{
+		OrganizationId: organizationId,
+		NetworkId:      m.Nwid,
+		MemberId:       m.ID,
+		Authorized:     m.Authorized != nil && *m.Authorized,
+		IpAssignments:  m.IpAssignments,
+		Identity:       m.Identity,
+	}
+	if m.LastAuthorizedTime != nil {
+		member.LastAuthorizedTime = int64(*m.LastAuthorizedTime)
+	}
+	return member
 }
 
 func True() *bool {
@@ -218,3 +430,9 @@ func False() *bool {
 	val := false
 	return &val
 }
+
+// NetworkError describes a network that could not be retrieved from the controller
+type NetworkError struct {
+	NetworkId string
+	Error     derrors.Error
+}
@@ -0,0 +1,127 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zt
+
+import (
+	"github.com/nalej/derrors"
+	"github.com/nalej/network-manager/internal/pkg/entities"
+	"sync"
+	"time"
+)
+
+// DefaultMemberHistorySize is the default number of member removals kept by the history
+const DefaultMemberHistorySize = 1000
+
+// Reasons to remove a member from a network
+const (
+	// The member has been unauthorized by its service
+	RemovalReasonUnauthorized = "unauthorized"
+	// The service of the member is terminating
+	RemovalReasonServiceTerminating = "service terminating"
+	// The connection of the network has been removed
+	RemovalReasonConnectionRemoved = "connection removed"
+	// A new member has taken over the static IP of the member
+	RemovalReasonReplaced = "replaced"
+	// The member is not claimed by anyone in the system model
+	RemovalReasonStale = "stale"
+)
+
+// MemberRemoval with a member removed from a network
+type MemberRemoval struct {
+	// Organization the network belongs to, if known
+	OrganizationId string
+	NetworkId      string
+	MemberId       string
+	// Identity of the member (address and public key), if known
+	Identity string
+	// IPs assigned to the member when it was removed
+	IpAssignments []string
+	Reason        string
+	Timestamp     int64
+}
+
+func (r *MemberRemoval) ToMemberRemoval() entities.MemberRemoval {
+	return entities.MemberRemoval{
+		OrganizationId: r.OrganizationId,
+		NetworkId:      r.NetworkId,
+		MemberId:       r.MemberId,
+		Identity:       r.Identity,
+		IpAssignments:  r.IpAssignments,
+		Reason:         r.Reason,
+		Timestamp:      r.Timestamp,
+	}
+}
+
+// MemberHistory records the members removed by the client.
+type MemberHistory interface {
+	// Add a removal to the history, setting its timestamp if it is not set.
+	Add(removal MemberRemoval) derrors.Error
+	// List the removals of a network of an organization, newest first.
+	List(organizationId string, networkId string) ([]MemberRemoval, derrors.Error)
+}
+
+// MemoryMemberHistory is a bounded history of member removals kept in memory. When it is full, the oldest removals
+// are discarded. The history is lost on exit.
+type MemoryMemberHistory struct {
+	sync.Mutex
+	entries []MemberRemoval
+	// next position to be written
+	next int
+	full bool
+}
+
+// NewMemoryMemberHistory creates an in-memory history that keeps the last size removals.
+func NewMemoryMemberHistory(size int) *MemoryMemberHistory {
+	return &MemoryMemberHistory{entries: make([]MemberRemoval, size)}
+}
+
+// Add a removal to the history.
+func (h *MemoryMemberHistory) Add(removal MemberRemoval) derrors.Error {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	if removal.Timestamp == 0 {
+		removal.Timestamp = time.Now().Unix()
+	}
+	h.entries[h.next] = removal
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+	return nil
+}
+
+// List the removals of a network of an organization, newest first.
+func (h *MemoryMemberHistory) List(organizationId string, networkId string) ([]MemberRemoval, derrors.Error) {
+	h.Lock()
+	defer h.Unlock()
+	count := h.next
+	if h.full {
+		count = len(h.entries)
+	}
+	result := make([]MemberRemoval, 0)
+	for i := 1; i <= count; i++ {
+		entry := h.entries[(h.next-i+len(h.entries))%len(h.entries)]
+		if entry.OrganizationId == organizationId && entry.NetworkId == networkId {
+			result = append(result, entry)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,88 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zt_test
+
+import (
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"github.com/onsi/ginkgo"
+	"github.com/onsi/gomega"
+)
+
+func removal(networkId string, memberId string) zt.MemberRemoval {
+	return zt.MemberRemoval{
+		OrganizationId: "org1",
+		NetworkId:      networkId,
+		MemberId:       memberId,
+		Reason:         zt.RemovalReasonStale,
+	}
+}
+
+func list(history zt.MemberHistory, organizationId string, networkId string) []zt.MemberRemoval {
+	removals, err := history.List(organizationId, networkId)
+	gomega.Expect(err).To(gomega.Succeed())
+	return removals
+}
+
+func memberIds(removals []zt.MemberRemoval) []string {
+	ids := make([]string, len(removals))
+	for i, removal := range removals {
+		ids[i] = removal.MemberId
+	}
+	return ids
+}
+
+var _ = ginkgo.Describe("Member history", func() {
+
+	ginkgo.It("should list the removals of a network newest first", func() {
+		history := zt.NewMemoryMemberHistory(10)
+		gomega.Expect(history.Add(removal("net1", "m1"))).To(gomega.Succeed())
+		gomega.Expect(history.Add(removal("net2", "m2"))).To(gomega.Succeed())
+		gomega.Expect(history.Add(removal("net1", "m3"))).To(gomega.Succeed())
+
+		gomega.Expect(memberIds(list(history, "org1", "net1"))).To(gomega.Equal([]string{"m3", "m1"}))
+		gomega.Expect(memberIds(list(history, "org1", "net2"))).To(gomega.Equal([]string{"m2"}))
+		gomega.Expect(list(history, "org2", "net1")).To(gomega.BeEmpty())
+	})
+
+	ginkgo.It("should discard the oldest removals when it is full", func() {
+		history := zt.NewMemoryMemberHistory(2)
+		gomega.Expect(history.Add(removal("net1", "m1"))).To(gomega.Succeed())
+		gomega.Expect(history.Add(removal("net1", "m2"))).To(gomega.Succeed())
+		gomega.Expect(memberIds(list(history, "org1", "net1"))).To(gomega.Equal([]string{"m2", "m1"}))
+
+		gomega.Expect(history.Add(removal("net1", "m3"))).To(gomega.Succeed())
+		gomega.Expect(memberIds(list(history, "org1", "net1"))).To(gomega.Equal([]string{"m3", "m2"}))
+		gomega.Expect(history.Add(removal("net1", "m4"))).To(gomega.Succeed())
+		gomega.Expect(history.Add(removal("net1", "m5"))).To(gomega.Succeed())
+		gomega.Expect(memberIds(list(history, "org1", "net1"))).To(gomega.Equal([]string{"m5", "m4"}))
+	})
+
+	ginkgo.It("should set the timestamp of the removals", func() {
+		history := zt.NewMemoryMemberHistory(1)
+		gomega.Expect(history.Add(removal("net1", "m1"))).To(gomega.Succeed())
+		removals := list(history, "org1", "net1")
+		gomega.Expect(removals).To(gomega.HaveLen(1))
+		gomega.Expect(removals[0].Timestamp).To(gomega.BeNumerically(">", 0))
+	})
+
+	ginkgo.It("should keep nothing without size", func() {
+		history := zt.NewMemoryMemberHistory(0)
+		gomega.Expect(history.Add(removal("net1", "m1"))).To(gomega.Succeed())
+		gomega.Expect(list(history, "org1", "net1")).To(gomega.BeEmpty())
+	})
+})
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zt
+
+// Rule types supported by the ZeroTier rules engine
+const (
+	RuleActionAccept           = "ACTION_ACCEPT"
+	RuleActionDrop             = "ACTION_DROP"
+	RuleMatchEtherType         = "MATCH_ETHERTYPE"
+	RuleMatchIpProtocol        = "MATCH_IP_PROTOCOL"
+	RuleMatchIpSourcePortRange = "MATCH_IP_SOURCE_PORT_RANGE"
+	RuleMatchIpDestPortRange   = "MATCH_IP_DEST_PORT_RANGE"
+	RuleMatchTagSender         = "MATCH_TAG_SENDER"
+	RuleMatchTagReceiver       = "MATCH_TAG_RECEIVER"
+)
+
+// Ethernet frame types
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+	EtherTypeIPv6 = 0x86dd
+)
+
+// IP protocol numbers
+const (
+	IpProtocolICMP   = 1
+	IpProtocolTCP    = 6
+	IpProtocolUDP    = 17
+	IpProtocolICMPv6 = 58
+)
+
+// RuleSet with the rules to be pushed to a network and the tags they refer to.
+type RuleSet struct {
+	Rules []Rule
+	Tags  []Tag
+}
+
+// MemberTag assigns a value to a tag of a network member.
+type MemberTag struct {
+	Id    uint32
+	Value uint32
+}
+
+func (t MemberTag) toTuple() []uint32 {
+	return []uint32{t.Id, t.Value}
+}
+
+// AcceptRule returns an ACTION_ACCEPT rule.
+func AcceptRule() Rule {
+	return Rule{Type: RuleActionAccept}
+}
+
+// DropRule returns an ACTION_DROP rule.
+func DropRule() Rule {
+	return Rule{Type: RuleActionDrop}
+}
+
+// MatchEtherType returns a rule matching the given ethernet frame type.
+func MatchEtherType(etherType int, not bool, or bool) Rule {
+	return Rule{Type: RuleMatchEtherType, Not: not, Or: or, EtherType: &etherType}
+}
+
+// MatchIpProtocol returns a rule matching the given IP protocol.
+func MatchIpProtocol(protocol int, not bool, or bool) Rule {
+	return Rule{Type: RuleMatchIpProtocol, Not: not, Or: or, IpProtocol: &protocol}
+}
+
+// MatchIpSourcePortRange returns a rule matching the source port range [start, end].
+func MatchIpSourcePortRange(start int, end int) Rule {
+	return Rule{Type: RuleMatchIpSourcePortRange, Start: &start, End: &end}
+}
+
+// MatchIpDestPortRange returns a rule matching the destination port range [start, end].
+func MatchIpDestPortRange(start int, end int) Rule {
+	return Rule{Type: RuleMatchIpDestPortRange, Start: &start, End: &end}
+}
+
+// MatchTagSender returns a rule matching the value of a tag of the sender.
+func MatchTagSender(tag MemberTag, or bool) Rule {
+	return Rule{Type: RuleMatchTagSender, Or: or, Id: &tag.Id, Value: &tag.Value}
+}
+
+// MatchTagReceiver returns a rule matching the value of a tag of the receiver.
+func MatchTagReceiver(tag MemberTag, or bool) Rule {
+	return Rule{Type: RuleMatchTagReceiver, Or: or, Id: &tag.Id, Value: &tag.Value}
+}
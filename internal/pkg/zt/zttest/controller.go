@@ -0,0 +1,375 @@
+/*
+ * Copyright 2019 Nalej
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package zttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nalej/network-manager/internal/pkg/zt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// paths of the controller API
+	controllerPath = "/controller"
+	networkPath    = controllerPath + "/network"
+	// MockupControllerAddress is the 10-digit address of the mockup controller
+	MockupControllerAddress = "ef1a2b3c4d"
+	// MockupControllerVersion is the ZeroTier One version reported by the mockup controller
+	MockupControllerVersion = "1.4.6"
+)
+
+// MockupController is an in-process ZeroTier controller that keeps its networks and members in memory. It
+// implements the subset of the controller API used by the ZTClient, so the client and the managers can be
+// tested end to end without a real controller. It is only linked in the tests and in the builds with the ztmockup
+// tag.
+type MockupController struct {
+	sync.Mutex
+	server      *httptest.Server
+	accessToken string
+	// Networks indexed by network ID
+	networks map[string]*zt.ZTNetwork
+	// Members indexed by network ID and member ID
+	members map[string]map[string]*zt.ZTMember
+	// Counter to generate network IDs
+	lastNetwork int
+}
+
+// NewMockupController starts a new mockup controller. Requests must include the given access token.
+func NewMockupController(accessToken string) *MockupController {
+	m := &MockupController{
+		accessToken: accessToken,
+		networks:    make(map[string]*zt.ZTNetwork, 0),
+		members:     make(map[string]map[string]*zt.ZTMember, 0),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", m.handleStatus)
+	mux.HandleFunc(controllerPath, m.handleController)
+	mux.HandleFunc(networkPath, m.handleNetworkList)
+	mux.HandleFunc(networkPath+"/", m.handleNetwork)
+	m.server = httptest.NewServer(m.authenticate(mux))
+	return m
+}
+
+// URL returns the URL of the mockup controller.
+func (m *MockupController) URL() string {
+	return m.server.URL
+}
+
+// Close stops the mockup controller.
+func (m *MockupController) Close() {
+	m.server.Close()
+}
+
+// Clear cleans the contents of the mockup.
+func (m *MockupController) Clear() {
+	m.Lock()
+	m.networks = make(map[string]*zt.ZTNetwork, 0)
+	m.members = make(map[string]map[string]*zt.ZTMember, 0)
+	m.Unlock()
+}
+
+// Join simulates a node requesting to join a network. The member is not authorized.
+func (m *MockupController) Join(networkId string, memberId string) bool {
+	m.Lock()
+	defer m.Unlock()
+	members, exists := m.members[networkId]
+	if !exists {
+		return false
+	}
+	if _, exists := members[memberId]; !exists {
+		members[memberId] = m.newMember(networkId, memberId)
+	}
+	return true
+}
+
+func (m *MockupController) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-ZT1-Auth") != m.accessToken {
+			writeError(w, http.StatusUnauthorized, "invalid access token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (m *MockupController) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, zt.PeerStatus{
+		Address:        MockupControllerAddress,
+		Clock:          now(),
+		Online:         true,
+		PlanetWorldId:  149604618,
+		PublicIdentity: fmt.Sprintf("%s:0:mockup", MockupControllerAddress),
+		Version:        MockupControllerVersion,
+		VersionMajor:   1,
+		VersionMinor:   4,
+		VersionRev:     6,
+	})
+}
+
+func (m *MockupController) handleController(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"controller": true, "apiVersion": 4, "clock": now()})
+}
+
+func (m *MockupController) handleNetworkList(w http.ResponseWriter, r *http.Request) {
+	m.Lock()
+	defer m.Unlock()
+	ids := make([]string, 0, len(m.networks))
+	for id := range m.networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	writeJSON(w, ids)
+}
+
+// handleNetwork serves /controller/network/{id} and /controller/network/{id}/member[/{member}]
+func (m *MockupController) handleNetwork(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, networkPath+"/"), "/")
+	m.Lock()
+	defer m.Unlock()
+	switch {
+	case len(parts) == 1:
+		m.serveNetwork(w, r, parts[0])
+	case len(parts) == 2 && parts[1] == "member":
+		m.serveMemberList(w, r, parts[0])
+	case len(parts) == 3 && parts[1] == "member":
+		m.serveMember(w, r, parts[0], parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (m *MockupController) serveNetwork(w http.ResponseWriter, r *http.Request, networkId string) {
+	network, exists := m.networks[networkId]
+	created := false
+	if r.Method == http.MethodPost && strings.HasSuffix(networkId, "______") {
+		if strings.TrimSuffix(networkId, "______") != MockupControllerAddress {
+			writeError(w, http.StatusBadRequest, "invalid controller address")
+			return
+		}
+		// the network is only stored once the request is valid
+		networkId = fmt.Sprintf("%s%06x", MockupControllerAddress, m.lastNetwork+1)
+		network = &zt.ZTNetwork{
+			ID:           networkId,
+			Nwid:         networkId,
+			ObjType:      "network",
+			Private:      zt.True(),
+			CreationTime: now(),
+		}
+		exists, created = true, true
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, "network not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !merge(w, r, network) {
+			return
+		}
+		network.ID = networkId
+		network.Nwid = networkId
+		network.LastModified = now()
+		revision := 1
+		if network.Revision != nil {
+			revision = *network.Revision + 1
+		}
+		network.Revision = &revision
+		if created {
+			m.lastNetwork++
+			m.networks[networkId] = network
+			m.members[networkId] = make(map[string]*zt.ZTMember, 0)
+		}
+	case http.MethodDelete:
+		delete(m.networks, networkId)
+		delete(m.members, networkId)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	m.updateCounters(network)
+	network.Clock = now()
+	writeJSON(w, network)
+}
+
+func (m *MockupController) serveMemberList(w http.ResponseWriter, r *http.Request, networkId string) {
+	members, exists := m.members[networkId]
+	if !exists {
+		writeError(w, http.StatusNotFound, "network not found")
+		return
+	}
+	revisions := make(map[string]int, len(members))
+	for id, member := range members {
+		revisions[id] = *member.Revision
+	}
+	writeJSON(w, revisions)
+}
+
+func (m *MockupController) serveMember(w http.ResponseWriter, r *http.Request, networkId string, memberId string) {
+	members, exists := m.members[networkId]
+	if !exists {
+		writeError(w, http.StatusNotFound, "network not found")
+		return
+	}
+	member, exists := members[memberId]
+	if !exists && r.Method != http.MethodPost {
+		writeError(w, http.StatusNotFound, "member not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !exists {
+			member = m.newMember(networkId, memberId)
+		}
+		wasAuthorized := *member.Authorized
+		if !merge(w, r, member) {
+			return
+		}
+		members[memberId] = member
+		member.ID = memberId
+		member.Address = memberId
+		member.Nwid = networkId
+		member.LastModified = now()
+		revision := *member.Revision + 1
+		member.Revision = &revision
+		if *member.Authorized && !wasAuthorized {
+			authorizedTime := now()
+			member.LastAuthorizedTime = &authorizedTime
+			m.assignIp(m.networks[networkId], member)
+		} else if !*member.Authorized && wasAuthorized {
+			deauthorizedTime := now()
+			member.LastDeauthorizedTime = &deauthorizedTime
+		}
+	case http.MethodDelete:
+		delete(members, memberId)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	member.Clock = now()
+	writeJSON(w, member)
+}
+
+func (m *MockupController) newMember(networkId string, memberId string) *zt.ZTMember {
+	revision := 0
+	lastAuthorized := 0
+	lastDeauthorized := 0
+	return &zt.ZTMember{
+		ID:                   memberId,
+		Address:              memberId,
+		ObjType:              "member",
+		Nwid:                 networkId,
+		CreationTime:         now(),
+		Revision:             &revision,
+		Authorized:           zt.False(),
+		LastAuthorizedTime:   &lastAuthorized,
+		LastDeauthorizedTime: &lastDeauthorized,
+		ActiveBridge:         zt.False(),
+		Identity:             fmt.Sprintf("%s:0:mockup", memberId),
+		IpAssignments:        make([]string, 0),
+		NoAutoAssignIps:      zt.False(),
+	}
+}
+
+// assignIp assigns the first free IPv4 address of the pools of the network if the member has none.
+func (m *MockupController) assignIp(network *zt.ZTNetwork, member *zt.ZTMember) {
+	if network == nil || network.V4AssignMode == nil || !network.V4AssignMode.Zt ||
+		len(member.IpAssignments) > 0 || (member.NoAutoAssignIps != nil && *member.NoAutoAssignIps) {
+		return
+	}
+	used := make(map[string]bool, 0)
+	for _, other := range m.members[network.ID] {
+		for _, ip := range other.IpAssignments {
+			used[ip] = true
+		}
+	}
+	ip, err := network.FreeIp(used)
+	if err != nil {
+		// pools exhausted, the member gets no address as in the controller
+		return
+	}
+	member.IpAssignments = []string{ip}
+}
+
+func (m *MockupController) updateCounters(network *zt.ZTNetwork) {
+	authorized := 0
+	total := len(m.members[network.ID])
+	for _, member := range m.members[network.ID] {
+		if member.Authorized != nil && *member.Authorized {
+			authorized++
+		}
+	}
+	active := 0
+	network.AuthorizedMemberCount = &authorized
+	network.ActiveMemberCount = &active
+	network.TotalMemberCount = &total
+}
+
+// merge applies the fields of the request body over the current value of the entity, as the controller does
+// with partial updates.
+func merge(w http.ResponseWriter, r *http.Request, entity interface{}) bool {
+	current, err := json.Marshal(entity)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	fields := make(map[string]json.RawMessage, 0)
+	if err = json.Unmarshal(current, &fields); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return false
+	}
+	update := make(map[string]json.RawMessage, 0)
+	if err = json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	for field, value := range update {
+		fields[field] = value
+	}
+	merged, err := json.Marshal(fields)
+	if err == nil {
+		err = json.Unmarshal(merged, entity)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func now() int {
+	return int(time.Now().UnixNano() / int64(time.Millisecond))
+}